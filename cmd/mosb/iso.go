@@ -40,6 +40,11 @@ var isoCmd = cli.Command{
 					Usage: "Update type, complete or partial",
 					Value: "complete",
 				},
+				cli.StringFlag{
+					Name:  "storage-type",
+					Usage: "Storage type, atomfs or puzzlefs",
+					Value: "atomfs",
+				},
 			},
 		},
 	},
@@ -61,16 +66,24 @@ func doBuildISO(ctx *cli.Context) error {
 		return err
 	}
 
-	// TODO product should come from certificate
-	product := "de6c82c5-2e01-4c92-949b-a6545d30fc06"
+	storageType, err := mosconfig.ParseStorageType(ctx.String("storage-type"))
+	if err != nil {
+		return err
+	}
+
+	product, err := mosconfig.ProductFromCert(cert)
+	if err != nil {
+		return err
+	}
 
 	iso := mosconfig.ISOConfig{
-		InputFile:  ctx.String("file"),
-		OutputFile: ctx.String("output-file"),
-		Product:    product,
-		Cert:       cert,
-		Key:        key,
-		UpdateType: updateType,
+		InputFile:   ctx.String("file"),
+		OutputFile:  ctx.String("output-file"),
+		Product:     product,
+		Cert:        cert,
+		Key:         key,
+		UpdateType:  updateType,
+		StorageType: storageType,
 	}
 
 	// TODO - do we need to do some cosign integration for
@@ -50,6 +50,14 @@ var sociCmd = cli.Command{
 					Usage: "OCI path for signed oci layer to create",
 					Value: "oci:meta",
 				},
+				cli.BoolFlag{
+					Name:  "skip-tls",
+					Usage: "Do not verify the TLS certificate of docker:// urls (or use plain http)",
+				},
+				cli.StringFlag{
+					Name:  "cert-dir",
+					Usage: "Directory with the CA certificates (*.crt) for docker:// urls",
+				},
 			},
 		},
 	},
@@ -84,6 +92,8 @@ func doBuildSOCI(ctx *cli.Context) error {
 		Meta:        meta,
 		Cert:        cert,
 		Key:         key,
+		SkipTLS:     ctx.Bool("skip-tls"),
+		CertDir:     ctx.String("cert-dir"),
 	}
 
 	// TODO - do we need to do some cosign integration for
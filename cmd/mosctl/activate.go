@@ -27,6 +27,27 @@ var activateCmd = cli.Command{
 			Usage: "Manifest CA path",
 			Value: "/factory/secure/manifestCA.pem",
 		},
+		cli.BoolFlag{
+			Name:  "wait",
+			Usage: "Wait until the target is ready (healthy, if it has a healthcheck)",
+		},
+		cli.DurationFlag{
+			Name:  "wait-timeout",
+			Usage: "How long --wait waits for the target to be ready",
+			Value: mosconfig.DefaultReadyTimeout,
+		},
+		cli.BoolFlag{
+			Name:  "no-idmapped-mounts",
+			Usage: "Shift containers' files instead of mounting them idmapped",
+		},
+		cli.BoolFlag{
+			Name:  "reboot",
+			Usage: "When activating hostfs, reboot into it now",
+		},
+		cli.BoolFlag{
+			Name:  "kexec",
+			Usage: "When activating hostfs, kexec into it now",
+		},
 	},
 }
 
@@ -41,21 +62,49 @@ func doActivate(ctx *cli.Context) error {
 		target = "hostfs"
 	}
 
+	action := mosconfig.BootNone
+	if ctx.Bool("reboot") && ctx.Bool("kexec") {
+		return fmt.Errorf("--reboot and --kexec cannot be used together")
+	}
+	if ctx.Bool("reboot") {
+		action = mosconfig.BootReboot
+	} else if ctx.Bool("kexec") {
+		action = mosconfig.BootKexec
+	}
+	if action != mosconfig.BootNone && target != "hostfs" {
+		return fmt.Errorf("--reboot and --kexec are only for hostfs")
+	}
+
 	opts := mosconfig.DefaultMosOptions()
 	opts.RootDir = rfs
 	capath := ctx.String("capath")
 	if capath != "" {
 		opts.CaPath = capath
 	}
+	opts.NoIdmappedMounts = ctx.Bool("no-idmapped-mounts")
 	mos, err := mosconfig.OpenMos(opts)
 	if err != nil {
 		return fmt.Errorf("Failed opening mos: %w", err)
 	}
 
-	err = mos.Activate(target)
+	if target == "hostfs" {
+		err = mos.ActivateHostfs(action)
+	} else {
+		err = mos.Activate(target)
+	}
 	if err != nil {
 		return fmt.Errorf("Failed to activate %s: %w", target, err)
 	}
 
+	if ctx.Bool("wait") {
+		t, err := mos.Current(target)
+		if err != nil {
+			return err
+		}
+		if err := mos.WaitReady(t, ctx.Duration("wait-timeout")); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/urfave/cli"
+)
+
+// cniHookCmd is run by lxc when a container with a cni network starts
+// or stops.  lxc passes the container name, "lxc", the hook type and,
+// for the stop hook, the container's namespaces.
+var cniHookCmd = cli.Command{
+	Name:   "cni-hook",
+	Usage:  "set up or tear down a container's CNI network (lxc hook)",
+	Hidden: true,
+	Action: doCNIHook,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+	},
+}
+
+func doCNIHook(ctx *cli.Context) error {
+	args := ctx.Args()
+	name := os.Getenv("LXC_NAME")
+	hookType := os.Getenv("LXC_HOOK_TYPE")
+	if name == "" && len(args) > 0 {
+		name = args[0]
+	}
+	if hookType == "" && len(args) > 2 {
+		hookType = args[2]
+	}
+	if name == "" || hookType == "" {
+		return fmt.Errorf("cni-hook must be run as an lxc hook")
+	}
+
+	extra := []string{}
+	if len(args) > 3 {
+		extra = args[3:]
+	}
+	return mosconfig.RunCNIHook(ctx.String("root"), name, hookType, extra)
+}
@@ -53,16 +53,21 @@ func doCreateBootfs(ctx *cli.Context) error {
 	opts.StorageCache = ctx.String("atomfs-store")
 	opts.ScratchWrites = ctx.String("scratch-dir")
 	opts.CaPath = ctx.String("ca-path")
+	// We may need to count down the boot tries of a pending update
+	opts.LayersReadOnly = false
+	opts.ManifestReadOnly = false
 
 	m, err := mosconfig.OpenMos(opts)
 	if err != nil {
 		return errors.Wrapf(err, "Error opening mos")
 	}
+	defer m.Close()
 
-	t, err := m.Current("hostfs")
+	t, err := m.BootTarget("hostfs")
 	if err != nil {
 		return errors.Wrapf(err, "Error getting hostfs target information")
 	}
+	log.Infof("Booting hostfs version %q", t.Version)
 
 	dest := ctx.String("dest")
 	if ctx.Bool("readonly") {
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/urfave/cli"
+)
+
+var gcCmd = cli.Command{
+	Name:   "gc",
+	Usage:  "remove images, volumes and nsgroup uid ranges which are no longer used by the system manifest",
+	Action: doGC,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+		cli.StringFlag{
+			Name:  "capath, ca",
+			Usage: "Manifest CA path",
+			Value: "/factory/secure/manifestCA.pem",
+		},
+		cli.IntFlag{
+			Name:  "keep",
+			Usage: "Number of previous system manifests whose images to keep for rollback",
+			Value: mosconfig.DefaultGCKeep,
+		},
+	},
+}
+
+func doGC(ctx *cli.Context) error {
+	mos, err := openWriteableMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	if err := mos.GC(ctx.Int("keep")); err != nil {
+		return fmt.Errorf("Garbage collection failed: %w", err)
+	}
+	return nil
+}
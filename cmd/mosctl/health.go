@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/urfave/cli"
+)
+
+// healthMonitorCmd is run by the health unit of a container target with
+// a healthcheck.
+var healthMonitorCmd = cli.Command{
+	Name:      "health-monitor",
+	Usage:     "run a container's healthcheck, restarting it when it fails",
+	ArgsUsage: "<target>",
+	Hidden:    true,
+	Action:    doHealthMonitor,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+	},
+}
+
+func doHealthMonitor(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		return fmt.Errorf("A target name is required")
+	}
+	return mosconfig.RunHealthMonitor(ctx.String("root"), ctx.Args()[0])
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/urfave/cli"
+)
+
+var historyFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "root, rfs, r",
+		Usage: "Directory under which to find the mos install",
+		Value: "/",
+	},
+	cli.StringFlag{
+		Name:  "capath, ca",
+		Usage: "Manifest CA path",
+		Value: "/factory/secure/manifestCA.pem",
+	},
+	cli.BoolFlag{
+		Name:  "json",
+		Usage: "Print as json",
+	},
+}
+
+var historyCmd = cli.Command{
+	Name:   "history",
+	Usage:  "list the revisions of the system manifest",
+	Action: doHistory,
+	Flags:  historyFlags,
+	Subcommands: []cli.Command{
+		cli.Command{
+			Name:      "diff",
+			Usage:     "show the targets added, removed or changed between two revisions",
+			ArgsUsage: "<rev1> <rev2>",
+			Action:    doHistoryDiff,
+			Flags:     historyFlags,
+		},
+	},
+}
+
+func openHistoryMos(ctx *cli.Context) (*mosconfig.Mos, error) {
+	rfs := ctx.String("root")
+	if rfs == "" || !mosconfig.PathExists(rfs) {
+		return nil, fmt.Errorf("A valid root directory must be specified")
+	}
+
+	opts := mosconfig.DefaultMosOptions()
+	opts.RootDir = rfs
+	capath := ctx.String("capath")
+	if capath != "" {
+		opts.CaPath = capath
+	}
+
+	mos, err := mosconfig.OpenMos(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening mos: %w", err)
+	}
+	return mos, nil
+}
+
+func printJSON(v interface{}) error {
+	bytes, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("Failed marshalling json: %w", err)
+	}
+	fmt.Println(string(bytes))
+	return nil
+}
+
+func doHistory(ctx *cli.Context) error {
+	if ctx.NArg() != 0 {
+		return fmt.Errorf("Unknown history subcommand %q", ctx.Args().First())
+	}
+
+	mos, err := openHistoryMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	revisions, err := mos.History()
+	if err != nil {
+		return fmt.Errorf("Failed reading manifest history: %w", err)
+	}
+
+	if ctx.Bool("json") {
+		return printJSON(revisions)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "COMMIT\tTIME\tACTION\tRELEASE\tSIGNER\tCHANGES")
+	for _, r := range revisions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Commit[:12], r.Time.Format(time.RFC3339), orDash(r.Action),
+			orDash(r.Serial), orDash(r.Signer), orDash(strings.Join(r.Changes, ", ")))
+	}
+	return w.Flush()
+}
+
+func doHistoryDiff(ctx *cli.Context) error {
+	if ctx.NArg() != 2 {
+		return fmt.Errorf("Two revisions are needed")
+	}
+
+	mos, err := openHistoryMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	changes, err := mos.DiffRevisions(ctx.Args().Get(0), ctx.Args().Get(1))
+	if err != nil {
+		return fmt.Errorf("Failed comparing manifest revisions: %w", err)
+	}
+
+	if ctx.Bool("json") {
+		return printJSON(changes)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tCHANGE\tFIELD\tOLD\tNEW")
+	for _, c := range changes {
+		if len(c.Fields) == 0 {
+			fmt.Fprintf(w, "%s\t%s\t-\t-\t-\n", c.Name, c.Change)
+			continue
+		}
+		for _, f := range c.Fields {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				c.Name, c.Change, f.Field, orDash(f.Old), orDash(f.New))
+		}
+	}
+	return w.Flush()
+}
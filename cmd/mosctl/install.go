@@ -11,7 +11,7 @@ var installCmd = cli.Command{
 	Name:   "install",
 	Usage:  "install a new mos system",
 	Action: doInstall,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:  "f, file",
 			Usage: "File from which to read the install manifest",
@@ -27,7 +27,12 @@ var installCmd = cli.Command{
 			Usage: "Directory under which atomfs store is kept",
 			Value: "/atomfs-store",
 		},
-	},
+		cli.StringFlag{
+			Name:  "init",
+			Usage: "What runs container services: systemd or supervisor ('mosctl supervise')",
+			Value: "systemd",
+		},
+	}, registryFlags...),
 }
 
 func doInstall(ctx *cli.Context) error {
@@ -42,7 +47,12 @@ func doInstall(ctx *cli.Context) error {
 		return fmt.Errorf("mos config directory not found")
 	}
 
-	if err := mosconfig.InitializeMos(store, config, ctx.String("file")); err != nil {
+	initType, err := mosconfig.ParseInitType(ctx.String("init"))
+	if err != nil {
+		return err
+	}
+
+	if err := mosconfig.InitializeMos(store, config, ctx.String("file"), initType, registryOpts(ctx)); err != nil {
 		return err
 	}
 
@@ -16,9 +16,18 @@ func main() {
 	app.Commands = []cli.Command{
 		createBootFsCmd,
 		activateCmd,
+		cniHookCmd,
+		healthMonitorCmd,
+		historyCmd,
+		confirmBootCmd,
+		gcCmd,
 		installCmd,
+		rollbackCmd,
 		sociCmd,
+		statusCmd,
+		superviseCmd,
 		updateCmd,
+		verifyBootCmd,
 	}
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/urfave/cli"
+)
+
+// Flags shared by commands which can pull target images from a registry.
+var registryFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "registry",
+		Usage: "Registry from which to pull target images, e.g. docker://zothub.local:5000/machine",
+		Value: "",
+	},
+	cli.BoolFlag{
+		Name:  "registry-skip-tls",
+		Usage: "Do not verify the registry's TLS certificate (or use plain http)",
+	},
+	cli.StringFlag{
+		Name:  "registry-cert-dir",
+		Usage: "Directory with the CA certificates (*.crt) for the registry, and optionally a client *.cert and *.key",
+		Value: "",
+	},
+	cli.StringFlag{
+		Name:  "registry-auth",
+		Usage: "yaml file containing the registry username and password",
+		Value: "",
+	},
+}
+
+func registryOpts(ctx *cli.Context) mosconfig.RegistryOpts {
+	return mosconfig.RegistryOpts{
+		Base:     ctx.String("registry"),
+		SkipTLS:  ctx.Bool("registry-skip-tls"),
+		CertDir:  ctx.String("registry-cert-dir"),
+		AuthFile: ctx.String("registry-auth"),
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/urfave/cli"
+)
+
+var rollbackCmd = cli.Command{
+	Name:   "rollback",
+	Usage:  "discard a pending update, or return to the system manifest before the last update",
+	Action: doRollback,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+		cli.StringFlag{
+			Name:  "capath, ca",
+			Usage: "Manifest CA path",
+			Value: "/factory/secure/manifestCA.pem",
+		},
+	},
+}
+
+var confirmBootCmd = cli.Command{
+	Name:   "confirm-boot",
+	Usage:  "make a pending update which has successfully booted the current system manifest",
+	Action: doConfirmBoot,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+		cli.StringFlag{
+			Name:  "capath, ca",
+			Usage: "Manifest CA path",
+			Value: "/factory/secure/manifestCA.pem",
+		},
+	},
+}
+
+var verifyBootCmd = cli.Command{
+	Name:   "verify-boot",
+	Usage:  "confirm a pending update if its hostfs was booted, or roll it back once it has failed to boot",
+	Action: doVerifyBoot,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+		cli.StringFlag{
+			Name:  "capath, ca",
+			Usage: "Manifest CA path",
+			Value: "/factory/secure/manifestCA.pem",
+		},
+	},
+}
+
+func openWriteableMos(ctx *cli.Context) (*mosconfig.Mos, error) {
+	rfs := ctx.String("root")
+	if rfs == "" || !mosconfig.PathExists(rfs) {
+		return nil, fmt.Errorf("A valid root directory must be specified")
+	}
+
+	opts := mosconfig.DefaultMosOptions()
+	opts.RootDir = rfs
+	opts.LayersReadOnly = false
+	opts.ManifestReadOnly = false
+	capath := ctx.String("capath")
+	if capath != "" {
+		opts.CaPath = capath
+	}
+
+	mos, err := mosconfig.OpenMos(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Failed opening mos: %w", err)
+	}
+	return mos, nil
+}
+
+func doRollback(ctx *cli.Context) error {
+	mos, err := openWriteableMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	if err := mos.Rollback(); err != nil {
+		return fmt.Errorf("Rollback failed: %w", err)
+	}
+	return nil
+}
+
+func doConfirmBoot(ctx *cli.Context) error {
+	mos, err := openWriteableMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	if err := mos.ConfirmBoot(); err != nil {
+		return fmt.Errorf("Failed confirming the pending update: %w", err)
+	}
+	return nil
+}
+
+func doVerifyBoot(ctx *cli.Context) error {
+	mos, err := openWriteableMos(ctx)
+	if err != nil {
+		return err
+	}
+	defer mos.Close()
+
+	return mos.VerifyBoot()
+}
@@ -35,6 +35,24 @@ var sociCmd = cli.Command{
 					Name:  "mountpoint, dest",
 					Usage: "Directory onto which to mount the layer",
 				},
+				cli.StringFlag{
+					Name:  "cache-dir",
+					Usage: "Directory to which images from a docker:// repo-base are synced",
+					Value: "/scratch-writes/soci-cache",
+				},
+				cli.BoolFlag{
+					Name:  "skip-tls",
+					Usage: "Do not verify the TLS certificate of a docker:// repo-base (or use plain http)",
+				},
+				cli.StringFlag{
+					Name:  "cert-dir",
+					Usage: "Directory with the CA certificates (*.crt) for a docker:// repo-base",
+				},
+				cli.StringFlag{
+					Name:  "registry-auth",
+					Usage: "yaml file containing the username and password for a docker:// repo-base",
+					Value: "",
+				},
 			},
 		},
 	},
@@ -52,5 +70,12 @@ func mountSOci(ctx *cli.Context) error {
 	metalayer := ctx.String("meta")
 	capath := ctx.String("ca")
 
-	return mosconfig.MountSOCI(repobase, metalayer, capath, mp)
+	repoOpts := mosconfig.RepoOpts{
+		CacheDir: ctx.String("cache-dir"),
+		SkipTLS:  ctx.Bool("skip-tls"),
+		CertDir:  ctx.String("cert-dir"),
+		AuthFile: ctx.String("registry-auth"),
+	}
+
+	return mosconfig.MountSOCI(repobase, metalayer, capath, mp, repoOpts)
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/urfave/cli"
+)
+
+var statusCmd = cli.Command{
+	Name:   "status",
+	Usage:  "show the installed, running and pending versions of each target",
+	Action: doStatus,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+		cli.StringFlag{
+			Name:  "capath, ca",
+			Usage: "Manifest CA path",
+			Value: "/factory/secure/manifestCA.pem",
+		},
+		cli.BoolFlag{
+			Name:  "json",
+			Usage: "Print the status as json",
+		},
+		cli.BoolFlag{
+			Name:  "usage",
+			Usage: "Show the resource limits and current usage of containers",
+		},
+	},
+}
+
+func doStatus(ctx *cli.Context) error {
+	rfs := ctx.String("root")
+	if rfs == "" || !mosconfig.PathExists(rfs) {
+		return fmt.Errorf("A valid root directory must be specified")
+	}
+
+	opts := mosconfig.DefaultMosOptions()
+	opts.RootDir = rfs
+	capath := ctx.String("capath")
+	if capath != "" {
+		opts.CaPath = capath
+	}
+
+	mos, err := mosconfig.OpenMos(opts)
+	if err != nil {
+		return fmt.Errorf("Failed opening mos: %w", err)
+	}
+	defer mos.Close()
+
+	status, err := mos.Status()
+	if err != nil {
+		return fmt.Errorf("Failed getting status: %w", err)
+	}
+
+	if ctx.Bool("json") {
+		bytes, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return fmt.Errorf("Failed marshalling status: %w", err)
+		}
+		fmt.Println(string(bytes))
+		return nil
+	}
+
+	if ctx.Bool("usage") {
+		return printUsage(status)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tIMAGE\tVERSION\tMOUNTED\tPENDING\tSTATE\tHEALTH\tNSGROUP\tUIDS\tADDRESSES\tHASH")
+	for _, s := range status {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Name, s.ServiceType, s.ImagePath, s.Version,
+			orDash(s.MountedVersion), orDash(s.PendingVersion), s.State,
+			orDash(s.Health), orDash(s.NSGroup), orDash(s.UidRange),
+			orDash(strings.Join(s.Addresses, ",")), orDash(s.ManifestHash))
+	}
+	return w.Flush()
+}
+
+// printUsage prints the resource limits and usage of container targets.
+func printUsage(status []mosconfig.TargetStatus) error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSTATE\tMEMORY\tMEMORY-MAX\tCPU-SECONDS\tCPU-MAX\tPIDS\tPIDS-MAX")
+	for _, s := range status {
+		if s.ServiceType != mosconfig.ContainerService {
+			continue
+		}
+		limits := mosconfig.Resources{}
+		if s.Resources != nil {
+			limits = *s.Resources
+		}
+		mem, cpu, pids := "", "", ""
+		if s.Usage != nil {
+			mem = strconv.FormatInt(s.Usage.MemoryCurrent, 10)
+			cpu = fmt.Sprintf("%.2f", float64(s.Usage.CPUUsageUsec)/1e6)
+			pids = strconv.FormatInt(s.Usage.PidsCurrent, 10)
+		}
+		pidsMax := ""
+		if limits.PidsMax != 0 {
+			pidsMax = strconv.FormatInt(limits.PidsMax, 10)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Name, s.State, orDash(mem), orDash(limits.MemoryMax),
+			orDash(cpu), orDash(limits.CPUMax), orDash(pids), orDash(pidsMax))
+	}
+	return w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
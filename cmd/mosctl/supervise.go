@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/project-machine/mos/pkg/mosconfig"
+	"github.com/urfave/cli"
+)
+
+// superviseCmd runs the container services on systems installed with
+// --init supervisor.  It should be started by the system's init, and
+// runs until it is killed.
+var superviseCmd = cli.Command{
+	Name:   "supervise",
+	Usage:  "run and restart container services, on systems without systemd",
+	Action: doSupervise,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "root, rfs, r",
+			Usage: "Directory under which to find the mos install",
+			Value: "/",
+		},
+	},
+}
+
+func doSupervise(ctx *cli.Context) error {
+	rfs := ctx.String("root")
+	if rfs == "" || !mosconfig.PathExists(rfs) {
+		return fmt.Errorf("A valid root directory must be specified")
+	}
+	return mosconfig.RunSupervisor(rfs)
+}
@@ -11,7 +11,7 @@ var updateCmd = cli.Command{
 	Name:   "update",
 	Usage:  "update a mos system",
 	Action: doUpdate,
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.StringFlag{
 			Name:  "f, file",
 			Usage: "File from which to read the install manifest",
@@ -27,7 +27,34 @@ var updateCmd = cli.Command{
 			Usage: "Manifest CA path",
 			Value: "/factory/secure/manifestCA.pem",
 		},
-	},
+		cli.BoolFlag{
+			Name:  "pending",
+			Usage: "Only use the update once the new hostfs has booted and been confirmed",
+		},
+		cli.IntFlag{
+			Name:  "boot-tries",
+			Usage: "Number of times to try booting a pending update before falling back",
+			Value: mosconfig.DefaultBootTries,
+		},
+		cli.BoolFlag{
+			Name:  "activate",
+			Usage: "Activate the updated container targets, and roll back if they do not become ready",
+		},
+		cli.DurationFlag{
+			Name:  "wait-timeout",
+			Usage: "How long --activate waits for each updated target to be ready",
+			Value: mosconfig.DefaultReadyTimeout,
+		},
+		cli.BoolFlag{
+			Name:  "gc",
+			Usage: "Remove images which are no longer used once the update is done",
+		},
+		cli.IntFlag{
+			Name:  "gc-keep",
+			Usage: "Number of previous system manifests whose images --gc keeps for rollback",
+			Value: mosconfig.DefaultGCKeep,
+		},
+	}, registryFlags...),
 }
 
 func doUpdate(ctx *cli.Context) error {
@@ -42,6 +69,7 @@ func doUpdate(ctx *cli.Context) error {
 	if capath != "" {
 		opts.CaPath = capath
 	}
+	opts.Registry = registryOpts(ctx)
 
 	mos, err := mosconfig.OpenMos(opts)
 	if err != nil {
@@ -50,10 +78,25 @@ func doUpdate(ctx *cli.Context) error {
 	defer mos.Close()
 
 	cpath := ctx.String("file")
-	err = mos.Update(cpath)
+	if ctx.Bool("pending") && ctx.Bool("activate") {
+		return fmt.Errorf("--pending and --activate cannot be used together")
+	}
+	if ctx.Bool("pending") {
+		err = mos.StageUpdate(cpath, ctx.Int("boot-tries"))
+	} else if ctx.Bool("activate") {
+		err = mos.UpdateAndActivate(cpath, ctx.Duration("wait-timeout"))
+	} else {
+		err = mos.Update(cpath)
+	}
 	if err != nil {
 		return fmt.Errorf("Update using %q failed: %w", cpath, err)
 	}
 
+	if ctx.Bool("gc") {
+		if err := mos.GC(ctx.Int("gc-keep")); err != nil {
+			return fmt.Errorf("Garbage collection after update failed: %w", err)
+		}
+	}
+
 	return nil
 }
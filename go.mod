@@ -2,7 +2,11 @@ module github.com/project-machine/mos
 
 require (
 	github.com/apex/log v1.9.0
+	github.com/containers/image/v5 v5.16.1
+	github.com/cyphar/filepath-securejoin v0.2.3
+	github.com/docker/go-units v0.5.0
 	github.com/go-git/go-git/v5 v5.4.2
+	github.com/google/uuid v1.3.0
 	github.com/lxc/lxd v0.0.0-20230109185737-f7ccf0330640
 	github.com/msoap/byline v1.1.1
 	github.com/opencontainers/image-spec v1.0.3-0.20220303224323-02efb9a75ee1
@@ -30,18 +34,15 @@ require (
 	github.com/canonical/go-sp800.108-kdf v0.0.0-20210314145419-a3359f2d21b9 // indirect
 	github.com/canonical/go-tpm2 v0.0.0-20220823192114-7a7993f0fa1f // indirect
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
-	github.com/containers/image/v5 v5.16.1 // indirect
 	github.com/containers/libtrust v0.0.0-20200511145503-9c3a6c22cd9a // indirect
 	github.com/containers/ocicrypt v1.1.3 // indirect
 	github.com/containers/storage v1.37.0 // indirect
 	github.com/cpuguy83/go-md2man/v2 v2.0.2 // indirect
-	github.com/cyphar/filepath-securejoin v0.2.3 // indirect
 	github.com/docker/distribution v2.8.1+incompatible // indirect
 	github.com/docker/docker v23.0.0-rc.1+incompatible // indirect
 	github.com/docker/docker-credential-helpers v0.7.0 // indirect
 	github.com/docker/go-connections v0.4.0 // indirect
 	github.com/docker/go-metrics v0.0.1 // indirect
-	github.com/docker/go-units v0.5.0 // indirect
 	github.com/emirpasic/gods v1.12.0 // indirect
 	github.com/flosch/pongo2 v0.0.0-20200913210552-0d938eb266f3 // indirect
 	github.com/freddierice/go-losetup v0.0.0-20220331141030-7ad00c49b973 // indirect
@@ -50,7 +51,6 @@ require (
 	github.com/go-git/go-billy/v5 v5.3.1 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
-	github.com/google/uuid v1.3.0 // indirect
 	github.com/gorilla/mux v1.8.0 // indirect
 	github.com/gorilla/websocket v1.5.0 // indirect
 	github.com/hashicorp/errwrap v1.1.0 // indirect
@@ -0,0 +1,301 @@
+package mosconfig
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// A CNINetwork is a CNI network configuration shipped in an install
+// manifest.  Container targets with a 'cni' network name one of these in
+// their network's cni_network.
+type CNINetwork struct {
+	Name string `yaml:"name"`
+
+	// The CNI network configuration list (or single network
+	// configuration), as json.
+	Config string `yaml:"config"`
+}
+
+// Directories in which CNI plugins are looked for.
+const DefaultCNIPath = "/opt/cni/bin:/usr/libexec/cni:/usr/lib/cni"
+
+// The interface name which CNI plugins create in the container.
+const cniIfName = "eth0"
+
+type cniConfList struct {
+	CNIVersion string                   `json:"cniVersion"`
+	Name       string                   `json:"name"`
+	Plugins    []map[string]interface{} `json:"plugins"`
+}
+
+// parseCNIConfig parses a CNI network configuration list.  A single
+// plugin network configuration is turned into a list of one.
+func parseCNIConfig(config string) (cniConfList, error) {
+	conf := cniConfList{}
+	if err := json.Unmarshal([]byte(config), &conf); err != nil {
+		return conf, fmt.Errorf("Failed parsing CNI configuration: %w", err)
+	}
+	if len(conf.Plugins) == 0 {
+		single := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(config), &single); err != nil {
+			return conf, fmt.Errorf("Failed parsing CNI configuration: %w", err)
+		}
+		conf.Plugins = []map[string]interface{}{single}
+	}
+
+	if conf.Name == "" {
+		return conf, fmt.Errorf("CNI configuration has no name")
+	}
+	if conf.CNIVersion == "" {
+		return conf, fmt.Errorf("CNI configuration %q has no cniVersion", conf.Name)
+	}
+	for _, p := range conf.Plugins {
+		ptype, ok := p["type"].(string)
+		if !ok || ptype == "" || strings.Contains(ptype, "/") {
+			return conf, fmt.Errorf("CNI configuration %q has a bad plugin type %v", conf.Name, p["type"])
+		}
+	}
+	return conf, nil
+}
+
+func (n CNINetwork) Validate() error {
+	if n.Name == "" || strings.ContainsAny(n.Name, "/ \t\n") {
+		return fmt.Errorf("Bad CNI network name %q", n.Name)
+	}
+	if _, err := parseCNIConfig(n.Config); err != nil {
+		return fmt.Errorf("Bad CNI network %q: %w", n.Name, err)
+	}
+	return nil
+}
+
+// validateCNINetworks checks the install manifest's CNI networks, and
+// that every target with a cni network names one of them.
+func (af *InstallFile) validateCNINetworks() error {
+	names := map[string]bool{}
+	for _, n := range af.CNINetworks {
+		if err := n.Validate(); err != nil {
+			return err
+		}
+		if names[n.Name] {
+			return fmt.Errorf("CNI network %q is defined twice", n.Name)
+		}
+		names[n.Name] = true
+	}
+	for _, t := range af.Targets {
+		if t.Network.Type == CNINetworkType && !names[t.Network.CNINetwork] {
+			return fmt.Errorf("Target %s uses undefined CNI network %q", t.ServiceName, t.Network.CNINetwork)
+		}
+	}
+	return nil
+}
+
+func findCNINetwork(cf InstallFile, name string) (*CNINetwork, bool) {
+	for _, n := range cf.CNINetworks {
+		if n.Name == name {
+			return &n, true
+		}
+	}
+	return nil, false
+}
+
+// The CNI configuration and the result of the last ADD are kept in the
+// container's lxc configuration directory.
+func cniConfigPath(lxcconfigDir string) string {
+	return filepath.Join(lxcconfigDir, "cni.conflist")
+}
+
+func cniResultPath(lxcconfigDir string) string {
+	return filepath.Join(lxcconfigDir, "cni-result.json")
+}
+
+// setupCNINetwork writes the CNI configuration for @t's container into
+// @lxcconfigDir, and returns the lxc configuration which gives it an
+// empty network namespace and calls 'mosctl cni-hook' to run the CNI
+// plugins when it starts and stops.
+func (mos *Mos) setupCNINetwork(t *Target, lxcconfigDir string) ([]string, error) {
+	syst, err := mos.GetSystarget(t)
+	if err != nil {
+		return []string{}, err
+	}
+	if syst.cniNetwork == nil {
+		return []string{}, fmt.Errorf("No CNI network %q found for %s", t.Network.CNINetwork, t.ServiceName)
+	}
+
+	if err := os.WriteFile(cniConfigPath(lxcconfigDir), []byte(syst.cniNetwork.Config), 0644); err != nil {
+		return []string{}, fmt.Errorf("Failed writing CNI configuration for %s: %w", t.ServiceName, err)
+	}
+
+	mosctl, err := os.Executable()
+	if err != nil {
+		return []string{}, fmt.Errorf("Failed finding mosctl: %w", err)
+	}
+	hook := fmt.Sprintf("%s cni-hook --root %s", mosctl, mos.opts.RootDir)
+	return []string{
+		"lxc.net.0.type = empty",
+		"lxc.hook.start-host = " + hook,
+		"lxc.hook.stop = " + hook,
+	}, nil
+}
+
+// runCNIPlugin runs CNI plugin @conf for command @command, and returns
+// its output.
+func runCNIPlugin(command, containerID, netns string, conf map[string]interface{}) ([]byte, error) {
+	ptype := conf["type"].(string)
+	cniPath := os.Getenv("CNI_PATH")
+	if cniPath == "" {
+		cniPath = DefaultCNIPath
+	}
+	plugin := ""
+	for _, dir := range filepath.SplitList(cniPath) {
+		if PathExists(filepath.Join(dir, ptype)) {
+			plugin = filepath.Join(dir, ptype)
+			break
+		}
+	}
+	if plugin == "" {
+		return nil, fmt.Errorf("CNI plugin %q not found in %s", ptype, cniPath)
+	}
+
+	stdin, err := json.Marshal(conf)
+	if err != nil {
+		return nil, fmt.Errorf("Failed marshalling configuration for CNI plugin %q: %w", ptype, err)
+	}
+
+	cmd := exec.Command(plugin)
+	cmd.Env = append(os.Environ(),
+		"CNI_COMMAND="+command,
+		"CNI_CONTAINERID="+containerID,
+		"CNI_NETNS="+netns,
+		"CNI_IFNAME="+cniIfName,
+		"CNI_PATH="+cniPath)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("CNI plugin %q %s failed: %w: %s %s", ptype, command, err, stdout.String(), stderr.String())
+	}
+	return stdout.Bytes(), nil
+}
+
+// cniAdd runs the plugins of @conf in order to attach container @name's
+// network namespace @netns, and returns the final result.
+func cniAdd(conf cniConfList, name, netns string) ([]byte, error) {
+	var result []byte
+	for _, p := range conf.Plugins {
+		p["name"] = conf.Name
+		p["cniVersion"] = conf.CNIVersion
+		if result != nil {
+			p["prevResult"] = json.RawMessage(result)
+		}
+		out, err := runCNIPlugin("ADD", name, netns, p)
+		if err != nil {
+			return nil, err
+		}
+		result = out
+	}
+	return result, nil
+}
+
+// cniDel runs the plugins of @conf in reverse order to detach container
+// @name.  @result is the result of the ADD, if known.
+func cniDel(conf cniConfList, name, netns string, result []byte) error {
+	var lastErr error
+	for i := len(conf.Plugins) - 1; i >= 0; i-- {
+		p := conf.Plugins[i]
+		p["name"] = conf.Name
+		p["cniVersion"] = conf.CNIVersion
+		if result != nil {
+			p["prevResult"] = json.RawMessage(result)
+		}
+		// Keep going, so that every plugin can release what it holds
+		if _, err := runCNIPlugin("DEL", name, netns, p); err != nil {
+			log.Warnf("%v", err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// RunCNIHook is run by lxc, through 'mosctl cni-hook', when container
+// @name with a cni network starts or stops.  @hookType is lxc's hook
+// type, and @args are the extra arguments lxc passed to the hook.
+func RunCNIHook(rootDir, name, hookType string, args []string) error {
+	lxcconfigDir := filepath.Join(rootDir, "var/lib/lxc", name)
+	content, err := os.ReadFile(cniConfigPath(lxcconfigDir))
+	if err != nil {
+		return fmt.Errorf("Failed reading CNI configuration for %s: %w", name, err)
+	}
+	conf, err := parseCNIConfig(string(content))
+	if err != nil {
+		return err
+	}
+
+	switch hookType {
+	case "start-host":
+		pid := os.Getenv("LXC_PID")
+		if pid == "" {
+			return fmt.Errorf("LXC_PID is not set for %s", name)
+		}
+		netns := fmt.Sprintf("/proc/%s/ns/net", pid)
+		result, err := cniAdd(conf, name, netns)
+		if err != nil {
+			return fmt.Errorf("Failed setting up CNI network for %s: %w", name, err)
+		}
+		if err := os.WriteFile(cniResultPath(lxcconfigDir), result, 0644); err != nil {
+			return fmt.Errorf("Failed writing CNI result for %s: %w", name, err)
+		}
+		return nil
+	case "stop":
+		// lxc passes the container's namespaces as type:path
+		netns := ""
+		for _, a := range args {
+			if strings.HasPrefix(a, "net:") {
+				netns = strings.TrimPrefix(a, "net:")
+			}
+		}
+		result, err := os.ReadFile(cniResultPath(lxcconfigDir))
+		if err != nil {
+			result = nil
+		}
+		err = cniDel(conf, name, netns, result)
+		os.Remove(cniResultPath(lxcconfigDir))
+		if err != nil {
+			return fmt.Errorf("Failed tearing down CNI network for %s: %w", name, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unhandled lxc hook type %q", hookType)
+	}
+}
+
+// cniAddresses returns the addresses which the CNI plugins gave to
+// container @name when it was last started.
+func cniAddresses(rootDir, name string) []string {
+	lxcconfigDir := filepath.Join(rootDir, "var/lib/lxc", name)
+	content, err := os.ReadFile(cniResultPath(lxcconfigDir))
+	if err != nil {
+		return nil
+	}
+	result := struct {
+		IPs []struct {
+			Address string `json:"address"`
+		} `json:"ips"`
+	}{}
+	if err := json.Unmarshal(content, &result); err != nil {
+		log.Warnf("Failed parsing CNI result for %s: %v", name, err)
+		return nil
+	}
+	addrs := []string{}
+	for _, ip := range result.IPs {
+		addrs = append(addrs, ip.Address)
+	}
+	return addrs
+}
@@ -0,0 +1,156 @@
+package mosconfig
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// ordering returns the targets which @t must start after.
+func (t *Target) ordering() []string {
+	return append(append([]string{}, t.DependsOn...), t.After...)
+}
+
+// ValidateDependencies checks a target's own depends_on and after
+// lists.  Whether the targets they name exist is checked against the
+// whole system manifest by validateDependencies.
+func (t Target) ValidateDependencies() error {
+	deps := t.ordering()
+	if len(deps) != 0 && t.ServiceType != ContainerService {
+		return fmt.Errorf("Only container targets can have dependencies")
+	}
+	seen := map[string]bool{}
+	for _, d := range deps {
+		if d == "" {
+			return fmt.Errorf("Empty dependency")
+		}
+		if d == t.ServiceName {
+			return fmt.Errorf("Target cannot depend on itself")
+		}
+		if seen[d] {
+			return fmt.Errorf("Dependency %s is listed twice", d)
+		}
+		seen[d] = true
+	}
+	return nil
+}
+
+// validateDependencies checks that the targets which each of @targets
+// depends on or is ordered after are container targets in @targets, and
+// that there are no cycles.
+func validateDependencies(targets []*Target) error {
+	byName := map[string]*Target{}
+	for _, t := range targets {
+		byName[t.ServiceName] = t
+	}
+
+	for _, t := range targets {
+		for _, d := range t.ordering() {
+			dep, ok := byName[d]
+			if !ok {
+				return fmt.Errorf("Target %s depends on missing target %s", t.ServiceName, d)
+			}
+			if dep.ServiceType != ContainerService {
+				return fmt.Errorf("Target %s depends on %s, which is not a container", t.ServiceName, d)
+			}
+		}
+	}
+
+	// depth first search, looking for a target which is already on
+	// the current path
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := map[string]int{}
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return fmt.Errorf("Dependency cycle: %s", strings.Join(append(path, name), " -> "))
+		case done:
+			return nil
+		}
+		state[name] = visiting
+		for _, d := range byName[name].ordering() {
+			if err := visit(d, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		return nil
+	}
+	for _, t := range targets {
+		if err := visit(t.ServiceName, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unitDependencies returns the [Unit] lines ordering @t's service after
+// those of its dependencies.
+func unitDependencies(t *Target) string {
+	lines := ""
+	for _, d := range t.DependsOn {
+		lines += fmt.Sprintf("Requires=%s.service\n", d)
+	}
+	for _, d := range t.ordering() {
+		lines += fmt.Sprintf("After=%s.service\n", d)
+	}
+	return lines
+}
+
+// runningDependents returns the running targets which depend on @t,
+// directly or through other targets.  systemd stops these along with
+// @t, so they need to be started again once @t is back.
+func (mos *Mos) runningDependents(t *Target) ([]*Target, error) {
+	manifest, err := mos.CurrentManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	ret := []*Target{}
+	found := map[string]bool{t.ServiceName: true}
+	queue := []string{t.ServiceName}
+	for len(queue) != 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, st := range manifest.SysTargets {
+			dep := st.raw
+			if found[dep.ServiceName] {
+				continue
+			}
+			for _, d := range dep.DependsOn {
+				if d != name {
+					continue
+				}
+				found[dep.ServiceName] = true
+				queue = append(queue, dep.ServiceName)
+				state, err := mos.runState(dep)
+				if err != nil {
+					return nil, err
+				}
+				if state == StateRunning {
+					ret = append(ret, dep)
+				}
+				break
+			}
+		}
+	}
+	return ret, nil
+}
+
+// restartDependents starts @dependents again after the target they
+// depend on was restarted.
+func (mos *Mos) restartDependents(dependents []*Target) {
+	for _, d := range dependents {
+		log.Infof("Restarting dependent target %q", d.ServiceName)
+		if err := mos.startInit(d); err != nil {
+			log.Warnf("Failed restarting %s: %v", d.ServiceName, err)
+		}
+	}
+}
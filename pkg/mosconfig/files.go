@@ -5,8 +5,8 @@ import (
 	"os"
 	"strings"
 
+	"github.com/google/uuid"
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
-	"github.com/project-machine/trust/pkg/trust"
 	"gopkg.in/yaml.v2"
 	imagesource "stackerbuild.io/stacker/pkg/types"
 )
@@ -57,17 +57,29 @@ type MountSpec struct {
 	Options string `yaml:"options"`
 }
 
-// Only host network supported right now.
-// To do: simple/nat, CNI
+// A container can share the host's network, have no network, be
+// attached to the host bridge with a 'simple' network, or have its
+// network set up by CNI plugins.
 type TargetNetworkType string
 
 const (
-	HostNetwork TargetNetworkType = "host"
-	NoNetwork   TargetNetworkType = "none"
+	HostNetwork    TargetNetworkType = "host"
+	NoNetwork      TargetNetworkType = "none"
+	SimpleNetwork  TargetNetworkType = "simple"
+	CNINetworkType TargetNetworkType = "cni"
 )
 
 type TargetNetwork struct {
 	Type TargetNetworkType `yaml:"type"`
+
+	// For simple networks: an optional fixed address in the host's
+	// subnet, and ports to forward from the host to the container.
+	Address string        `yaml:"address"`
+	Ports   []PortForward `yaml:"ports"`
+
+	// For cni networks: the name of a CNI network in the install
+	// manifest's cni_networks.
+	CNINetwork string `yaml:"cni_network"`
 }
 
 type ServiceType string
@@ -79,14 +91,21 @@ const (
 )
 
 type Target struct {
-	ServiceName  string        `yaml:"service_name"` // name of target
-	ImagePath    string        `yaml:"imagepath"`    // full image repository path
-	Version      string        `yaml:"version"`      // docker or oci version tag
-	ServiceType  ServiceType   `yaml:"service_type"`
-	Network      TargetNetwork `yaml:"network"`
-	NSGroup      string        `yaml:"nsgroup"`
-	Mounts       []*MountSpec  `yaml:"mounts"`
-	ManifestHash string        `yaml:"manifest_hash"`
+	ServiceName  string          `yaml:"service_name"` // name of target
+	ImagePath    string          `yaml:"imagepath"`    // full image repository path
+	Version      string          `yaml:"version"`      // docker or oci version tag
+	ServiceType  ServiceType     `yaml:"service_type"`
+	Network      TargetNetwork   `yaml:"network"`
+	NSGroup      string          `yaml:"nsgroup"`
+	Mounts       []*MountSpec    `yaml:"mounts"`
+	Volumes      []VolumeSpec    `yaml:"volumes"`
+	Idmap        []IdmapSpec     `yaml:"idmap"`
+	Resources    *Resources      `yaml:"resources"`
+	Security     *SecurityPolicy `yaml:"security"`
+	DependsOn    []string        `yaml:"depends_on"` // targets which must be running
+	After        []string        `yaml:"after"`      // targets to start after, if present
+	Healthcheck  *Healthcheck    `yaml:"healthcheck"`
+	ManifestHash string          `yaml:"manifest_hash"`
 }
 type InstallTargets []Target
 
@@ -99,16 +118,51 @@ type InstallFile struct {
 	Version     int            `yaml:"version"`
 	ImageType   ImageType      `yaml:"image_type"`
 	Product     string         `yaml:"product"`
+	Serial      int64          `yaml:"serial"` // release serial, never decreasing
 	Targets     InstallTargets `yaml:"targets"`
 	UpdateType  UpdateType     `yaml:"update_type"`
 	StorageType StorageType    `yaml:"storage_type"`
+	CNINetworks []CNINetwork   `yaml:"cni_networks"`
+
+	SeccompPolicies []SeccompPolicy `yaml:"seccomp_policies"`
 }
 
-// Note we only do combined uid+gid ranges, range 65536, and only starting at
-// container id 0.
-type IdmapSet struct {
-	Name   string `yaml:"idmap-name"` // This is the NSGroup specified in target
+// Which ids an idmap entry maps.
+type IdType string
+
+const (
+	IdBoth IdType = "both" // the default
+	IdUid  IdType = "uid"
+	IdGid  IdType = "gid"
+)
+
+// IdmapSpec is one entry of a target's idmap.  It maps Range container
+// ids starting at Nsid onto the host ids starting at Hostid if that is
+// set, else onto the ids at offset Nsid in the nsgroup's host range.
+type IdmapSpec struct {
+	Type   IdType `yaml:"type"`
+	Nsid   int64  `yaml:"nsid"`
+	Hostid *int64 `yaml:"hostid"`
+	Range  int64  `yaml:"range"`
+}
+
+// IdmapEntry maps Range container ids starting at Nsid onto the host
+// ids starting at Hostid.
+type IdmapEntry struct {
+	Type   IdType `yaml:"type"`
+	Nsid   int64  `yaml:"nsid"`
 	Hostid int64  `yaml:"hostid"`
+	Range  int64  `yaml:"range"`
+}
+
+// IdmapSet is the host id range allocated to an nsgroup.  Entries are
+// the nsgroup's idmap, resolved to host ids.  Without Entries, both uids
+// and gids from container id 0 are mapped onto the whole range.
+type IdmapSet struct {
+	Name    string       `yaml:"idmap-name"` // This is the NSGroup specified in target
+	Hostid  int64        `yaml:"hostid"`
+	Range   int64        `yaml:"range"` // 0 in older manifests, meaning the default
+	Entries []IdmapEntry `yaml:"entries,omitempty"`
 }
 
 // SysTarget exists as an intermediary between a 'system manifest'
@@ -117,9 +171,11 @@ type SysTarget struct {
 	Name   string `yaml:"name"`   // the name of the target
 	Source string `yaml:"source"` // the content address manifest file defining it
 
-	raw         *Target
-	OCIManifest ispec.Manifest
-	OCIConfig   ispec.Image
+	raw           *Target
+	cniNetwork    *CNINetwork
+	seccompPolicy *SeccompPolicy
+	OCIManifest   ispec.Manifest
+	OCIConfig     ispec.Image
 }
 type SysTargets []SysTarget
 
@@ -141,15 +197,30 @@ func (af *InstallFile) Validate() error {
 	if af.Product == "" {
 		return fmt.Errorf("Must specify a product")
 	}
+	if _, err := uuid.Parse(af.Product); err != nil {
+		return fmt.Errorf("Bad product %q: %w", af.Product, err)
+	}
 
 	if af.Version > CurrentInstallFileVersion || af.Version < 1 {
 		return fmt.Errorf("unsupported atomix file version: %d", af.Version)
 	}
 
+	if af.Serial < 0 {
+		return fmt.Errorf("Release serial cannot be negative")
+	}
+
 	if err := af.Targets.Validate(); err != nil {
 		return err
 	}
 
+	if err := af.validateCNINetworks(); err != nil {
+		return err
+	}
+
+	if err := af.validateSeccompPolicies(); err != nil {
+		return err
+	}
+
 	if af.UpdateType == "" {
 		af.UpdateType = PartialUpdate
 	}
@@ -177,19 +248,21 @@ func simpleParseInstall(manifestPath string) (InstallFile, error) {
 // caPath is the CA cert to verify certPath.  This comes from signed initrd.
 // srcDir is only passed if we are in an install or update step.  In this
 //
-//	case, we copy the layers from either srcDir/zot or srcDir/oci, into
+//	case, we copy the layers from either srcDir/zot or srcDir/oci, or from
+//	the registry if srcDir is a docker:// url, into
 //	persistent storage.  If srcDir is "", then we are parsing an installed
 //	manifest and layers are already installed.
 //
 // s is the storage driver, currently always an atomfs.
-func ReadVerifyManifest(manifestPath, certPath, caPath, srcDir string, s Storage) (InstallFile, error) {
+// check says whether certPath may be revoked or expired.
+func ReadVerifyManifest(manifestPath, certPath, caPath, srcDir string, s Storage, check SignerCheck) (InstallFile, error) {
 	bytes, err := os.ReadFile(manifestPath)
 	if err != nil {
 		return InstallFile{}, fmt.Errorf("Failed reading manifest: %w", err)
 	}
 	sigPath := manifestPath + ".signed"
 
-	if err := trust.VerifyManifest(bytes, sigPath, certPath, caPath); err != nil {
+	if err := check.VerifyManifest(bytes, sigPath, certPath, caPath); err != nil {
 		return InstallFile{}, err
 	}
 
@@ -199,6 +272,17 @@ func ReadVerifyManifest(manifestPath, certPath, caPath, srcDir string, s Storage
 		return InstallFile{}, fmt.Errorf("Failed parsing manifest: %w", err)
 	}
 
+	// A new manifest must be for the product its signer is for
+	if !check.Installed {
+		product, err := ProductFromCert(certPath)
+		if err != nil {
+			return InstallFile{}, err
+		}
+		if manifest.Product != product {
+			return InstallFile{}, fmt.Errorf("Manifest is for product %q, but its signer is for product %q", manifest.Product, product)
+		}
+	}
+
 	// We've verified the install.yaml contents.  Now verify that the container
 	// image manifest files pointed to have not been altered.
 	for _, t := range manifest.Targets {
@@ -235,12 +319,40 @@ func (ts InstallTargets) Validate() error {
 			return fmt.Errorf("Target %s cannot have empty version", t.ServiceName)
 		}
 
-		if !t.ValidateNetwork() {
-			return fmt.Errorf("Target %s has bad network: %#v", t.ServiceName, t.Network)
+		if err := t.ValidateNetwork(); err != nil {
+			return fmt.Errorf("Target %s has bad network: %w", t.ServiceName, err)
+		}
+
+		if err := t.ValidateMounts(); err != nil {
+			return fmt.Errorf("Target %s has bad mounts: %w", t.ServiceName, err)
+		}
+
+		if err := t.ValidateVolumes(); err != nil {
+			return fmt.Errorf("Target %s has bad volumes: %w", t.ServiceName, err)
+		}
+
+		if err := t.ValidateIdmap(); err != nil {
+			return fmt.Errorf("Target %s has bad idmap: %w", t.ServiceName, err)
+		}
+
+		if err := t.ValidateResources(); err != nil {
+			return fmt.Errorf("Target %s has bad resources: %w", t.ServiceName, err)
+		}
+
+		if err := t.ValidateSecurity(); err != nil {
+			return fmt.Errorf("Target %s has bad security policy: %w", t.ServiceName, err)
+		}
+
+		if err := t.ValidateDependencies(); err != nil {
+			return fmt.Errorf("Target %s has bad dependencies: %w", t.ServiceName, err)
+		}
+
+		if err := t.ValidateHealthcheck(); err != nil {
+			return fmt.Errorf("Target %s has bad healthcheck: %w", t.ServiceName, err)
 		}
 	}
 
-	return nil
+	return ts.validateNSGroups()
 }
 
 // From a list of targets provided by the user, build an install.yaml.
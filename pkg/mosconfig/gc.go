@@ -0,0 +1,365 @@
+package mosconfig
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/opencontainers/umoci"
+	"gopkg.in/yaml.v2"
+	stackeroci "stackerbuild.io/stacker/pkg/oci"
+)
+
+// The default number of previous system manifests whose images are kept
+// by GC, so that we can still roll back to them.
+const DefaultGCKeep = 1
+
+// targetsAt returns the targets listed in the system manifest at
+// manifest.git commit @commit.  The install manifests are not verified,
+// since we only use them to decide what to keep.
+func targetsAt(commit *object.Commit) ([]*Target, error) {
+	f, err := commit.File("manifest.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("Failed finding manifest.yaml in %s: %w", commit.Hash, err)
+	}
+	contents, err := f.Contents()
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading manifest.yaml in %s: %w", commit.Hash, err)
+	}
+
+	var sysmanifest SysManifest
+	if err := yaml.Unmarshal([]byte(contents), &sysmanifest); err != nil {
+		return nil, fmt.Errorf("Failed parsing manifest.yaml in %s: %w", commit.Hash, err)
+	}
+
+	installs := map[string]InstallFile{}
+	targets := []*Target{}
+	for _, st := range sysmanifest.SysTargets {
+		cf, ok := installs[st.Source]
+		if !ok {
+			f, err := commit.File(st.Source)
+			if err != nil {
+				return nil, fmt.Errorf("Failed finding %s in %s: %w", st.Source, commit.Hash, err)
+			}
+			contents, err := f.Contents()
+			if err != nil {
+				return nil, fmt.Errorf("Failed reading %s in %s: %w", st.Source, commit.Hash, err)
+			}
+			if err := yaml.Unmarshal([]byte(contents), &cf); err != nil {
+				return nil, fmt.Errorf("Failed parsing %s in %s: %w", st.Source, commit.Hash, err)
+			}
+			installs[st.Source] = cf
+		}
+		t, ok := findTarget(cf, st.Name)
+		if !ok {
+			return nil, fmt.Errorf("target %s not found in %s", st.Name, st.Source)
+		}
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
+
+// referencedTargets returns all targets in the current system manifest,
+// the @keep system manifests before it, and any pending update.
+func (mos *Mos) referencedTargets(keep int) ([]*Target, error) {
+	mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+	repo, _, err := openManifestRepo(mPath)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []*object.Commit{}
+
+	head, err := repo.Reference(plumbing.Master, true)
+	if err != nil {
+		return nil, fmt.Errorf("Failed finding the current manifest: %w", err)
+	}
+	hash := head.Hash()
+	for i := 0; i <= keep; i++ {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading manifest commit %s: %w", hash, err)
+		}
+		commits = append(commits, commit)
+		if commit.NumParents() == 0 {
+			break
+		}
+		hash = commit.ParentHashes[0]
+	}
+
+	pending, err := repo.Reference(pendingBranch, true)
+	if err == nil {
+		commit, err := repo.CommitObject(pending.Hash())
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading pending update: %w", err)
+		}
+		commits = append(commits, commit)
+	} else if err != plumbing.ErrReferenceNotFound {
+		return nil, fmt.Errorf("Failed looking for a pending update: %w", err)
+	}
+
+	seen := map[string]bool{}
+	ret := []*Target{}
+	for _, c := range commits {
+		targets, err := targetsAt(c)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range targets {
+			key := t.ImagePath + ":" + t.Version + "@" + t.ManifestHash
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			ret = append(ret, t)
+		}
+	}
+
+	return ret, nil
+}
+
+// GC removes all images from storage which are not used by the current
+// system manifest, the @keep system manifests before it, or a pending
+// update, as well as the volumes of targets which none of those list.
+// It also releases the dropped nsgroup ranges which are not in use.
+func (mos *Mos) GC(keep int) error {
+	if keep < 0 {
+		return fmt.Errorf("Number of manifests to keep must not be negative")
+	}
+
+	targets, err := mos.referencedTargets(keep)
+	if err != nil {
+		return fmt.Errorf("Failed finding referenced images: %w", err)
+	}
+
+	if err := mos.storage.GC(targets); err != nil {
+		return err
+	}
+
+	if err := mos.gcVolumes(targets); err != nil {
+		return err
+	}
+
+	return mos.releaseIdmaps()
+}
+
+// gcLayout removes all tags from the OCI layout at @ociDir which are not
+// listed in @keep, and then all manifests and blobs which are no longer
+// reachable.
+func gcLayout(ociDir string, keep map[string]bool) error {
+	oci, err := umoci.OpenLayout(ociDir)
+	if err != nil {
+		return fmt.Errorf("Failed opening OCI layout %q: %w", ociDir, err)
+	}
+	defer oci.Close()
+
+	tags, err := oci.ListReferences(context.Background())
+	if err != nil {
+		return fmt.Errorf("Failed listing images in %q: %w", ociDir, err)
+	}
+
+	for _, tag := range tags {
+		if keep[tag] {
+			continue
+		}
+		log.Infof("removing unreferenced image %s from %q", tag, ociDir)
+		if err := oci.DeleteReference(context.Background(), tag); err != nil {
+			return fmt.Errorf("Failed removing %s from %q: %w", tag, ociDir, err)
+		}
+	}
+
+	if err := oci.GC(context.Background()); err != nil {
+		return fmt.Errorf("Failed removing unreferenced blobs from %q: %w", ociDir, err)
+	}
+
+	return nil
+}
+
+// GC removes the zot repos, tags and blobs which are not used by any of
+// @keep, as well as atomfs metadata for layers which are no longer
+// mounted.
+func (a *AtomfsStorage) GC(keep []*Target) error {
+	// zot repo path -> tags to keep
+	repos := map[string]map[string]bool{}
+	for _, t := range keep {
+		if repos[t.ImagePath] == nil {
+			repos[t.ImagePath] = map[string]bool{}
+		}
+		repos[t.ImagePath][t.Version] = true
+	}
+
+	layouts := []string{}
+	err := filepath.WalkDir(a.zotPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() || path == a.zotPath {
+			return nil
+		}
+		if PathExists(filepath.Join(path, "index.json")) {
+			layouts = append(layouts, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("Failed walking zot storage %q: %w", a.zotPath, err)
+	}
+
+	for _, dir := range layouts {
+		rel, err := filepath.Rel(a.zotPath, dir)
+		if err != nil {
+			return err
+		}
+		tags, ok := repos[rel]
+		if !ok {
+			log.Infof("removing unreferenced image repo %q", rel)
+			if err := os.RemoveAll(dir); err != nil {
+				return fmt.Errorf("Failed removing %q: %w", dir, err)
+			}
+			continue
+		}
+		if err := gcLayout(dir, tags); err != nil {
+			return err
+		}
+	}
+
+	return a.gcMetadata()
+}
+
+// gcMetadata removes the atomfs mountpoints for layers which are no
+// longer mounted, as well as leftover readonly mountpoints from
+// writeable overlays.  Only empty directories are removed.
+func (a *AtomfsStorage) gcMetadata() error {
+	stale := []string{}
+
+	mountsDir := filepath.Join(a.metadataPath(), "mounts")
+	entries, err := os.ReadDir(mountsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed reading atomfs metadata: %w", err)
+	}
+	for _, e := range entries {
+		stale = append(stale, filepath.Join(mountsDir, e.Name()))
+	}
+
+	entries, err = os.ReadDir(a.scratchPath)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed reading %q: %w", a.scratchPath, err)
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.Contains(e.Name(), "-scratch-readonly-") {
+			stale = append(stale, filepath.Join(a.scratchPath, e.Name()))
+		}
+	}
+
+	for _, dir := range stale {
+		mounted, err := IsMountpoint(dir)
+		if err != nil {
+			return fmt.Errorf("Failed checking whether %q is mounted: %w", dir, err)
+		}
+		if mounted {
+			continue
+		}
+		if err := os.Remove(dir); err != nil {
+			log.Warnf("Failed removing stale atomfs mountpoint %q: %v", dir, err)
+		}
+	}
+
+	return nil
+}
+
+// GC removes the tags which are not used by any of @keep, and then all
+// blobs which none of the remaining images use.  Blobs are only removed
+// if every remaining image has a record of its blobs, since images
+// imported without one may use any of them.
+func (p *PuzzlefsStorage) GC(keep []*Target) error {
+	tags := map[string]bool{}
+	for _, t := range keep {
+		tags[puzzlefsTag(t)] = true
+	}
+
+	oci, err := umoci.OpenLayout(p.storePath)
+	if err != nil {
+		return fmt.Errorf("Failed opening OCI layout %q: %w", p.storePath, err)
+	}
+	defer oci.Close()
+
+	existing, err := oci.ListReferences(context.Background())
+	if err != nil {
+		return fmt.Errorf("Failed listing images in %q: %w", p.storePath, err)
+	}
+
+	live := map[string]bool{}
+	recorded := true
+	for _, tag := range existing {
+		if !tags[tag] {
+			log.Infof("removing unreferenced image %s", tag)
+			if err := oci.DeleteReference(context.Background(), tag); err != nil {
+				return fmt.Errorf("Failed removing %s: %w", tag, err)
+			}
+			if err := os.Remove(p.blobRecord(tag)); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("Failed removing the blob record of %s: %w", tag, err)
+			}
+			continue
+		}
+
+		blobs, err := p.readBlobRecord(tag)
+		if err != nil {
+			return fmt.Errorf("Failed reading the blob record of %s: %w", tag, err)
+		}
+		if blobs == nil {
+			log.Warnf("No blob record for %s, not removing any blobs", tag)
+			recorded = false
+			continue
+		}
+		for _, b := range blobs {
+			live[b] = true
+		}
+
+		// The manifest, config and rootfs of the image
+		dps, err := oci.ResolveReference(context.Background(), tag)
+		if err != nil {
+			return fmt.Errorf("Failed resolving %s: %w", tag, err)
+		}
+		for _, dp := range dps {
+			for _, d := range dp.Walk {
+				live[d.Digest.Encoded()] = true
+			}
+		}
+		manifest, err := stackeroci.LookupManifest(oci, tag)
+		if err != nil {
+			return fmt.Errorf("Failed reading the manifest of %s: %w", tag, err)
+		}
+		live[manifest.Config.Digest.Encoded()] = true
+		for _, l := range manifest.Layers {
+			live[l.Digest.Encoded()] = true
+		}
+	}
+	if !recorded {
+		return nil
+	}
+
+	blobs, err := layoutBlobs(p.storePath)
+	if err != nil {
+		return err
+	}
+	removed := 0
+	for _, b := range blobs {
+		if live[b] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(p.storePath, "blobs", "sha256", b)); err != nil {
+			return fmt.Errorf("Failed removing unreferenced blob %s: %w", b, err)
+		}
+		removed++
+	}
+	log.Infof("removed %d of %d puzzlefs blobs", removed, len(blobs))
+
+	return nil
+}
@@ -0,0 +1,355 @@
+package mosconfig
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/go-git/go-git/v5/plumbing"
+	"gopkg.in/yaml.v2"
+)
+
+// A Healthcheck is a command which is run inside a container target
+// every Interval to check that it works.  If it fails (or takes longer
+// than Timeout) Retries times in a row, the target is restarted.
+type Healthcheck struct {
+	Command  []string `yaml:"command"`
+	Interval string   `yaml:"interval"` // e.g. 30s
+	Timeout  string   `yaml:"timeout"`
+	Retries  int      `yaml:"retries"`
+}
+
+const (
+	DefaultHealthInterval = 30 * time.Second
+	DefaultHealthTimeout  = 10 * time.Second
+	DefaultHealthRetries  = 3
+
+	// How long to wait for an activated target to be ready
+	DefaultReadyTimeout = 5 * time.Minute
+)
+
+// Health states reported by Status
+const (
+	HealthStarting  = "starting"
+	HealthHealthy   = "healthy"
+	HealthUnhealthy = "unhealthy"
+)
+
+func parseHealthDuration(d string, def time.Duration) (time.Duration, error) {
+	if d == "" {
+		return def, nil
+	}
+	ret, err := time.ParseDuration(d)
+	if err != nil {
+		return 0, fmt.Errorf("Bad duration %q: %w", d, err)
+	}
+	if ret <= 0 {
+		return 0, fmt.Errorf("Duration %q must be positive", d)
+	}
+	return ret, nil
+}
+
+func (h *Healthcheck) interval() (time.Duration, error) {
+	return parseHealthDuration(h.Interval, DefaultHealthInterval)
+}
+
+func (h *Healthcheck) timeout() (time.Duration, error) {
+	return parseHealthDuration(h.Timeout, DefaultHealthTimeout)
+}
+
+func (h *Healthcheck) retries() int {
+	if h.Retries == 0 {
+		return DefaultHealthRetries
+	}
+	return h.Retries
+}
+
+func (h *Healthcheck) Validate() error {
+	if len(h.Command) == 0 || h.Command[0] == "" {
+		return fmt.Errorf("Healthcheck has no command")
+	}
+	if _, err := h.interval(); err != nil {
+		return err
+	}
+	if _, err := h.timeout(); err != nil {
+		return err
+	}
+	if h.Retries < 0 {
+		return fmt.Errorf("Healthcheck retries cannot be negative")
+	}
+	return nil
+}
+
+func (t Target) ValidateHealthcheck() error {
+	if t.Healthcheck == nil {
+		return nil
+	}
+	if t.ServiceType != ContainerService {
+		return fmt.Errorf("Healthchecks are only supported for container targets")
+	}
+	return t.Healthcheck.Validate()
+}
+
+// The healthcheck of a container, and its latest result, are kept in its
+// lxc configuration directory, for the health monitor.
+func healthcheckPath(rootDir, name string) string {
+	return filepath.Join(rootDir, "var/lib/lxc", name, "healthcheck.yaml")
+}
+
+func healthStatePath(rootDir, name string) string {
+	return filepath.Join(rootDir, "var/lib/lxc", name, "health")
+}
+
+// writeHealthcheck records @t's healthcheck for the health monitor.
+func (mos *Mos) writeHealthcheck(t *Target) error {
+	path := healthcheckPath(mos.opts.RootDir, t.ServiceName)
+	if t.Healthcheck == nil {
+		os.Remove(path)
+		return nil
+	}
+
+	bytes, err := yaml.Marshal(t.Healthcheck)
+	if err != nil {
+		return fmt.Errorf("Failed marshalling healthcheck for %s: %w", t.ServiceName, err)
+	}
+	if err := os.WriteFile(path, bytes, 0644); err != nil {
+		return fmt.Errorf("Failed writing healthcheck for %s: %w", t.ServiceName, err)
+	}
+	return nil
+}
+
+// readHealthcheck returns the healthcheck recorded for container @name,
+// or nil if it has none.
+func readHealthcheck(rootDir, name string) (*Healthcheck, error) {
+	content, err := os.ReadFile(healthcheckPath(rootDir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed reading healthcheck for %s: %w", name, err)
+	}
+	h := Healthcheck{}
+	if err := yaml.Unmarshal(content, &h); err != nil {
+		return nil, fmt.Errorf("Failed parsing healthcheck for %s: %w", name, err)
+	}
+	if err := h.Validate(); err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// runHealthcheck runs @h's command in container @name.
+func runHealthcheck(name string, h *Healthcheck) error {
+	timeout, err := h.timeout()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := append([]string{"-n", name, "--"}, h.Command...)
+	out, err := exec.CommandContext(ctx, "lxc-attach", args...).CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("Healthcheck timed out after %s", timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("Healthcheck failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// clearHealthState forgets the health which container @name had in a
+// previous run.
+func clearHealthState(rootDir, name string) error {
+	if err := os.Remove(healthStatePath(rootDir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed clearing health of %s: %w", name, err)
+	}
+	return nil
+}
+
+func writeHealthState(rootDir, name, state string) {
+	if err := os.WriteFile(healthStatePath(rootDir, name), []byte(state+"\n"), 0644); err != nil {
+		log.Warnf("Failed recording health of %s: %v", name, err)
+	}
+}
+
+// monitorHealth runs healthcheck @h of container @name until @ctx is
+// done, and calls @unhealthy once the check has failed too many times in
+// a row.
+func monitorHealth(ctx context.Context, rootDir, name string, h *Healthcheck, unhealthy func() error) error {
+	interval, err := h.interval()
+	if err != nil {
+		return err
+	}
+
+	writeHealthState(rootDir, name, HealthStarting)
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+		err := runHealthcheck(name, h)
+		if err == nil {
+			if failures != 0 {
+				log.Infof("%s is healthy again", name)
+			}
+			failures = 0
+			writeHealthState(rootDir, name, HealthHealthy)
+			continue
+		}
+
+		failures++
+		log.Warnf("%s: %v (%d of %d)", name, err, failures, h.retries())
+		if failures < h.retries() {
+			continue
+		}
+		writeHealthState(rootDir, name, HealthUnhealthy)
+		log.Warnf("Restarting unhealthy %s", name)
+		if err := unhealthy(); err != nil {
+			return fmt.Errorf("Failed restarting %s: %w", name, err)
+		}
+		failures = 0
+	}
+}
+
+// RunHealthMonitor is run by the systemd health unit of container
+// @name, through 'mosctl health-monitor'.  It runs the container's
+// healthcheck until it is stopped, and restarts the container once the
+// check has failed too many times in a row.
+func RunHealthMonitor(rootDir, name string) error {
+	h, err := readHealthcheck(rootDir, name)
+	if err != nil {
+		return err
+	}
+	if h == nil {
+		return fmt.Errorf("%s has no healthcheck", name)
+	}
+
+	return monitorHealth(context.Background(), rootDir, name, h, func() error {
+		return RunCommand("systemctl", "restart", "--no-block", name+".service")
+	})
+}
+
+// Health returns the health of container target @t, or "" if it has no
+// healthcheck or is not running.
+func (mos *Mos) Health(t *Target) string {
+	if t.Healthcheck == nil {
+		return ""
+	}
+	state, err := mos.runState(t)
+	if err != nil || state != StateRunning {
+		return ""
+	}
+	content, err := os.ReadFile(healthStatePath(mos.opts.RootDir, t.ServiceName))
+	if err != nil {
+		return HealthStarting
+	}
+	return strings.TrimSpace(string(content))
+}
+
+// WaitReady waits up to @timeout for target @t to be ready: healthy if
+// it has a healthcheck, else running.
+func (mos *Mos) WaitReady(t *Target, timeout time.Duration) error {
+	if t.ServiceType != ContainerService {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		if t.Healthcheck != nil {
+			if mos.Health(t) == HealthHealthy {
+				return nil
+			}
+		} else {
+			state, err := mos.runState(t)
+			if err != nil {
+				return err
+			}
+			if state == StateRunning {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s was not ready after %s", t.ServiceName, timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// UpdateAndActivate updates the system like Update, and then activates
+// each container target whose version changed, waiting up to @timeout
+// for it to become ready.  If one does not, the update is rolled back,
+// and the previous versions are activated again.  The update is only
+// cleaned up once all of them are ready.
+func (mos *Mos) UpdateAndActivate(filename string, timeout time.Duration) error {
+	// Rolling back must undo this update, not discard a pending one
+	pending, err := mos.HasPending()
+	if err != nil {
+		return err
+	}
+	if pending {
+		return fmt.Errorf("An update is pending boot, confirm or roll it back before activating another")
+	}
+
+	old, err := mos.CurrentManifest()
+	if err != nil {
+		return err
+	}
+
+	// Nothing is cleaned up until every changed target is ready
+	if err := mos.update(filename, plumbing.Master); err != nil {
+		return err
+	}
+
+	updated, err := mos.CurrentManifest()
+	if err != nil {
+		return err
+	}
+
+	oldTargets := SysTargets(old.SysTargets)
+	changed := []*Target{}
+	for _, st := range updated.SysTargets {
+		t := st.raw
+		if t.ServiceType != ContainerService {
+			continue
+		}
+		prev, ok := oldTargets.Contains(st)
+		if ok && prev.raw.Version == t.Version && prev.raw.ManifestHash == t.ManifestHash {
+			continue
+		}
+		changed = append(changed, t)
+	}
+
+	for _, t := range changed {
+		err := mos.Activate(t.ServiceName)
+		if err == nil {
+			err = mos.WaitReady(t, timeout)
+		}
+		if err == nil {
+			continue
+		}
+
+		log.Warnf("Rolling back update, as %s did not come up: %v", t.ServiceName, err)
+		if rerr := mos.rollbackMaster(); rerr != nil {
+			return fmt.Errorf("Failed rolling back after %s failed (%v): %w", t.ServiceName, err, rerr)
+		}
+		for _, c := range changed {
+			if _, ok := oldTargets.Contains(SysTarget{Name: c.ServiceName}); ok {
+				if aerr := mos.Activate(c.ServiceName); aerr != nil {
+					log.Warnf("Failed re-activating %s: %v", c.ServiceName, aerr)
+				}
+			} else if serr := mos.StopTarget(c); serr != nil {
+				log.Warnf("Failed stopping %s: %v", c.ServiceName, serr)
+			}
+		}
+		return fmt.Errorf("Update rolled back: %s did not come up: %w", t.ServiceName, err)
+	}
+
+	return mos.finishUpdate(old)
+}
@@ -0,0 +1,330 @@
+package mosconfig
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"gopkg.in/yaml.v2"
+)
+
+// Each commit to manifest.git ends with trailers describing the release
+// it installed:
+//
+//	Mos-Action: update
+//	Mos-Manifest: SHA.yaml
+//	Mos-Product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+//	Mos-Serial: 3
+//	Mos-Signer: CN=manifest PRODUCT:de6c82c5-2e01-4c92-949b-a6545d30fc06
+//	Mos-Target: hostfs changed
+//
+// with one Mos-Target for each target which was added, removed or
+// changed.
+const (
+	trailerAction   = "Mos-Action"
+	trailerManifest = "Mos-Manifest"
+	trailerProduct  = "Mos-Product"
+	trailerSerial   = "Mos-Serial"
+	trailerSigner   = "Mos-Signer"
+	trailerTarget   = "Mos-Target"
+)
+
+const (
+	ActionInstall = "install"
+	ActionUpdate  = "update"
+)
+
+// How a target changed between two system manifests.
+const (
+	TargetAdded   = "added"
+	TargetRemoved = "removed"
+	TargetChanged = "changed"
+)
+
+// A FieldChange is a change to one field of a target.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// A TargetChange is a target which was added, removed or changed
+// between two system manifests.
+type TargetChange struct {
+	Name   string        `json:"name"`
+	Change string        `json:"change"`
+	Fields []FieldChange `json:"fields,omitempty"`
+}
+
+func (c TargetChange) String() string {
+	return c.Name + " " + c.Change
+}
+
+// A Revision is one commit to the system manifest.
+type Revision struct {
+	Commit   string    `json:"commit"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action,omitempty"`
+	Manifest string    `json:"manifest,omitempty"`
+	Product  string    `json:"product,omitempty"`
+	Serial   string    `json:"serial,omitempty"`
+	Signer   string    `json:"signer,omitempty"`
+	Changes  []string  `json:"changes"`
+}
+
+// A manifestRelease describes the install manifest a commit installs.
+type manifestRelease struct {
+	Action   string
+	Manifest string // SHA.yaml
+	Product  string
+	Serial   int64
+	CertPath string
+}
+
+// revisionMessage returns the commit message for installing @release,
+// which changes the targets as in @changes.
+func revisionMessage(release manifestRelease, changes []TargetChange) (string, error) {
+	certs, err := readCerts(release.CertPath)
+	if err != nil {
+		return "", fmt.Errorf("Failed reading manifest cert (%q): %w", release.CertPath, err)
+	}
+	if len(certs) == 0 {
+		return "", fmt.Errorf("No certificate found in %q", release.CertPath)
+	}
+
+	var b strings.Builder
+	if release.Action == ActionInstall {
+		fmt.Fprintf(&b, "Install release %d\n\n", release.Serial)
+	} else {
+		fmt.Fprintf(&b, "System upgrade to release %d\n\n", release.Serial)
+	}
+	fmt.Fprintf(&b, "%s: %s\n", trailerAction, release.Action)
+	fmt.Fprintf(&b, "%s: %s\n", trailerManifest, release.Manifest)
+	fmt.Fprintf(&b, "%s: %s\n", trailerProduct, release.Product)
+	fmt.Fprintf(&b, "%s: %d\n", trailerSerial, release.Serial)
+	fmt.Fprintf(&b, "%s: %s\n", trailerSigner, certs[0].Subject.String())
+	for _, c := range changes {
+		fmt.Fprintf(&b, "%s: %s\n", trailerTarget, c.String())
+	}
+	return b.String(), nil
+}
+
+// parseTrailers returns the "Key: value" trailers in the last paragraph
+// of commit message @msg.
+func parseTrailers(msg string) map[string][]string {
+	trailers := map[string][]string{}
+	paragraphs := strings.Split(strings.TrimSpace(msg), "\n\n")
+	if len(paragraphs) < 2 {
+		return trailers
+	}
+	for _, line := range strings.Split(paragraphs[len(paragraphs)-1], "\n") {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		k = strings.TrimSpace(k)
+		trailers[k] = append(trailers[k], strings.TrimSpace(v))
+	}
+	return trailers
+}
+
+func firstTrailer(trailers map[string][]string, key string) string {
+	if v := trailers[key]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// sysTargetMap maps the names of the targets in @m to their definitions.
+func sysTargetMap(m *SysManifest) map[string]*Target {
+	targets := map[string]*Target{}
+	for _, t := range m.SysTargets {
+		targets[t.Name] = t.raw
+	}
+	return targets
+}
+
+// diffTargets returns the targets added, removed or changed from @old to
+// @new, sorted by name.
+func diffTargets(old, new map[string]*Target) []TargetChange {
+	changes := []TargetChange{}
+	for name, o := range old {
+		n, ok := new[name]
+		if !ok {
+			changes = append(changes, TargetChange{Name: name, Change: TargetRemoved})
+			continue
+		}
+		fields := []FieldChange{}
+		for _, f := range []struct{ name, old, new string }{
+			{"version", o.Version, n.Version},
+			{"manifest_hash", o.ManifestHash, n.ManifestHash},
+			{"service_type", string(o.ServiceType), string(n.ServiceType)},
+			{"nsgroup", o.NSGroup, n.NSGroup},
+		} {
+			if f.old != f.new {
+				fields = append(fields, FieldChange{Field: f.name, Old: f.old, New: f.new})
+			}
+		}
+		if len(fields) > 0 {
+			changes = append(changes, TargetChange{Name: name, Change: TargetChanged, Fields: fields})
+		}
+	}
+	for name := range new {
+		if _, ok := old[name]; !ok {
+			changes = append(changes, TargetChange{Name: name, Change: TargetAdded})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Name < changes[j].Name })
+	return changes
+}
+
+func (mos *Mos) openManifestHistory() (*git.Repository, error) {
+	dir := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the manifest git tree at %q: %w", dir, err)
+	}
+	return r, nil
+}
+
+// commitTargets returns the targets in the system manifest at @commit.
+// The install manifests are not verified, since history also shows
+// releases whose signers have since expired or been revoked.
+func commitTargets(commit *object.Commit) (map[string]*Target, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading manifest tree at %s: %w", commit.Hash, err)
+	}
+	contents, err := treeFileContents(tree, "manifest.yaml")
+	if err != nil {
+		return nil, fmt.Errorf("Error opening manifest at %s: %w", commit.Hash, err)
+	}
+	var sysmanifest SysManifest
+	if err := yaml.Unmarshal([]byte(contents), &sysmanifest); err != nil {
+		return nil, fmt.Errorf("Failed parsing manifest at %s: %w", commit.Hash, err)
+	}
+
+	manifests := map[string]InstallFile{}
+	targets := map[string]*Target{}
+	for _, t := range sysmanifest.SysTargets {
+		cf, ok := manifests[t.Source]
+		if !ok {
+			contents, err := treeFileContents(tree, t.Source)
+			if err != nil {
+				return nil, fmt.Errorf("Error opening install manifest %q at %s: %w", t.Source, commit.Hash, err)
+			}
+			if err := yaml.Unmarshal([]byte(contents), &cf); err != nil {
+				return nil, fmt.Errorf("Failed parsing install manifest %q at %s: %w", t.Source, commit.Hash, err)
+			}
+			manifests[t.Source] = cf
+		}
+		raw, ok := findTarget(cf, t.Name)
+		if !ok {
+			return nil, fmt.Errorf("target %s not found in %s", t.Name, t.Source)
+		}
+		targets[t.Name] = raw
+	}
+	return targets, nil
+}
+
+// History returns the revisions of the current system manifest, newest
+// first.  Revisions made before commits carried trailers only have
+// their changes, which are found by comparing them with their parent.
+func (mos *Mos) History() ([]Revision, error) {
+	r, err := mos.openManifestHistory()
+	if err != nil {
+		return nil, err
+	}
+	head, err := r.Reference(plumbing.Master, true)
+	if err != nil {
+		return nil, fmt.Errorf("Failed finding the current manifest: %w", err)
+	}
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading manifest commit %s: %w", head.Hash(), err)
+	}
+
+	revisions := []Revision{}
+	for commit != nil {
+		var parent *object.Commit
+		if commit.NumParents() > 0 {
+			parent, err = commit.Parent(0)
+			if err != nil {
+				return nil, fmt.Errorf("Failed reading the parent of manifest commit %s: %w", commit.Hash, err)
+			}
+		}
+
+		trailers := parseTrailers(commit.Message)
+		rev := Revision{
+			Commit:   commit.Hash.String(),
+			Time:     commit.Committer.When,
+			Action:   firstTrailer(trailers, trailerAction),
+			Manifest: firstTrailer(trailers, trailerManifest),
+			Product:  firstTrailer(trailers, trailerProduct),
+			Serial:   firstTrailer(trailers, trailerSerial),
+			Signer:   firstTrailer(trailers, trailerSigner),
+			Changes:  trailers[trailerTarget],
+		}
+		if rev.Action == "" {
+			changes, err := diffCommits(parent, commit)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range changes {
+				rev.Changes = append(rev.Changes, c.String())
+			}
+		}
+		if rev.Changes == nil {
+			rev.Changes = []string{}
+		}
+		revisions = append(revisions, rev)
+		commit = parent
+	}
+	return revisions, nil
+}
+
+// diffCommits returns the target changes from @old, which may be nil,
+// to @new.
+func diffCommits(old, new *object.Commit) ([]TargetChange, error) {
+	oldTargets := map[string]*Target{}
+	if old != nil {
+		var err error
+		oldTargets, err = commitTargets(old)
+		if err != nil {
+			return nil, err
+		}
+	}
+	newTargets, err := commitTargets(new)
+	if err != nil {
+		return nil, err
+	}
+	return diffTargets(oldTargets, newTargets), nil
+}
+
+// DiffRevisions returns the targets added, removed or changed from
+// revision @rev1 to @rev2 of manifest.git.  Revisions may be anything
+// git understands, such as a commit hash, 'master~2' or 'pending'.
+func (mos *Mos) DiffRevisions(rev1, rev2 string) ([]TargetChange, error) {
+	r, err := mos.openManifestHistory()
+	if err != nil {
+		return nil, err
+	}
+	commits := []*object.Commit{}
+	for _, rev := range []string{rev1, rev2} {
+		hash, err := r.ResolveRevision(plumbing.Revision(rev))
+		if err != nil {
+			return nil, fmt.Errorf("Failed finding manifest revision %q: %w", rev, err)
+		}
+		commit, err := r.CommitObject(*hash)
+		if err != nil {
+			return nil, fmt.Errorf("Failed reading manifest revision %q: %w", rev, err)
+		}
+		commits = append(commits, commit)
+	}
+	return diffCommits(commits[0], commits[1])
+}
@@ -0,0 +1,149 @@
+package mosconfig
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/apex/log"
+)
+
+// How to boot into a newly activated hostfs.
+type BootAction string
+
+const (
+	BootNone   BootAction = ""       // wait for the next reboot
+	BootReboot BootAction = "reboot" // reboot now
+	BootKexec  BootAction = "kexec"  // kexec into the boot kernel now
+)
+
+// nextHostfs returns the hostfs which create-boot-fs will boot next, and
+// whether it is from a pending update.  Unlike BootTarget, this does not
+// use up a boot attempt.
+func (mos *Mos) nextHostfs() (*Target, bool, error) {
+	mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+	repo, _, err := openManifestRepo(mPath)
+	if err != nil {
+		return nil, false, err
+	}
+
+	pending, err := refExists(repo, pendingBranch)
+	if err != nil {
+		return nil, false, err
+	}
+	if !pending {
+		t, err := mos.Current("hostfs")
+		return t, false, err
+	}
+
+	manifest, err := mos.manifestAt(pendingBranch)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, t := range manifest.SysTargets {
+		if t.Name == "hostfs" {
+			return t.raw, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("Target hostfs not found in pending update")
+}
+
+// hostfsBooted returns true if hostfs @t is the one we are running on.
+func (mos *Mos) hostfsBooted(t *Target) (bool, error) {
+	hash, err := mos.storage.MountedByHash(t)
+	if err != nil {
+		return false, fmt.Errorf("Failed finding the booted hostfs: %w", err)
+	}
+	if hash == "" {
+		return false, nil
+	}
+	_, mHash, err := mos.imageForHash(t, hash)
+	if err != nil {
+		return false, err
+	}
+	return mHash == t.ManifestHash, nil
+}
+
+// ActivateHostfs makes sure that the newest hostfs - that of the
+// pending update if there is one, else that of the system manifest - is
+// booted next, and then boots into it as @action says.  A pending
+// update which has used up its boot attempts gets DefaultBootTries more.
+func (mos *Mos) ActivateHostfs(action BootAction) error {
+	t, pending, err := mos.nextHostfs()
+	if err != nil {
+		return err
+	}
+
+	booted, err := mos.hostfsBooted(t)
+	if err != nil {
+		return err
+	}
+	if booted {
+		log.Infof("hostfs version %q is already booted", t.Version)
+		return nil
+	}
+
+	if pending {
+		tries, err := mos.readBootTries()
+		if err != nil {
+			return err
+		}
+		if tries <= 0 {
+			tries = DefaultBootTries
+			if err := mos.writeBootTries(tries); err != nil {
+				return err
+			}
+		}
+		log.Infof("Pending hostfs version %q will be booted next, %d tries left", t.Version, tries)
+	} else {
+		log.Infof("hostfs version %q will be booted next", t.Version)
+	}
+
+	switch action {
+	case BootNone:
+		return nil
+	case BootReboot:
+		return mos.initmgr.Reboot(false)
+	case BootKexec:
+		return mos.initmgr.Reboot(true)
+	default:
+		return fmt.Errorf("Unknown boot action %q", action)
+	}
+}
+
+// VerifyBoot is run once the system is up.  If an update is pending, it
+// checks which hostfs was booted: if it was the pending one, the update
+// is confirmed.  Otherwise the update is rolled back once it has no boot
+// attempts left, since create-boot-fs has given up on it.
+func (mos *Mos) VerifyBoot() error {
+	t, pending, err := mos.nextHostfs()
+	if err != nil {
+		return err
+	}
+	if !pending {
+		return nil
+	}
+
+	booted, err := mos.hostfsBooted(t)
+	if err != nil {
+		return err
+	}
+	if booted {
+		log.Infof("Pending hostfs version %q booted, confirming the update", t.Version)
+		return mos.ConfirmBoot()
+	}
+
+	tries, err := mos.readBootTries()
+	if err != nil {
+		return err
+	}
+	if tries > 0 {
+		log.Infof("Pending hostfs version %q has not been booted yet", t.Version)
+		return nil
+	}
+
+	log.Warnf("Pending hostfs version %q did not boot, rolling back", t.Version)
+	if err := mos.Rollback(); err != nil {
+		return err
+	}
+	return fmt.Errorf("Pending hostfs version %q did not boot, the update was rolled back", t.Version)
+}
@@ -0,0 +1,104 @@
+package mosconfig
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"github.com/lxc/lxd/shared/idmap"
+	"golang.org/x/sys/unix"
+)
+
+// errIdmapUnsupported is returned by mountIdmapped when the kernel or
+// the filesystem does not support idmapped mounts.
+var errIdmapUnsupported = errors.New("idmapped mounts are not supported")
+
+// usernsFd returns an fd for a new user namespace with the mappings in
+// @set.  The namespace is created by a child which is stopped (by
+// ptrace) before it gets to run anything, and which is killed once we
+// have the fd.
+func usernsFd(set idmap.IdmapSet) (int, error) {
+	// A ptraced child may only be waited for by the thread which
+	// started it.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	uidMaps := []syscall.SysProcIDMap{}
+	gidMaps := []syscall.SysProcIDMap{}
+	for _, e := range set.Idmap {
+		m := syscall.SysProcIDMap{
+			ContainerID: int(e.Nsid),
+			HostID:      int(e.Hostid),
+			Size:        int(e.Maprange),
+		}
+		if e.Isuid {
+			uidMaps = append(uidMaps, m)
+		}
+		if e.Isgid {
+			gidMaps = append(gidMaps, m)
+		}
+	}
+
+	cmd := exec.Command("/proc/self/exe")
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags:  unix.CLONE_NEWUSER,
+		UidMappings: uidMaps,
+		GidMappings: gidMaps,
+		Ptrace:      true,
+		Pdeathsig:   unix.SIGKILL,
+	}
+	if err := cmd.Start(); err != nil {
+		return -1, fmt.Errorf("Failed creating user namespace: %w", err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	fd, err := unix.Open(fmt.Sprintf("/proc/%d/ns/user", cmd.Process.Pid), unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, fmt.Errorf("Failed opening user namespace: %w", err)
+	}
+	return fd, nil
+}
+
+// mountIdmapped mounts a copy of the mount at @src onto @dest, with the
+// file ownership shifted by @set.  Returns errIdmapUnsupported if that
+// cannot be done here.
+func mountIdmapped(src, dest string, set idmap.IdmapSet) error {
+	nsfd, err := usernsFd(set)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(nsfd)
+
+	treefd, err := unix.OpenTree(unix.AT_FDCWD, src, unix.OPEN_TREE_CLONE|unix.OPEN_TREE_CLOEXEC|unix.AT_RECURSIVE)
+	if err != nil {
+		if errors.Is(err, unix.ENOSYS) {
+			return errIdmapUnsupported
+		}
+		return fmt.Errorf("Failed cloning mount %q: %w", src, err)
+	}
+	defer unix.Close(treefd)
+
+	attr := unix.MountAttr{
+		Attr_set:  unix.MOUNT_ATTR_IDMAP,
+		Userns_fd: uint64(nsfd),
+	}
+	err = unix.MountSetattr(treefd, "", unix.AT_EMPTY_PATH|unix.AT_RECURSIVE, &attr)
+	if err != nil {
+		// EINVAL means that the filesystem cannot be idmapped.  EPERM
+		// is a real error, which shifting would not get around.
+		if errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+			return errIdmapUnsupported
+		}
+		return fmt.Errorf("Failed idmapping mount %q: %w", src, err)
+	}
+
+	if err := unix.MoveMount(treefd, "", unix.AT_FDCWD, dest, unix.MOVE_MOUNT_F_EMPTY_PATH); err != nil {
+		return fmt.Errorf("Failed mounting idmapped %q onto %q: %w", src, dest, err)
+	}
+	return nil
+}
@@ -1,75 +1,91 @@
 package mosconfig
 
-// this contains our init related code
-// purely systemd for now
+// this contains our init related code: the Initmgr interface which
+// runs container targets' services, and the choice between systemd
+// (systemd.go) and mosctl's own supervisor (supervisor.go).
 
 import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+)
+
+type InitType string
 
-	"github.com/apex/log"
+const (
+	SystemdInit    InitType = "systemd"
+	SupervisorInit InitType = "supervisor"
 )
 
-func systemdStart(unitName string) error {
-	if err := RunCommand("systemctl", "enable", unitName); err != nil {
-		return fmt.Errorf("Failed enabling %s: %w", unitName, err)
-	}
-	if err := RunCommand("systemctl", "start", "--no-block", unitName); err != nil {
-		return fmt.Errorf("Failed starting %s: %w", unitName, err)
-	}
-	return nil
-}
+// An Initmgr runs the services of container targets.
+type Initmgr interface {
+	// Enable sets up @t's service, so that it is started at boot.
+	Enable(t *Target) error
 
-const execServiceTemplate = `
-[Unit]
-Description=%s
-DefaultDependencies=no
-After=network-online.target cloud-init.target
-Wants=network.target
+	// Start starts @t's service, without waiting for it to be up.
+	Start(t *Target) error
 
-[Service]
-Restart=on-failure
-RestartSec=1
-ExecStart=/usr/bin/lxc-execute -n %s
-ExecStop=/usr/bin/lxc-stop -n %s
+	// Stop stops @t's service, and waits for it to be down.  It is not
+	// an error if the service is not known.
+	Stop(t *Target) error
 
-[Install]
-WantedBy=multi-user.target
-`
+	// Status returns StateRunning, StateStopped or StateFailed.
+	Status(t *Target) (string, error)
 
-const stopService = `
-[Unit]
-Description=Stop the %s container before shutdown
-DefaultDependencies=no
-Before=shutdown.target
+	// Reboot reboots the system, or kexecs into the boot kernel if
+	// @kexec is true.
+	Reboot(kexec bool) error
+}
 
-[Service]
-Type=oneshot
-ExecStart=/usr/bin/systemctl stop %s
-TimeoutStartSec=0
+func ParseInitType(t string) (InitType, error) {
+	switch t {
+	case "", "systemd":
+		return SystemdInit, nil
+	case "supervisor":
+		return SupervisorInit, nil
+	default:
+		return "", fmt.Errorf("Unknown init type %q", t)
+	}
+}
 
-[Install]
-WantedBy=shutdown.target
-`
+func NewInitmgr(opts MosOptions) (Initmgr, error) {
+	switch opts.InitType {
+	case SystemdInit:
+		return &systemdInitmgr{rootDir: opts.RootDir}, nil
+	case SupervisorInit:
+		return &supervisorInitmgr{rootDir: opts.RootDir}, nil
+	default:
+		return nil, fmt.Errorf("Unknown init type %q", opts.InitType)
+	}
+}
+
+// The init type is chosen at install time, and recorded in
+// $config/init_type.
+func initTypePath(configDir string) string {
+	return filepath.Join(configDir, "init_type")
+}
 
-func (mos *Mos) writeContainerService(t *Target) error {
-	unitName := fmt.Sprintf("%s.service", t.ServiceName)
-	dest := filepath.Join(mos.opts.RootDir, "/etc", "systemd", "system", unitName)
-	log.Infof("Writing container service at %q", dest)
-	os.Remove(dest)
-	content := []byte(fmt.Sprintf(execServiceTemplate, t.ServiceName, t.ServiceName, t.ServiceName))
-	if err := os.WriteFile(dest, content, 0644); err != nil {
-		return fmt.Errorf("Failed writing systemd.service file for %q: %w", unitName, err)
+// Return the init type recorded at install time.  Systems installed
+// before this was recorded use systemd.
+func readInitType(configDir string) (InitType, error) {
+	content, err := os.ReadFile(initTypePath(configDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return SystemdInit, nil
+		}
+		return "", fmt.Errorf("Failed reading init type: %w", err)
 	}
+	return ParseInitType(strings.TrimSpace(string(content)))
+}
 
+func writeInitType(configDir string, t InitType) error {
+	if err := os.WriteFile(initTypePath(configDir), []byte(string(t)+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed writing init type: %w", err)
+	}
 	return nil
 }
 
 func (mos *Mos) startInit(t *Target) error {
-	unitName := fmt.Sprintf("%s.service", t.ServiceName)
-	if err := systemdStart(unitName); err != nil {
-		return err
-	}
-	return nil
+	return mos.initmgr.Start(t)
 }
@@ -6,7 +6,10 @@ import (
 	"strings"
 )
 
-func InitializeMos(storeDir, configDir, configFile string) error {
+// InitializeMos installs the system described by @configFile.  The
+// target images are copied from alongside @configFile, or pulled from
+// @registry if its Base is set.
+func InitializeMos(storeDir, configDir, configFile string, initType InitType, registry RegistryOpts) error {
 	// We must have $basedir/install.yml and $basedir/cert.pem
 	baseDir := filepath.Dir(configFile)
 	cPath := filepath.Join(baseDir, "manifestCert.pem")
@@ -20,12 +23,6 @@ func InitializeMos(storeDir, configDir, configFile string) error {
 		return fmt.Errorf("Install manifest or certificate missing")
 	}
 
-	mos, err := NewMos(configDir, storeDir)
-	if err != nil {
-		return fmt.Errorf("Error opening manifest: %w", err)
-	}
-	defer mos.Close()
-
 	// Well, bit of a chicken and egg problem here.  We parse the configfile
 	// first so we can copy all the needed zot images.
 	cf, err := simpleParseInstall(configFile)
@@ -33,8 +30,23 @@ func InitializeMos(storeDir, configDir, configFile string) error {
 		return fmt.Errorf("Failed parsing install configuration")
 	}
 
+	storageType, err := ParseStorageType(string(cf.StorageType))
+	if err != nil {
+		return err
+	}
+
+	mos, err := NewMos(configDir, storeDir, storageType, initType, registry)
+	if err != nil {
+		return fmt.Errorf("Error opening manifest: %w", err)
+	}
+	defer mos.Close()
+
+	src := baseDir
+	if registry.Base != "" {
+		src = registry.Base
+	}
 	for _, target := range cf.Targets {
-		err = mos.storage.ImportTarget(baseDir, &target)
+		err = mos.storage.ImportTarget(src, &target)
 		if err != nil {
 			return err
 		}
@@ -51,6 +63,18 @@ func InitializeMos(storeDir, configDir, configFile string) error {
 		return fmt.Errorf("Error initializing system manifest: %w", err)
 	}
 
+	if err := writeInitType(configDir, initType); err != nil {
+		return err
+	}
+
+	if err := writeStorageType(configDir, storageType); err != nil {
+		return err
+	}
+
+	if err := writeProduct(configDir, cf.Product); err != nil {
+		return err
+	}
+
 	return nil
 }
 
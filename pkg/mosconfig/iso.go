@@ -20,6 +20,10 @@ type ISOConfig struct {
 	Key        string
 	UpdateType UpdateType
 	Product    string
+
+	// Storage type for which to build the install media.  For
+	// puzzlefs, images must be local oci layouts.
+	StorageType StorageType
 }
 
 func (iso *ISOConfig) Generate() error {
@@ -59,8 +63,17 @@ func (iso *ISOConfig) Generate() error {
                 return err
         }
 
+        if iso.StorageType == "" {
+                iso.StorageType = AtomfsStorageType
+        }
+
         for key, t := range inputTargets {
-                sum, err := copyToOcidir(t.ImagePath, t.ServiceName, ociDir)
+                var sum string
+                if iso.StorageType == PuzzlefsStorageType {
+                        sum, err = copyPuzzlefsToOcidir(t.ImagePath, t.ServiceName, ociDir)
+                } else {
+                        sum, err = copyToOcidir(t.ImagePath, t.ServiceName, ociDir)
+                }
 		if err != nil {
                         return err
                 }
@@ -70,7 +83,7 @@ func (iso *ISOConfig) Generate() error {
 	manifest.Version = CurrentInstallFileVersion
 	manifest.ImageType = ISO
 	manifest.Product = iso.Product
-	manifest.StorageType = AtomfsStorageType
+	manifest.StorageType = iso.StorageType
 	manifest.UpdateType = iso.UpdateType
 
         bytes, err := yaml.Marshal(&manifest)
@@ -149,3 +162,15 @@ func copyToOcidir(src, name, ociDir string) (string, error) {
 
 	return shasum, nil
 }
+
+// copyPuzzlefsToOcidir - copy a puzzlefs image from the oci image path
+// specified in the install yaml, into the ISO/oci/ directory.  Return
+// the shasum of the image manifest.
+func copyPuzzlefsToOcidir(src, name, ociDir string) (string, error) {
+	srcDir, srcTag, err := splitOCIURL(src)
+	if err != nil {
+		return "", fmt.Errorf("puzzlefs images must be local oci layouts: %w", err)
+	}
+	hash, _, err := copyOCIImage(srcDir, srcTag, ociDir, name, "")
+	return hash, err
+}
@@ -40,7 +40,11 @@ func (mos *Mos) initManifest(manifestPath, manifestCert, manifestCA, configPath
 		return fmt.Errorf("Failed opening git worktree: %w", err)
 	}
 
-	cf, err := ReadVerifyManifest(manifestPath, manifestCert, manifestCA, "", mos.storage)
+	policy, err := mos.signerPolicy(manifestCA)
+	if err != nil {
+		return err
+	}
+	cf, err := ReadVerifyManifest(manifestPath, manifestCert, manifestCA, "", mos.storage, SignerCheck{Policy: policy})
 	if err != nil {
 		return fmt.Errorf("Failed verifying signature on %s: %w", manifestPath, err)
 	}
@@ -82,6 +86,22 @@ func (mos *Mos) initManifest(manifestPath, manifestCert, manifestCA, configPath
 	targets := SysTargets{}
 	uidmaps := []IdmapSet{}
 
+	raws := []*Target{}
+	for i := range cf.Targets {
+		raws = append(raws, &cf.Targets[i])
+	}
+	if err := validateDependencies(raws); err != nil {
+		return err
+	}
+	if err := validateHostPorts(raws); err != nil {
+		return err
+	}
+
+	alloc, err := mos.uidAllocator()
+	if err != nil {
+		return err
+	}
+
 	for _, t := range cf.Targets {
 		newT := SysTarget{
 			Name:   t.ServiceName,
@@ -89,7 +109,10 @@ func (mos *Mos) initManifest(manifestPath, manifestCert, manifestCA, configPath
 		}
 		targets = append(targets, newT)
 
-		uidmaps = addUIDMap([]IdmapSet{}, uidmaps, t)
+		uidmaps, err = alloc.addUIDMap([]IdmapSet{}, uidmaps, t)
+		if err != nil {
+			return err
+		}
 	}
 
 	sysmanifest := SysManifest{
@@ -110,15 +133,29 @@ func (mos *Mos) initManifest(manifestPath, manifestCert, manifestCA, configPath
 	if err != nil {
 		return fmt.Errorf("Git file add for system manifest failed: %w", err)
 	}
+	installed := map[string]*Target{}
+	for _, t := range raws {
+		installed[t.ServiceName] = t
+	}
+	msg, err := revisionMessage(manifestRelease{
+		Action:   ActionInstall,
+		Manifest: mFile,
+		Product:  cf.Product,
+		Serial:   cf.Serial,
+		CertPath: manifestCert,
+	}, diffTargets(map[string]*Target{}, installed))
+	if err != nil {
+		return err
+	}
 	commitOpts := &git.CommitOptions{
 		Author:    defaultSignature(),
 		Committer: defaultSignature(),
 	}
-	_, err = w.Commit("Initial commit", commitOpts)
+	_, err = w.Commit(msg, commitOpts)
 	if err != nil {
 		return fmt.Errorf("Failed committing to git")
 	}
-	return nil
+	return recordReleaseSerial(configPath, cf.Product, cf.Serial)
 }
 
 func defaultSignature() *object.Signature {
@@ -133,14 +170,14 @@ func defaultSignature() *object.Signature {
 func (mos *Mos) ReadTargetManifest(t *Target) (ispec.Manifest, ispec.Image, error) {
 	emptyM := ispec.Manifest{}
 	emptyC := ispec.Image{}
-	ociDir := filepath.Join(mos.opts.StorageCache, t.ImagePath)
+	ociDir, name := mos.storage.ImageRef(t)
 	oci, err := umoci.OpenLayout(ociDir)
 	if err != nil {
 		return emptyM, emptyC, fmt.Errorf("Failed reading OCI manifest for %s: %w", t.ImagePath, err)
 	}
 	defer oci.Close()
 
-	ociManifest, err := stackeroci.LookupManifest(oci, t.Version)
+	ociManifest, err := stackeroci.LookupManifest(oci, name)
 	if err != nil {
 		return emptyM, emptyC, err
 	}
@@ -158,63 +195,80 @@ func (mos *Mos) CurrentManifest() (*SysManifest, error) {
 		return mos.Manifest, nil
 	}
 
-	dir := filepath.Join(mos.opts.ConfigDir, "manifest.git")
-	clonedir, err := os.MkdirTemp("", "verify")
+	sysmanifest, err := mos.manifestAt(plumbing.Master)
 	if err != nil {
-		return nil, errors.Wrapf(err, "Error making tempdir")
+		return nil, err
 	}
-	defer os.RemoveAll(clonedir)
 
-	r, err := git.PlainClone(clonedir, false,
-		&git.CloneOptions{
-			URL:           dir,
-			ReferenceName: plumbing.Master,
-			SingleBranch:  true,
-		},
-	)
+	mos.Manifest = sysmanifest
+
+	return sysmanifest, nil
+}
+
+// manifestAt reads and verifies the system manifest at branch @ref of
+// manifest.git.
+func (mos *Mos) manifestAt(ref plumbing.ReferenceName) (*SysManifest, error) {
+	dir := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+	r, err := git.PlainOpen(dir)
 	if err != nil {
 		return nil, fmt.Errorf("Error opening the manifest git tree at %q: %w", dir, err)
 	}
 
-	w, err := r.Worktree()
+	head, err := r.Reference(ref, true)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting worktree")
+		return nil, fmt.Errorf("Failed finding %s in the manifest git tree: %w", ref, err)
 	}
-
-	cOpts := git.CheckoutOptions{
-		Branch: plumbing.Master,
-		Force:  true,
-		Create: false,
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading manifest commit %s: %w", head.Hash(), err)
 	}
-	err = w.Checkout(&cOpts)
+	tree, err := commit.Tree()
 	if err != nil {
-		return nil, fmt.Errorf("Git checkout failed: %w", err)
+		return nil, fmt.Errorf("Failed reading manifest tree at %s: %w", head.Hash(), err)
 	}
 
-	contents, err := os.ReadFile(filepath.Join(clonedir, "manifest.yaml"))
+	cacheKey, err := mos.manifestCacheKey(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	if cached := mos.readManifestCache(ref, cacheKey); cached != nil {
+		return cached, nil
+	}
+
+	contents, err := treeFileContents(tree, "manifest.yaml")
 	if err != nil {
 		return nil, fmt.Errorf("Error opening manifest: %w", err)
 	}
 
 	var sysmanifest SysManifest
-	err = yaml.Unmarshal(contents, &sysmanifest)
+	err = yaml.Unmarshal([]byte(contents), &sysmanifest)
 	if err != nil {
 		return nil, fmt.Errorf("Failed parsing manifest: %w", err)
 	}
 
-	manifests := make(map[string]InstallFile)
+	manifests := make(map[string]verifiedManifest)
+	signersExpire := time.Time{}
 	ret := SysTargets{}
 	for _, t := range sysmanifest.SysTargets {
 		h := t.Source
-		s, err := mos.readInstallManifest(clonedir, manifests, h)
+		s, notAfter, err := mos.readInstallManifest(tree, manifests, h)
 		if err != nil {
 			return nil, errors.Wrapf(err, "Error reading install manifest for %#v", t)
 		}
+		if signersExpire.IsZero() || notAfter.Before(signersExpire) {
+			signersExpire = notAfter
+		}
 		raw, ok := findTarget(s, t.Name)
 		if !ok {
 			return nil, fmt.Errorf("target %s not found in %s", t.Name, h)
 		}
 		t.raw = raw
+		if raw.Network.Type == CNINetworkType {
+			t.cniNetwork, _ = findCNINetwork(s, raw.Network.CNINetwork)
+		}
+		if raw.Security != nil {
+			t.seccompPolicy, _ = findSeccompPolicy(s, raw.Security.Seccomp)
+		}
 
 		t.OCIManifest, t.OCIConfig, err = mos.ReadTargetManifest(t.raw)
 		if err != nil {
@@ -225,11 +279,19 @@ func (mos *Mos) CurrentManifest() (*SysManifest, error) {
 	}
 	sysmanifest.SysTargets = ret
 
-	mos.Manifest = &sysmanifest
+	mos.writeManifestCache(ref, cacheKey, &sysmanifest, signersExpire)
 
 	return &sysmanifest, nil
 }
 
+func treeFileContents(tree *object.Tree, name string) (string, error) {
+	f, err := tree.File(name)
+	if err != nil {
+		return "", err
+	}
+	return f.Contents()
+}
+
 func findTarget(cf InstallFile, name string) (*Target, bool) {
 	for _, t := range cf.Targets {
 		if t.ServiceName == name {
@@ -239,46 +301,86 @@ func findTarget(cf InstallFile, name string) (*Target, bool) {
 	return &Target{}, false
 }
 
+// A verifiedManifest is an install manifest whose signature has been
+// verified, and when its signer's certificate expires.
+type verifiedManifest struct {
+	cf       InstallFile
+	notAfter time.Time
+}
+
 // readInstallManifest is used while loading the current, active
-// install manifest.
-func (mos *Mos) readInstallManifest(gitdir string, l map[string]InstallFile, yName string) (InstallFile, error) {
-	r, ok := l[yName]
-	if ok {
-		return r, nil
+// install manifest.  The manifest, its signature and its signer's
+// certificate are read from the manifest.git @tree, unless @l already
+// has it.  It also returns when the signer's certificate expires.
+func (mos *Mos) readInstallManifest(tree *object.Tree, l map[string]verifiedManifest, yName string) (InstallFile, time.Time, error) {
+	if v, ok := l[yName]; ok {
+		return v.cf, v.notAfter, nil
 	}
 
 	pemName := strings.TrimSuffix(yName, ".yaml") + ".pem"
+	pemContents, err := treeFileContents(tree, pemName)
+	if err != nil {
+		return InstallFile{}, time.Time{}, fmt.Errorf("Failed reading %q from the manifest git tree: %w", pemName, err)
+	}
+	certs, err := parseCerts([]byte(pemContents))
+	if err != nil {
+		return InstallFile{}, time.Time{}, fmt.Errorf("Failed reading signing certificate for %q: %w", yName, err)
+	}
+	notAfter := certs[0].NotAfter
 
 	tmpd, err := os.MkdirTemp("", "verify")
 	if err != nil {
-		return InstallFile{}, fmt.Errorf("Failed creating a tempdir: %w", err)
+		return InstallFile{}, time.Time{}, fmt.Errorf("Failed creating a tempdir: %w", err)
 	}
 	defer os.RemoveAll(tmpd)
 
+	files := map[string]string{pemName: pemContents}
+	for _, name := range []string{yName, yName + ".signed"} {
+		contents, err := treeFileContents(tree, name)
+		if err != nil {
+			return InstallFile{}, time.Time{}, fmt.Errorf("Failed reading %q from the manifest git tree: %w", name, err)
+		}
+		files[name] = contents
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(tmpd, filepath.Base(name)), []byte(contents), 0600); err != nil {
+			return InstallFile{}, time.Time{}, fmt.Errorf("Failed writing %q: %w", name, err)
+		}
+	}
+
+	policy, err := mos.signerPolicy(mos.opts.CaPath)
+	if err != nil {
+		return InstallFile{}, time.Time{}, err
+	}
+
 	manifest, err := ReadVerifyManifest(
-		filepath.Join(gitdir, yName),
-		filepath.Join(gitdir, pemName),
+		filepath.Join(tmpd, filepath.Base(yName)),
+		filepath.Join(tmpd, filepath.Base(pemName)),
 		mos.opts.CaPath,
 		"",
-		mos.storage)
+		mos.storage,
+		SignerCheck{Policy: policy, Installed: true})
 	if err != nil {
-		return InstallFile{}, errors.Wrapf(err, "Failed verifying signature for target %q", yName)
+		return InstallFile{}, time.Time{}, errors.Wrapf(err, "Failed verifying signature for target %q", yName)
 	}
 
-	l[yName] = manifest
-	return manifest, nil
+	l[yName] = verifiedManifest{manifest, notAfter}
+	return manifest, notAfter, nil
 }
 
-func (mos *Mos) UpdateManifest(manifest *SysManifest, newmanifest *SysManifest, newdir string) error {
+// UpdateManifest commits the system manifest @newmanifest, whose install
+// manifests are found in @newdir, on top of @manifest, with the commit
+// message @msg.  The commit is
+// made on a staging branch, and @dest is only pointed to it once the
+// new system manifest has been verified.  On failure, manifest.git is
+// left as it was.
+func (mos *Mos) UpdateManifest(manifest *SysManifest, newmanifest *SysManifest, newdir, msg string, dest plumbing.ReferenceName) error {
 	// Check out a new branch, copy over each required install.yaml
 	// from the old manifest, and the files from the new install.
-
-	// TODO - upon failure we should restore the old git branch
-
 	mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
-	repo, err := git.PlainOpen(mPath)
+	repo, w, err := openManifestRepo(mPath)
 	if err != nil {
-		return fmt.Errorf("Failed opening manifest git repo at %q: %w", mPath, err)
+		return err
 	}
 
 	files, err := os.ReadDir(mPath)
@@ -286,11 +388,28 @@ func (mos *Mos) UpdateManifest(manifest *SysManifest, newmanifest *SysManifest,
 		return fmt.Errorf("Failed reading manifest directory: %w", err)
 	}
 
-	w, err := repo.Worktree()
+	head, err := repo.Reference(plumbing.Master, true)
+	if err != nil {
+		return fmt.Errorf("Failed finding the current manifest: %w", err)
+	}
+	if err := startStaging(repo, w, head.Hash()); err != nil {
+		return err
+	}
+
+	hash, err := mos.commitManifest(manifest, newmanifest, newdir, mPath, msg, files, w)
 	if err != nil {
-		return fmt.Errorf("Failed opening manifest repo: %w", err)
+		abortStaging(repo, w)
+		return err
 	}
 
+	if err := mos.promote(repo, w, hash, dest); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (mos *Mos) commitManifest(manifest *SysManifest, newmanifest *SysManifest, newdir, mPath, msg string, files []os.DirEntry, w *git.Worktree) (plumbing.Hash, error) {
 	// Copy any needed source yamls into our tempdir
 	for _, t := range manifest.SysTargets {
 		f := t.Source
@@ -303,7 +422,7 @@ func (mos *Mos) UpdateManifest(manifest *SysManifest, newmanifest *SysManifest,
 			src := filepath.Join(mPath, fName)
 			dest := filepath.Join(newdir, fName)
 			if err := CopyFileBits(src, dest); err != nil {
-				return fmt.Errorf("Failed copying %q out of system manifest repo: %w", src, err)
+				return plumbing.ZeroHash, fmt.Errorf("Failed copying %q out of system manifest repo: %w", src, err)
 			}
 		}
 	}
@@ -311,7 +430,7 @@ func (mos *Mos) UpdateManifest(manifest *SysManifest, newmanifest *SysManifest,
 	// Remove all files from git index
 	for _, f := range files {
 		if _, err := w.Remove(f.Name()); err != nil {
-			return fmt.Errorf("Failed removing %q from previous manifest: %w", f.Name(), err)
+			return plumbing.ZeroHash, fmt.Errorf("Failed removing %q from previous manifest: %w", f.Name(), err)
 		}
 	}
 
@@ -327,30 +446,30 @@ func (mos *Mos) UpdateManifest(manifest *SysManifest, newmanifest *SysManifest,
 			src := filepath.Join(newdir, fName)
 			dest := filepath.Join(mPath, fName)
 			if err := CopyFileBits(src, dest); err != nil {
-				return fmt.Errorf("Failed copying %q to system manifest repo: %w", src, err)
+				return plumbing.ZeroHash, fmt.Errorf("Failed copying %q to system manifest repo: %w", src, err)
 			}
-			if _, err = w.Add(fName); err != nil {
-				return fmt.Errorf("Error adding %q to manifest git index: %w", src, err)
+			if _, err := w.Add(fName); err != nil {
+				return plumbing.ZeroHash, fmt.Errorf("Error adding %q to manifest git index: %w", src, err)
 			}
 		}
 	}
 	src := filepath.Join(newdir, "manifest.yaml")
 	dest := filepath.Join(mPath, "manifest.yaml")
 	if err := CopyFileBits(src, dest); err != nil {
-		return fmt.Errorf("Failed copying manifest to final directory")
+		return plumbing.ZeroHash, fmt.Errorf("Failed copying manifest to final directory")
 	}
-	if _, err = w.Add("manifest.yaml"); err != nil {
-		return fmt.Errorf("Error adding manifest.yaml to manifest git index: %w", err)
+	if _, err := w.Add("manifest.yaml"); err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("Error adding manifest.yaml to manifest git index: %w", err)
 	}
 
 	commitOpts := &git.CommitOptions{
 		Author:    defaultSignature(),
 		Committer: defaultSignature(),
 	}
-	msg := "System upgrade to (TODO - fill in version)" // TODO
-	if _, err := w.Commit(msg, commitOpts); err != nil {
-		return fmt.Errorf("Failed committing to git")
+	hash, err := w.Commit(msg, commitOpts)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("Failed committing to git")
 	}
 
-	return nil
+	return hash, nil
 }
@@ -0,0 +1,211 @@
+package mosconfig
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/go-git/go-git/v5/plumbing"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// The verified system manifest at each branch of manifest.git is cached
+// in $config/manifest-cache/BRANCH.json, so that install manifest
+// signatures and image layouts are only checked again when the branch,
+// the manifest CA, the revocation list or the signer policy change.
+// The cache is authenticated with an HMAC whose key,
+// $config/manifest-cache/key, only root can read.
+func manifestCacheDir(configDir string) string {
+	return filepath.Join(configDir, "manifest-cache")
+}
+
+// A manifestCacheKey is what the cached manifest was verified against.
+type manifestCacheKey struct {
+	Commit string       `json:"commit"`
+	CA     string       `json:"ca"`  // sha256 of the CA
+	CRL    string       `json:"crl"` // sha256 of the CRL, if any
+	Policy SignerPolicy `json:"policy"`
+}
+
+type cachedTarget struct {
+	Name          string         `json:"name"`
+	Source        string         `json:"source"`
+	Raw           *Target        `json:"raw"`
+	CNINetwork    *CNINetwork    `json:"cni_network,omitempty"`
+	SeccompPolicy *SeccompPolicy `json:"seccomp_policy,omitempty"`
+	OCIManifest   ispec.Manifest `json:"oci_manifest"`
+	OCIConfig     ispec.Image    `json:"oci_config"`
+}
+
+type manifestCacheState struct {
+	Key manifestCacheKey `json:"key"`
+
+	// When the first of the manifests' signers expires, after which
+	// the manifest must be verified again if expired signers are
+	// rejected.
+	SignersExpire time.Time `json:"signers_expire"`
+
+	UidMaps []IdmapSet     `json:"uidmaps"`
+	Targets []cachedTarget `json:"targets"`
+}
+
+type manifestCacheFile struct {
+	MAC   string          `json:"mac"`
+	State json.RawMessage `json:"state"`
+}
+
+func (mos *Mos) manifestCacheKey(commit plumbing.Hash) (manifestCacheKey, error) {
+	key := manifestCacheKey{Commit: commit.String()}
+	var err error
+	key.CA, err = ShaSum(mos.opts.CaPath)
+	if err != nil {
+		return key, fmt.Errorf("Failed reading manifest CA: %w", err)
+	}
+	key.Policy, err = mos.signerPolicy(mos.opts.CaPath)
+	if err != nil {
+		return key, err
+	}
+	if PathExists(key.Policy.CRLPath) {
+		key.CRL, err = ShaSum(key.Policy.CRLPath)
+		if err != nil {
+			return key, fmt.Errorf("Failed reading revocation list: %w", err)
+		}
+	}
+	return key, nil
+}
+
+// manifestCacheMACKey returns the HMAC key, creating it if @create and
+// it does not yet exist.
+func (mos *Mos) manifestCacheMACKey(create bool) ([]byte, error) {
+	path := filepath.Join(manifestCacheDir(mos.opts.ConfigDir), "key")
+	key, err := os.ReadFile(path)
+	if err == nil || !os.IsNotExist(err) || !create {
+		return key, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func cacheMAC(key, state []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(state)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func manifestCachePath(configDir string, ref plumbing.ReferenceName) string {
+	return filepath.Join(manifestCacheDir(configDir), ref.Short()+".json")
+}
+
+// readManifestCache returns the cached system manifest at @ref if it was
+// verified against @key, else nil.
+func (mos *Mos) readManifestCache(ref plumbing.ReferenceName, key manifestCacheKey) *SysManifest {
+	content, err := os.ReadFile(manifestCachePath(mos.opts.ConfigDir, ref))
+	if err != nil {
+		return nil
+	}
+	macKey, err := mos.manifestCacheMACKey(false)
+	if err != nil {
+		return nil
+	}
+	var f manifestCacheFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		log.Warnf("Ignoring corrupt manifest cache: %v", err)
+		return nil
+	}
+	if !hmac.Equal([]byte(f.MAC), []byte(cacheMAC(macKey, f.State))) {
+		log.Warnf("Ignoring manifest cache with a bad MAC")
+		return nil
+	}
+	var state manifestCacheState
+	if err := json.Unmarshal(f.State, &state); err != nil {
+		log.Warnf("Ignoring corrupt manifest cache: %v", err)
+		return nil
+	}
+
+	if state.Key != key {
+		return nil
+	}
+	if key.Policy.ExpiredSigners == RejectExpired && time.Now().After(state.SignersExpire) {
+		return nil
+	}
+
+	sysmanifest := SysManifest{UidMaps: state.UidMaps}
+	for _, ct := range state.Targets {
+		sysmanifest.SysTargets = append(sysmanifest.SysTargets, SysTarget{
+			Name:          ct.Name,
+			Source:        ct.Source,
+			raw:           ct.Raw,
+			cniNetwork:    ct.CNINetwork,
+			seccompPolicy: ct.SeccompPolicy,
+			OCIManifest:   ct.OCIManifest,
+			OCIConfig:     ct.OCIConfig,
+		})
+	}
+	return &sysmanifest
+}
+
+// writeManifestCache caches @sysmanifest, verified against @key, as the
+// system manifest at @ref.  Failures are only logged, since the manifest
+// can always be verified again.
+func (mos *Mos) writeManifestCache(ref plumbing.ReferenceName, key manifestCacheKey, sysmanifest *SysManifest, signersExpire time.Time) {
+	state := manifestCacheState{
+		Key:           key,
+		SignersExpire: signersExpire,
+		UidMaps:       sysmanifest.UidMaps,
+	}
+	for _, t := range sysmanifest.SysTargets {
+		state.Targets = append(state.Targets, cachedTarget{
+			Name:          t.Name,
+			Source:        t.Source,
+			Raw:           t.raw,
+			CNINetwork:    t.cniNetwork,
+			SeccompPolicy: t.seccompPolicy,
+			OCIManifest:   t.OCIManifest,
+			OCIConfig:     t.OCIConfig,
+		})
+	}
+
+	err := func() error {
+		stateBytes, err := json.Marshal(&state)
+		if err != nil {
+			return err
+		}
+		macKey, err := mos.manifestCacheMACKey(true)
+		if err != nil {
+			return err
+		}
+		content, err := json.Marshal(&manifestCacheFile{
+			MAC:   cacheMAC(macKey, stateBytes),
+			State: stateBytes,
+		})
+		if err != nil {
+			return err
+		}
+		path := manifestCachePath(mos.opts.ConfigDir, ref)
+		tmp := path + ".tmp"
+		if err := os.WriteFile(tmp, content, 0600); err != nil {
+			return err
+		}
+		return os.Rename(tmp, path)
+	}()
+	if err != nil {
+		log.Warnf("Failed caching the verified system manifest: %v", err)
+	}
+}
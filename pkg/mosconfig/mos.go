@@ -8,12 +8,14 @@ import (
 	"time"
 
 	"github.com/apex/log"
+	"github.com/lxc/lxd/shared/idmap"
 	"github.com/pkg/errors"
 	"golang.org/x/sys/unix"
 )
 
 type MosOptions struct {
-	// Storage type - atomfs for now
+	// Storage type - atomfs or puzzlefs.  If empty, then OpenMos
+	// uses the type which was chosen at install time.
 	StorageType StorageType
 
 	// The host root directory.  If you specify this (to anything other
@@ -42,11 +44,26 @@ type MosOptions struct {
 
 	// OTOH if we want to fetch the manifest CA from a custom path:
 	CaPath string
+
+	// Host paths (relative to RootDir) which targets may bind mount
+	MountSources []string
+
+	// Remote registry from which to pull target images, if they are
+	// not shipped alongside the install manifest.
+	Registry RegistryOpts
+
+	// What runs container services - systemd or mosctl's supervisor.
+	// If empty, then OpenMos uses the type chosen at install time.
+	InitType InitType
+
+	// Always shift containers' files rather than mounting them
+	// idmapped.
+	NoIdmappedMounts bool
 }
 
 func DefaultMosOptions() MosOptions {
 	return MosOptions{
-		StorageType:      AtomfsStorageType,
+		StorageType:      "",
 		ConfigDir:        "",
 		StorageCache:     "",
 		ScratchWrites:    "",
@@ -55,11 +72,13 @@ func DefaultMosOptions() MosOptions {
 		ManifestReadOnly: true,
 		NoHostCerts:      false,
 		CaPath:           "/factory/secure/manifestCA.pem",
+		MountSources:     DefaultMountSources,
 	}
 }
 
 type Mos struct {
 	storage Storage
+	initmgr Initmgr
 	//bootmgr   Bootmgr
 
 	opts     MosOptions
@@ -68,15 +87,18 @@ type Mos struct {
 	Manifest *SysManifest
 }
 
-func NewMos(configDir, storeDir string) (*Mos, error) {
+func NewMos(configDir, storeDir string, storageType StorageType, initType InitType, registry RegistryOpts) (*Mos, error) {
 	opts := MosOptions{
-		StorageType:      AtomfsStorageType,
+		StorageType:      storageType,
 		ConfigDir:        configDir,
 		StorageCache:     storeDir,
 		RootDir:          "/",
 		LayersReadOnly:   false,
 		ManifestReadOnly: false,
 		NoHostCerts:      true,
+		MountSources:     DefaultMountSources,
+		Registry:         registry,
+		InitType:         initType,
 	}
 
 	s, err := NewStorage(opts)
@@ -84,10 +106,16 @@ func NewMos(configDir, storeDir string) (*Mos, error) {
 		return nil, fmt.Errorf("Error initializing storage")
 	}
 
+	initmgr, err := NewInitmgr(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	mos := &Mos{
 		opts:     opts,
 		lockfile: nil,
 		storage:  s,
+		initmgr:  initmgr,
 	}
 
 	if err := mos.acquireLock(); err != nil {
@@ -112,20 +140,45 @@ func setDirOpts(opts MosOptions) MosOptions {
 	if opts.RootDir != "/" && !strings.HasPrefix(opts.CaPath, opts.RootDir) {
 		opts.CaPath = filepath.Join(opts.RootDir, opts.CaPath)
 	}
+	if opts.MountSources == nil {
+		opts.MountSources = DefaultMountSources
+	}
 	return opts
 }
 
 func OpenMos(opts MosOptions) (*Mos, error) {
 	opts = setDirOpts(opts)
 
+	if opts.StorageType == "" {
+		t, err := readStorageType(opts.ConfigDir)
+		if err != nil {
+			return nil, err
+		}
+		opts.StorageType = t
+	}
+
+	if opts.InitType == "" {
+		t, err := readInitType(opts.ConfigDir)
+		if err != nil {
+			return nil, err
+		}
+		opts.InitType = t
+	}
+
 	s, err := NewStorage(opts)
 	if err != nil {
 		return nil, fmt.Errorf("Error initializing storage")
 	}
 
+	initmgr, err := NewInitmgr(opts)
+	if err != nil {
+		return nil, err
+	}
+
 	mos := &Mos{
 		opts:    opts,
 		storage: s,
+		initmgr: initmgr,
 	}
 
 	err = mos.acquireLock()
@@ -168,6 +221,7 @@ func (mos *Mos) Current(name string) (*Target, error) {
 // If it is not yet running then start it.
 // If it is already running, but is not at the newest version (i.e. after an
 // upgrade), then restart it. (Not fully implemented)
+// hostfs is instead staged to be booted next, see ActivateHostfs.
 func (mos *Mos) Activate(name string) error {
 	t, err := mos.Current(name)
 	if err != nil {
@@ -175,26 +229,31 @@ func (mos *Mos) Activate(name string) error {
 	}
 
 	if t.ServiceType == HostfsService {
-		return fmt.Errorf("Reboot not yet supported, do it yourself")
+		return mos.ActivateHostfs(BootNone)
 	}
 
-	v, err := mos.RunningVersion(t)
+	v, hash, err := mos.runningImage(t)
 	if err != nil {
 		return err
 	}
 
-	log.Infof("running version is \"%q\" wanted version is %q", v, t.Version)
-	if v == t.Version {
-		// TODO this is actually broken - what we get is the layer config
-		// hash (e.g. ee60af2a371e08a67174387985dd5f270d5596f7265f94f15107889aab454157),
-		// but we need the version.  This isn't so bad, we just always restart
-		// on activate.
-
+	log.Infof("running version is %q wanted version is %q", v, t.Version)
+	if v == t.Version && hash == t.ManifestHash {
 		// latest version already running
 		return nil
 	}
+	running := hash != ""
 
-	if v != "" {
+	// Targets which depend on t are stopped along with it
+	dependents := []*Target{}
+	if running && t.ServiceType == ContainerService {
+		dependents, err = mos.runningDependents(t)
+		if err != nil {
+			return fmt.Errorf("Failed finding dependents of %s: %w", name, err)
+		}
+	}
+
+	if running {
 		log.Infof("Stopping target %q", t.ServiceName)
 		err = mos.StopTarget(t)
 		if err != nil {
@@ -212,17 +271,38 @@ func (mos *Mos) Activate(name string) error {
 		return nil
 	}
 
+	// WaitReady must not see the health of the previous run
+	if err := clearHealthState(mos.opts.RootDir, t.ServiceName); err != nil {
+		return err
+	}
+
 	err = mos.startInit(t)
 	if err != nil {
 		return err
 	}
 
+	mos.restartDependents(dependents)
+
 	return nil
 }
 
 func (mos *Mos) SetupTargetRuntime(t *Target) error {
 	log.Debugf("Setting up target %s", t.ServiceName)
-	err := mos.storage.SetupTarget(t)
+
+	// Containers' files are mounted idmapped into their uid range
+	// where we can, rather than shifted.
+	var idmapset *idmap.IdmapSet
+	if t.ServiceType == ContainerService && t.NeedsIdmap() && !mos.opts.NoIdmappedMounts {
+		set, _, err := mos.GetUIDMapStr(t)
+		if err != nil {
+			return err
+		}
+		if len(set.Idmap) != 0 {
+			idmapset = &set
+		}
+	}
+
+	idmapped, err := mos.storage.SetupTarget(t, idmapset)
 	if err != nil {
 		return fmt.Errorf("Failed setting up storage for %s:%s: %w", t.ServiceName, t.Version, err)
 	}
@@ -233,7 +313,7 @@ func (mos *Mos) SetupTargetRuntime(t *Target) error {
 	case HostfsService:
 		return nil
 	case ContainerService:
-		return mos.setupContainerService(t)
+		return mos.setupContainerService(t, idmapped)
 	default:
 		return fmt.Errorf("Unhandled service type %s", t.ServiceType)
 	}
@@ -265,16 +345,29 @@ func (mos *Mos) startFsOnly(t *Target) error {
 	if err = unix.Mount(src, dest, "", unix.MS_BIND, ""); err != nil {
 		return err
 	}
+	if err = mos.bindMounts(t, dest); err != nil {
+		unmountTree(dest)
+		return fmt.Errorf("Failed setting up mounts for %s: %w", t.ServiceName, err)
+	}
+	if err = mos.bindVolumes(t, dest); err != nil {
+		unmountTree(dest)
+		return fmt.Errorf("Failed setting up volumes for %s: %w", t.ServiceName, err)
+	}
 	return nil
 }
 
-func (mos *Mos) setupContainerService(t *Target) error {
-	err := mos.writeLxcConfig(t)
+func (mos *Mos) setupContainerService(t *Target, idmapped bool) error {
+	err := mos.writeLxcConfig(t, idmapped)
+	if err != nil {
+		return err
+	}
+
+	err = mos.writeHealthcheck(t)
 	if err != nil {
 		return err
 	}
 
-	err = mos.writeContainerService(t)
+	err = mos.initmgr.Enable(t)
 	if err != nil {
 		return err
 	}
@@ -288,12 +381,19 @@ func (mos *Mos) SetupNetwork(t *Target) ([]string, error) {
 		return []string{"lxc.net.0.type = none"}, nil
 	case NoNetwork:
 		return []string{"lxc.net.0.type = empty"}, nil
+	case SimpleNetwork:
+		return mos.setupSimpleNetwork(t)
+	case CNINetworkType:
+		return mos.setupCNINetwork(t, filepath.Join(mos.opts.RootDir, "var/lib/lxc", t.ServiceName))
 	default:
 		return []string{}, fmt.Errorf("Unhandled network type: %s", t.Network.Type)
 	}
 }
 
-func (mos *Mos) writeLxcConfig(t *Target) error {
+// writeLxcConfig writes the lxc configuration for container @t.  If its
+// root filesystem is not @idmapped, then its files are first shifted
+// into the container's uid range.
+func (mos *Mos) writeLxcConfig(t *Target, idmapped bool) error {
 	// We are guaranteed to have stopped the container before reaching
 	// here
 	lxcStateDir := filepath.Join(mos.opts.RootDir, "var/lib/lxc")
@@ -329,7 +429,7 @@ func (mos *Mos) writeLxcConfig(t *Target) error {
 		lxcConf = append(lxcConf, "lxc.idmap = "+line)
 	}
 
-	if err := addUidMapping(idmapset); err != nil {
+	if err := mos.addUidMapping(t); err != nil {
 		return err
 	}
 
@@ -359,17 +459,31 @@ func (mos *Mos) writeLxcConfig(t *Target) error {
 	}
 	log.Infof("mountpoint %q is ready after %d seconds", rfs, count)
 
-	if !UidmapIsHost() {
-		err = fixupSymlinks(rfs)
-		if err != nil {
-			return err
-		}
+	// An idmapped rootfs is the read-only image, in which mount
+	// destinations must already exist.  Otherwise create them before
+	// shifting, so that they are owned by the container.
+	mounts, err := mos.lxcMountEntries(t, rfs, !idmapped)
+	if err != nil {
+		return fmt.Errorf("Failed setting up mounts for %s: %w", t.ServiceName, err)
+	}
+	volumes, err := mos.lxcVolumeEntries(t, rfs, &idmapset, !idmapped)
+	if err != nil {
+		return fmt.Errorf("Failed setting up volumes for %s: %w", t.ServiceName, err)
 	}
 
-	if len(idmapset.Idmap) != 0 {
-		err = idmapset.ShiftFile(rfs)
-		if err != nil {
-			return err
+	if !idmapped {
+		if !UidmapIsHost() {
+			err = fixupSymlinks(rfs)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(idmapset.Idmap) != 0 {
+			err = idmapset.ShiftFile(rfs)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	lxcConf = append(lxcConf, "lxc.rootfs.path = "+rfs)
@@ -385,16 +499,26 @@ func (mos *Mos) writeLxcConfig(t *Target) error {
 	lxcConf = append(lxcConf, fmt.Sprintf("lxc.execute.cmd = %s", strings.Join(cmd, " ")))
 	lxcConf = append(lxcConf, "lxc.mount.auto = proc:mixed")
 	lxcConf = append(lxcConf, "lxc.log.level = TRACE")
-	// XXX TODO the apparmor profile should only be unset if we
-	// are running in a confined, nested parent container (for testing).
-	lxcConf = append(lxcConf, "lxc.apparmor.profile = unchanged")
 	lxcConf = append(lxcConf, fmt.Sprintf("lxc.log.file = %s/%s.log", lxclogDir, t.ServiceName))
 
 	for _, env := range syst.OCIConfig.Config.Env {
 		lxcConf = append(lxcConf, fmt.Sprintf("lxc.environment = %s", env))
 	}
 
-	// TODO - setup the mounts
+	lxcConf = append(lxcConf, mounts...)
+	lxcConf = append(lxcConf, volumes...)
+
+	resources, err := lxcResourceEntries(t)
+	if err != nil {
+		return fmt.Errorf("Failed setting up resource limits for %s: %w", t.ServiceName, err)
+	}
+	lxcConf = append(lxcConf, resources...)
+
+	security, err := mos.lxcSecurityEntries(t, lxcconfigDir)
+	if err != nil {
+		return fmt.Errorf("Failed setting up security policy for %s: %w", t.ServiceName, err)
+	}
+	lxcConf = append(lxcConf, security...)
 
 	// Write the result
 	lxcConfFile := filepath.Join(lxcconfigDir, "config")
@@ -411,38 +535,72 @@ func (mos *Mos) writeLxcConfig(t *Target) error {
 	return nil
 }
 
-// Return the layer hash for a running service.
-// We do this by looking for the mounted fs and using the hash to look
-// back through the manifest and find the current version.
-// Return "", nil if the service is not running.
-func (mos *Mos) RunningVersion(t *Target) (string, error) {
+// runningImage returns the version and manifest hash of target @t's
+// image which is mounted, or "", "" if it is not running.  They come from
+// the state which SetupTarget recorded if that still matches the mounts,
+// else from looking the mounted hash up in our store, in which case the
+// version is "" if it cannot be found.
+func (mos *Mos) runningImage(t *Target) (string, string, error) {
 	hash, err := mos.storage.MountedByHash(t)
+	if err != nil {
+		return "", "", err
+	}
+	if hash == "" {
+		return "", "", nil
+	}
+
+	s, err := readTargetState(mos.opts.ScratchWrites, t.ServiceName)
+	if err != nil {
+		return "", "", err
+	}
+	if s != nil && s.ImagePath == t.ImagePath && s.ManifestHash == hash {
+		return s.Version, s.ManifestHash, nil
+	}
+
+	version, mHash, err := mos.imageForHash(t, hash)
+	if err != nil {
+		return "", "", err
+	}
+	if version == "" {
+		return "", hash, nil
+	}
+	return version, mHash, nil
+}
+
+// RunningVersion returns the version of target @t's image which is
+// mounted, or "" if it is not running.  If the mounted image cannot be
+// found in our store, then the mounted hash is returned instead.
+func (mos *Mos) RunningVersion(t *Target) (string, error) {
+	version, hash, err := mos.runningImage(t)
 	if err != nil {
 		return "", err
 	}
-	log.Infof("RunningVersion: %s has version %q", t.ServiceName, hash)
+	if version == "" && hash != "" {
+		log.Warnf("RunningVersion: no image found for %s with hash %q", t.ServiceName, hash)
+		return hash, nil
+	}
+	log.Infof("RunningVersion: %s has version %q", t.ServiceName, version)
 
-	return hash, nil
+	return version, nil
 }
 
 func (mos *Mos) StopTarget(t *Target) error {
-	unitName := fmt.Sprintf("%s.service", t.ServiceName)
 	switch t.ServiceType {
 	case ContainerService:
-		out, rc := RunCommandWithRc("systemctl", "stop", unitName)
-		outs := string(out)
-		if rc != 0 && !strings.HasSuffix(outs, "not loaded.\n") {
-			return fmt.Errorf("Failed to stop service %s: %s", t.ServiceName, outs)
+		if err := mos.initmgr.Stop(t); err != nil {
+			return err
+		}
+		if err := clearHealthState(mos.opts.RootDir, t.ServiceName); err != nil {
+			return err
+		}
+		if err := mos.TearDownNetwork(t); err != nil {
+			log.Warnf("Failed tearing down network for %s: %v", t.ServiceName, err)
 		}
 	case HostfsService:
-		return fmt.Errorf("Stopping hostfs is not yet supported.  Please poweroff")
+		return fmt.Errorf("hostfs cannot be stopped, activate it with a reboot instead")
 	case FsService:
 		mp := filepath.Join(mos.opts.RootDir, "/mnt/atom", t.ServiceName)
-		err := unix.Unmount(mp, 0)
-		if err != nil {
-			return err
-		}
-		return nil
+		return unmountTree(mp)
 	default:
 		return fmt.Errorf("Unhandled service type: %s", t.ServiceType)
 	}
@@ -452,5 +610,13 @@ func (mos *Mos) StopTarget(t *Target) error {
 		return fmt.Errorf("Failed shutting down storage for %s: %w", t.ServiceName, err)
 	}
 
+	// The container may have been the last user of an nsgroup range
+	// which an update dropped.
+	if t.ServiceType == ContainerService {
+		if err := mos.releaseIdmaps(); err != nil {
+			log.Warnf("Failed releasing unused idmaps: %v", err)
+		}
+	}
+
 	return nil
 }
@@ -0,0 +1,290 @@
+package mosconfig
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/apex/log"
+	securejoin "github.com/cyphar/filepath-securejoin"
+	"golang.org/x/sys/unix"
+)
+
+// Host paths which a target is allowed to bind mount from, unless
+// overridden in MosOptions.  Paths are relative to the mos RootDir.
+var DefaultMountSources = []string{
+	"/data",
+	"/run",
+}
+
+// mount options which may be specified in a MountSpec
+var allowedMountOptions = map[string]bool{
+	"ro":     true,
+	"rw":     true,
+	"nosuid": true,
+	"nodev":  true,
+	"noexec": true,
+	"rbind":  true,
+}
+
+func (m *MountSpec) optionList() []string {
+	opts := []string{}
+	for _, o := range strings.Split(m.Options, ",") {
+		o = strings.TrimSpace(o)
+		if o != "" {
+			opts = append(opts, o)
+		}
+	}
+	return opts
+}
+
+func validateMountPath(p string) error {
+	if !filepath.IsAbs(p) {
+		return fmt.Errorf("path %q is not absolute", p)
+	}
+	if strings.ContainsAny(p, " \t\n") {
+		return fmt.Errorf("path %q contains whitespace", p)
+	}
+	for _, c := range strings.Split(p, "/") {
+		if c == ".." {
+			return fmt.Errorf("path %q contains '..'", p)
+		}
+	}
+	return nil
+}
+
+// Validate checks the syntax of a mount spec.  Whether the source is
+// allowed on this host is only checked at activation time.
+func (m *MountSpec) Validate() error {
+	if err := validateMountPath(m.Source); err != nil {
+		return fmt.Errorf("Bad mount source: %w", err)
+	}
+	if err := validateMountPath(m.Dest); err != nil {
+		return fmt.Errorf("Bad mount dest: %w", err)
+	}
+	if filepath.Clean(m.Dest) == "/" {
+		return fmt.Errorf("Cannot mount over the target's root directory")
+	}
+	for _, o := range m.optionList() {
+		if !allowedMountOptions[o] {
+			return fmt.Errorf("Unsupported mount option %q", o)
+		}
+	}
+	return nil
+}
+
+func (t Target) ValidateMounts() error {
+	for _, m := range t.Mounts {
+		if m == nil {
+			return fmt.Errorf("Empty mount entry")
+		}
+		if err := m.Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isUnder returns true if path is dir or is a path under dir.
+func isUnder(path, dir string) bool {
+	if dir == "/" {
+		return true
+	}
+	return path == dir || strings.HasPrefix(path, dir+"/")
+}
+
+// mountSource returns the host path to bind mount for @m, after
+// checking it against the allowed mount sources.
+func (mos *Mos) mountSource(m *MountSpec) (string, error) {
+	src := filepath.Join(mos.opts.RootDir, m.Source)
+	real, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return "", fmt.Errorf("Mount source %q is not available: %w", m.Source, err)
+	}
+
+	for _, a := range mos.opts.MountSources {
+		allowed := filepath.Join(mos.opts.RootDir, a)
+		if !isUnder(filepath.Clean(src), allowed) {
+			continue
+		}
+		// Make sure no symlink leads out of the allowed tree
+		realAllowed, err := filepath.EvalSymlinks(allowed)
+		if err != nil {
+			continue
+		}
+		if isUnder(real, realAllowed) {
+			return real, nil
+		}
+	}
+
+	return "", fmt.Errorf("Mount source %q is not an allowed host path", m.Source)
+}
+
+// mountDest returns the full path under @rootfs at which to mount @m,
+// creating it if needed and @create is true.  Symlinks are resolved
+// within @rootfs, so the result can never escape it.
+func mountDest(rootfs, src string, m *MountSpec, create bool) (string, error) {
+	dest, err := securejoin.SecureJoin(rootfs, m.Dest)
+	if err != nil {
+		return "", fmt.Errorf("Failed resolving %q under %q: %w", m.Dest, rootfs, err)
+	}
+	if !isUnder(dest, rootfs) || dest == rootfs {
+		return "", fmt.Errorf("Mount destination %q escapes the target rootfs", m.Dest)
+	}
+
+	if PathExists(dest) {
+		return dest, nil
+	}
+	if !create {
+		return "", fmt.Errorf("Mount destination %q does not exist in the read-only image", m.Dest)
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		return "", err
+	}
+	if fi.IsDir() {
+		if err := EnsureDir(dest); err != nil {
+			return "", err
+		}
+		return dest, nil
+	}
+
+	if err := EnsureDir(filepath.Dir(dest)); err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_RDONLY, 0644)
+	if err != nil {
+		return "", fmt.Errorf("Failed creating mount destination %q: %w", dest, err)
+	}
+	f.Close()
+	return dest, nil
+}
+
+// lxcMountEntry returns the lxc.mount.entry line for bind mounting host
+// path @src according to @m, into a container whose rootfs is at @rootfs.
+// The destination is created if needed and @create is true.
+func lxcMountEntry(rootfs, src string, m *MountSpec, create bool) (string, error) {
+	dest, err := mountDest(rootfs, src, m, create)
+	if err != nil {
+		return "", err
+	}
+	rel := strings.TrimPrefix(dest, rootfs+"/")
+
+	opts := []string{"bind"}
+	for _, o := range m.optionList() {
+		if o == "rbind" {
+			opts[0] = "rbind"
+			continue
+		}
+		opts = append(opts, o)
+	}
+	return fmt.Sprintf("lxc.mount.entry = %s %s none %s 0 0", src, rel, strings.Join(opts, ",")), nil
+}
+
+// Return the lxc.mount.entry lines for a container target, whose
+// rootfs is mounted at @rootfs, and writeable if @create is true.
+func (mos *Mos) lxcMountEntries(t *Target, rootfs string, create bool) ([]string, error) {
+	entries := []string{}
+	for _, m := range t.Mounts {
+		src, err := mos.mountSource(m)
+		if err != nil {
+			return entries, err
+		}
+		entry, err := lxcMountEntry(rootfs, src, m, create)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// bindMount bind mounts host path @src according to @m under @rootfs,
+// in our own mount namespace.  @rootfs is a read-only image, so the
+// destination must already exist in it.
+func bindMount(rootfs, src string, m *MountSpec) error {
+	dest, err := mountDest(rootfs, src, m, false)
+	if err != nil {
+		return err
+	}
+
+	flags := uintptr(unix.MS_BIND)
+	for _, o := range m.optionList() {
+		if o == "rbind" {
+			flags |= unix.MS_REC
+		}
+	}
+	if err := unix.Mount(src, dest, "", flags, ""); err != nil {
+		return fmt.Errorf("Failed bind mounting %q onto %q: %w", src, dest, err)
+	}
+
+	flags = unix.MS_BIND | unix.MS_REMOUNT
+	for _, o := range m.optionList() {
+		switch o {
+		case "ro":
+			flags |= unix.MS_RDONLY
+		case "nosuid":
+			flags |= unix.MS_NOSUID
+		case "nodev":
+			flags |= unix.MS_NODEV
+		case "noexec":
+			flags |= unix.MS_NOEXEC
+		}
+	}
+	if flags != unix.MS_BIND|unix.MS_REMOUNT {
+		if err := unix.Mount("", dest, "", flags, ""); err != nil {
+			return fmt.Errorf("Failed setting mount options on %q: %w", dest, err)
+		}
+	}
+	return nil
+}
+
+// Apply the target's mounts under @rootfs in our own mount namespace.
+// Used for fs-only targets.
+func (mos *Mos) bindMounts(t *Target, rootfs string) error {
+	for _, m := range t.Mounts {
+		src, err := mos.mountSource(m)
+		if err != nil {
+			return err
+		}
+		if err := bindMount(rootfs, src, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unmount everything mounted at or under @dir, deepest first.
+func unmountTree(dir string) error {
+	dir = filepath.Clean(dir)
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	mps := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) <= 1 {
+			continue
+		}
+		if isUnder(fields[1], dir) {
+			mps = append(mps, fields[1])
+		}
+	}
+
+	sort.Slice(mps, func(i, j int) bool { return len(mps[i]) > len(mps[j]) })
+	for _, mp := range mps {
+		if err := unix.Unmount(mp, 0); err != nil {
+			log.Warnf("Failed unmounting %q: %v", mp, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -1,6 +1,447 @@
 package mosconfig
 
-func (t Target) ValidateNetwork() bool {
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"gopkg.in/yaml.v2"
+)
+
+// A PortForward forwards connections to HostPort on the host to
+// ContainerPort in a container on a 'simple' network.
+type PortForward struct {
+	Protocol      string `yaml:"protocol"` // tcp (the default) or udp
+	HostPort      int    `yaml:"host_port"`
+	ContainerPort int    `yaml:"container_port"`
+}
+
+func (p PortForward) proto() string {
+	if p.Protocol == "" {
+		return "tcp"
+	}
+	return p.Protocol
+}
+
+func (p PortForward) Validate() error {
+	if p.Protocol != "" && p.Protocol != "tcp" && p.Protocol != "udp" {
+		return fmt.Errorf("Bad protocol %q", p.Protocol)
+	}
+	if p.HostPort < 1 || p.HostPort > 65535 {
+		return fmt.Errorf("Bad host port %d", p.HostPort)
+	}
+	if p.ContainerPort < 1 || p.ContainerPort > 65535 {
+		return fmt.Errorf("Bad container port %d", p.ContainerPort)
+	}
+	return nil
+}
+
+func (t Target) ValidateNetwork() error {
 	n := t.Network
-	return n.Type == HostNetwork || n.Type == NoNetwork
+	if n.Type != SimpleNetwork && (n.Address != "" || len(n.Ports) != 0) {
+		return fmt.Errorf("Address and ports are only supported for %s networks", SimpleNetwork)
+	}
+	if n.Type != CNINetworkType && n.CNINetwork != "" {
+		return fmt.Errorf("cni_network is only supported for %s networks", CNINetworkType)
+	}
+
+	switch n.Type {
+	case HostNetwork, NoNetwork:
+		return nil
+	case CNINetworkType:
+		if t.ServiceType != ContainerService {
+			return fmt.Errorf("Only containers can use a %s network", CNINetworkType)
+		}
+		if n.CNINetwork == "" {
+			return fmt.Errorf("No cni_network given")
+		}
+		return nil
+	case SimpleNetwork:
+	default:
+		return fmt.Errorf("Unknown network type %q", n.Type)
+	}
+
+	if t.ServiceType != ContainerService {
+		return fmt.Errorf("Only containers can use a %s network", SimpleNetwork)
+	}
+	if n.Address != "" {
+		ip := net.ParseIP(n.Address)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("Bad IPv4 address %q", n.Address)
+		}
+	}
+	seen := map[string]bool{}
+	for _, p := range n.Ports {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s/%d", p.proto(), p.HostPort)
+		if seen[key] {
+			return fmt.Errorf("Host port %s is forwarded twice", key)
+		}
+		seen[key] = true
+	}
+	return nil
+}
+
+// NetworkConfig is the host side configuration of 'simple' networks.  It
+// is read from $config/network.yaml, and the defaults are used if that
+// does not exist.
+type NetworkConfig struct {
+	Bridge string `yaml:"bridge"`
+	Subnet string `yaml:"subnet"`
+}
+
+const (
+	DefaultBridge = "mosbr0"
+	DefaultSubnet = "10.0.137.0/24"
+)
+
+// simpleNet is a parsed NetworkConfig.  The bridge has the first host
+// address in the subnet, and is the containers' gateway.
+type simpleNet struct {
+	bridge  string
+	subnet  *net.IPNet
+	gateway net.IP
+}
+
+func (s simpleNet) prefixLen() int {
+	ones, _ := s.subnet.Mask.Size()
+	return ones
+}
+
+func ipToUint(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uintToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+func (mos *Mos) networkConfig() (simpleNet, error) {
+	conf := NetworkConfig{Bridge: DefaultBridge, Subnet: DefaultSubnet}
+	path := filepath.Join(mos.opts.ConfigDir, "network.yaml")
+	content, err := os.ReadFile(path)
+	if err == nil {
+		if err := yaml.Unmarshal(content, &conf); err != nil {
+			return simpleNet{}, fmt.Errorf("Failed parsing %q: %w", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return simpleNet{}, fmt.Errorf("Failed reading network configuration: %w", err)
+	}
+
+	if conf.Bridge == "" {
+		conf.Bridge = DefaultBridge
+	}
+	if conf.Subnet == "" {
+		conf.Subnet = DefaultSubnet
+	}
+	_, subnet, err := net.ParseCIDR(conf.Subnet)
+	if err != nil || subnet.IP.To4() == nil {
+		return simpleNet{}, fmt.Errorf("Bad subnet %q", conf.Subnet)
+	}
+	if ones, _ := subnet.Mask.Size(); ones > 30 {
+		return simpleNet{}, fmt.Errorf("Subnet %q is too small", conf.Subnet)
+	}
+
+	return simpleNet{
+		bridge:  conf.Bridge,
+		subnet:  subnet,
+		gateway: uintToIP(ipToUint(subnet.IP) + 1),
+	}, nil
+}
+
+// The addresses handed out to containers are remembered in
+// $config/network-leases.yaml, so that a container keeps its address
+// across restarts and updates.
+func (mos *Mos) leasesPath() string {
+	return filepath.Join(mos.opts.ConfigDir, "network-leases.yaml")
+}
+
+// allocateAddress returns the address for target @t on network @sn.
+// This is the target's declared address if it has one, otherwise its
+// previous lease, or else the lowest free address in the subnet.
+func (mos *Mos) allocateAddress(t *Target, sn simpleNet) (net.IP, error) {
+	manifest, err := mos.CurrentManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	leases := map[string]string{}
+	content, err := os.ReadFile(mos.leasesPath())
+	if err == nil {
+		if err := yaml.Unmarshal(content, &leases); err != nil {
+			return nil, fmt.Errorf("Failed parsing network leases: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("Failed reading network leases: %w", err)
+	}
+
+	// Addresses which are in use or declared by other targets.
+	taken := map[string]bool{sn.gateway.String(): true}
+	current := map[string]bool{}
+	for _, st := range manifest.SysTargets {
+		current[st.Name] = true
+		if st.Name != t.ServiceName && st.raw.Network.Address != "" {
+			taken[st.raw.Network.Address] = true
+		}
+	}
+	for name, addr := range leases {
+		if !current[name] {
+			delete(leases, name)
+			continue
+		}
+		if name != t.ServiceName {
+			taken[addr] = true
+		}
+	}
+
+	var ip net.IP
+	if t.Network.Address != "" {
+		ip = net.ParseIP(t.Network.Address).To4()
+		if !sn.subnet.Contains(ip) || ip.Equal(sn.gateway) {
+			return nil, fmt.Errorf("Address %s of %s is not usable in subnet %s", ip, t.ServiceName, sn.subnet)
+		}
+		if taken[ip.String()] {
+			return nil, fmt.Errorf("Address %s of %s is already in use", ip, t.ServiceName)
+		}
+	} else if prev, ok := leases[t.ServiceName]; ok && sn.subnet.Contains(net.ParseIP(prev)) && !taken[prev] {
+		ip = net.ParseIP(prev).To4()
+	} else {
+		ones, bits := sn.subnet.Mask.Size()
+		first := ipToUint(sn.gateway) + 1
+		last := ipToUint(sn.subnet.IP) + (1 << uint(bits-ones)) - 2
+		for n := first; n <= last; n++ {
+			if !taken[uintToIP(n).String()] {
+				ip = uintToIP(n)
+				break
+			}
+		}
+		if ip == nil {
+			return nil, fmt.Errorf("No free address left in subnet %s", sn.subnet)
+		}
+	}
+
+	leases[t.ServiceName] = ip.String()
+	content, err = yaml.Marshal(leases)
+	if err != nil {
+		return nil, fmt.Errorf("Failed marshalling network leases: %w", err)
+	}
+	if err := os.WriteFile(mos.leasesPath(), content, 0644); err != nil {
+		return nil, fmt.Errorf("Failed writing network leases: %w", err)
+	}
+
+	return ip, nil
+}
+
+// iptablesEnsure appends rule @rule to @chain of @table unless it is
+// already there.
+func iptablesEnsure(table, chain string, rule ...string) error {
+	check := append([]string{"iptables", "-t", table, "-C", chain}, rule...)
+	if _, rc := RunCommandWithRc(check...); rc == 0 {
+		return nil
+	}
+	add := append([]string{"iptables", "-t", table, "-A", chain}, rule...)
+	return RunCommand(add...)
+}
+
+// iptablesRemove deletes rule @rule from @chain of @table if it is there.
+func iptablesRemove(table, chain string, rule ...string) error {
+	check := append([]string{"iptables", "-t", table, "-C", chain}, rule...)
+	if _, rc := RunCommandWithRc(check...); rc != 0 {
+		return nil
+	}
+	del := append([]string{"iptables", "-t", table, "-D", chain}, rule...)
+	return RunCommand(del...)
+}
+
+// iptablesDeleteTagged removes all rules in @chain of @table which have
+// the comment @tag.
+func iptablesDeleteTagged(table, chain, tag string) error {
+	out, rc := RunCommandWithRc("iptables", "-t", table, "-S", chain)
+	if rc != 0 {
+		return fmt.Errorf("Failed listing iptables %s %s: %s", table, chain, string(out))
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "-A" {
+			continue
+		}
+		tagged := false
+		for i, f := range fields {
+			fields[i] = strings.Trim(f, "\"")
+			if i > 0 && fields[i-1] == "--comment" && fields[i] == tag {
+				tagged = true
+			}
+		}
+		if !tagged {
+			continue
+		}
+		fields[0] = "-D"
+		args := append([]string{"iptables", "-t", table}, fields...)
+		if err := RunCommand(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func portForwardTag(t *Target) string {
+	return "mos:" + t.ServiceName
+}
+
+// ensureBridge creates the bridge for network @sn if needed, and sets up
+// forwarding and masquerading for its subnet.  Only replies and the
+// connections to forwarded ports are let through to the containers.
+func ensureBridge(sn simpleNet) error {
+	if _, rc := RunCommandWithRc("ip", "link", "show", sn.bridge); rc != 0 {
+		log.Infof("creating bridge %s for %s", sn.bridge, sn.subnet)
+		if err := RunCommand("ip", "link", "add", sn.bridge, "type", "bridge"); err != nil {
+			return fmt.Errorf("Failed creating bridge %s: %w", sn.bridge, err)
+		}
+	}
+
+	addr := fmt.Sprintf("%s/%d", sn.gateway, sn.prefixLen())
+	out, rc := RunCommandWithRc("ip", "-4", "-o", "addr", "show", "dev", sn.bridge)
+	if rc != 0 {
+		return fmt.Errorf("Failed reading addresses of %s: %s", sn.bridge, string(out))
+	}
+	if !strings.Contains(string(out), " "+addr+" ") {
+		if err := RunCommand("ip", "addr", "add", addr, "dev", sn.bridge); err != nil {
+			return fmt.Errorf("Failed adding address to %s: %w", sn.bridge, err)
+		}
+	}
+	if err := RunCommand("ip", "link", "set", sn.bridge, "up"); err != nil {
+		return fmt.Errorf("Failed bringing up %s: %w", sn.bridge, err)
+	}
+
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1\n"), 0644); err != nil {
+		return fmt.Errorf("Failed enabling ip forwarding: %w", err)
+	}
+
+	subnet := sn.subnet.String()
+	if err := iptablesEnsure("nat", "POSTROUTING", "-s", subnet, "!", "-o", sn.bridge, "-j", "MASQUERADE"); err != nil {
+		return fmt.Errorf("Failed setting up masquerading for %s: %w", subnet, err)
+	}
+	if err := iptablesEnsure("filter", "FORWARD", "-i", sn.bridge, "-j", "ACCEPT"); err != nil {
+		return fmt.Errorf("Failed allowing forwarding from %s: %w", sn.bridge, err)
+	}
+	// Older releases let everything through to the containers
+	if err := iptablesRemove("filter", "FORWARD", "-o", sn.bridge, "-j", "ACCEPT"); err != nil {
+		return fmt.Errorf("Failed removing forwarding rule for %s: %w", sn.bridge, err)
+	}
+	if err := iptablesEnsure("filter", "FORWARD", "-o", sn.bridge, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
+		return fmt.Errorf("Failed allowing replies to %s: %w", sn.bridge, err)
+	}
+	if err := iptablesEnsure("filter", "FORWARD", "-o", sn.bridge, "-m", "conntrack", "--ctstate", "DNAT", "-j", "ACCEPT"); err != nil {
+		return fmt.Errorf("Failed allowing forwarded ports to %s: %w", sn.bridge, err)
+	}
+	if err := iptablesEnsure("filter", "FORWARD", "-o", sn.bridge, "-j", "DROP"); err != nil {
+		return fmt.Errorf("Failed limiting forwarding to %s: %w", sn.bridge, err)
+	}
+
+	return nil
+}
+
+// setupPortForwards replaces the port forwards of @t, whose container
+// has address @ip.
+func setupPortForwards(t *Target, ip net.IP) error {
+	if err := tearDownPortForwards(t); err != nil {
+		return err
+	}
+
+	tag := portForwardTag(t)
+	for _, p := range t.Network.Ports {
+		dest := fmt.Sprintf("%s:%d", ip, p.ContainerPort)
+		// Only connections to the host's own addresses are forwarded,
+		// not those passing through it, such as the containers' own
+		// connections to remote hosts.
+		rule := []string{"-m", "addrtype", "--dst-type", "LOCAL",
+			"-p", p.proto(), "--dport", fmt.Sprintf("%d", p.HostPort),
+			"-m", "comment", "--comment", tag, "-j", "DNAT", "--to-destination", dest}
+		if err := iptablesEnsure("nat", "PREROUTING", rule...); err != nil {
+			return fmt.Errorf("Failed forwarding port %d to %s: %w", p.HostPort, dest, err)
+		}
+		// Connections from the host itself
+		if err := iptablesEnsure("nat", "OUTPUT", rule...); err != nil {
+			return fmt.Errorf("Failed forwarding local port %d to %s: %w", p.HostPort, dest, err)
+		}
+	}
+	return nil
+}
+
+// validateHostPorts checks that no two of @targets forward the same
+// host port.
+func validateHostPorts(targets []*Target) error {
+	owners := map[string]string{}
+	for _, t := range targets {
+		if t.Network.Type != SimpleNetwork {
+			continue
+		}
+		for _, p := range t.Network.Ports {
+			key := fmt.Sprintf("%s/%d", p.proto(), p.HostPort)
+			if owner, ok := owners[key]; ok && owner != t.ServiceName {
+				return fmt.Errorf("Host port %s is forwarded to both %s and %s", key, owner, t.ServiceName)
+			}
+			owners[key] = t.ServiceName
+		}
+	}
+	return nil
+}
+
+func tearDownPortForwards(t *Target) error {
+	tag := portForwardTag(t)
+	for _, chain := range []string{"PREROUTING", "OUTPUT"} {
+		if err := iptablesDeleteTagged("nat", chain, tag); err != nil {
+			return fmt.Errorf("Failed removing port forwards for %s: %w", t.ServiceName, err)
+		}
+	}
+	return nil
+}
+
+// setupSimpleNetwork connects the container for @t to the host bridge,
+// and returns the lxc network configuration for it.
+func (mos *Mos) setupSimpleNetwork(t *Target) ([]string, error) {
+	sn, err := mos.networkConfig()
+	if err != nil {
+		return []string{}, err
+	}
+
+	if err := ensureBridge(sn); err != nil {
+		return []string{}, err
+	}
+
+	ip, err := mos.allocateAddress(t, sn)
+	if err != nil {
+		return []string{}, err
+	}
+
+	if err := setupPortForwards(t, ip); err != nil {
+		return []string{}, err
+	}
+
+	log.Infof("%s has address %s on %s", t.ServiceName, ip, sn.bridge)
+	return []string{
+		"lxc.net.0.type = veth",
+		"lxc.net.0.link = " + sn.bridge,
+		"lxc.net.0.flags = up",
+		"lxc.net.0.name = eth0",
+		fmt.Sprintf("lxc.net.0.ipv4.address = %s/%d", ip, sn.prefixLen()),
+		"lxc.net.0.ipv4.gateway = " + sn.gateway.String(),
+	}, nil
+}
+
+// TearDownNetwork removes the host side network setup for @t, other than
+// its address lease.
+func (mos *Mos) TearDownNetwork(t *Target) error {
+	if t.Network.Type != SimpleNetwork {
+		return nil
+	}
+	return tearDownPortForwards(t)
 }
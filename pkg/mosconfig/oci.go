@@ -68,15 +68,37 @@ func MountOCILayer(ocidir, name, dest string) (func(), error) {
 	return cleanup, nil
 }
 
+// RepoOpts are the settings needed to use a 'docker:' repo base.  They
+// are unused for other repo bases.
+type RepoOpts struct {
+	// Directory to which remote images are synced, in zot layout
+	CacheDir string
+
+	// Whether to skip TLS verification (or use plain http)
+	SkipTLS bool
+
+	// Optional directory with the registry's CA certificates
+	CertDir string
+
+	// Optional yaml file with 'username' and 'password' for the
+	// registry.
+	AuthFile string
+}
+
+func (o RepoOpts) registry(repobase string) RegistryOpts {
+	return RegistryOpts{Base: repobase, SkipTLS: o.SkipTLS, CertDir: o.CertDir, AuthFile: o.AuthFile}
+}
+
 // MountRepoLayer mounts an image path @name at directory @dest.
 // @repobase is the repository base to prepend to @name to find the
 // layer.  If it starts with 'oci:', then it is a simple oci layout
 // base.  If it starts with 'zot:', then it is the top level zot
 // directory (under which the oci images will be in oci layouts at
 // subdirectories mirroring the image name, for instance ubuntu/amd64.
-// For 'docker:', it will be a directory to which we will sync the
-// remote images in zot layout.
-func MountRepoLayer(repobase, name, dest string) (string, func(), error) {
+// For 'docker:', @opts.CacheDir will be a directory to which we will
+// sync the remote images in zot layout.
+// Returns the directory from which the layer was mounted.
+func MountRepoLayer(repobase, name, dest string, opts RepoOpts) (string, func(), error) {
 	s := strings.SplitN(repobase, ":", 2)
 	if len(s) != 2 {
 		return "", func() {}, fmt.Errorf("Repo-base type not specified")
@@ -86,7 +108,15 @@ func MountRepoLayer(repobase, name, dest string) (string, func(), error) {
 
 	switch repotype {
 	case "docker":
-		return "", func() {}, fmt.Errorf("Docker repo bases not yet handed")
+		cachedir := opts.CacheDir
+		if cachedir == "" {
+			return "", func() {}, fmt.Errorf("A cache directory is required for docker repo bases")
+		}
+		if err := syncRemoteImage(opts.registry(repobase), name, cachedir); err != nil {
+			return "", func() {}, err
+		}
+		cleanup, err := MountOCILayer(cachedir, name, dest)
+		return cachedir, cleanup, err
 	case "oci":
 		cachedir := rest
 		cleanup, err := MountOCILayer(rest, name, dest)
@@ -96,14 +126,33 @@ func MountRepoLayer(repobase, name, dest string) (string, func(), error) {
 	}
 }
 
-func MountSOCI(repobase, metalayer, capath, mountpoint string) error {
+// syncRemoteImage copies image @name from registry @reg into the zot
+// layout at @cachedir.
+func syncRemoteImage(reg RegistryOpts, name, cachedir string) error {
+	path, tag := splitRegistryName(name)
+	tpath := filepath.Join(cachedir, path)
+	if err := EnsureDir(tpath); err != nil {
+		return fmt.Errorf("Failed creating cache directory %q: %w", tpath, err)
+	}
+	src := fmt.Sprintf("%s/%s:%s", strings.TrimSuffix(reg.Base, "/"), path, tag)
+	dest := fmt.Sprintf("oci:%s:%s", tpath, tag)
+	return reg.pullImage(src, dest)
+}
+
+func MountSOCI(repobase, metalayer, capath, mountpoint string, repoOpts RepoOpts) error {
 	tmpd, err := os.MkdirTemp("", "extract")
 	if err != nil {
 		return errors.Wrapf(err, "Failed creating tempdir")
 	}
 
+	// The meta layer must be in zot layout in the cache
+	if isRegistryURL(repobase) {
+		path, tag := splitRegistryName(metalayer)
+		metalayer = path + ":" + tag
+	}
+
 	fmt.Printf("XXX - mounting meta layer %q %q at %q\n", repobase, metalayer, tmpd)
-	storagecache, cleanup, err := MountRepoLayer(repobase, metalayer, tmpd)
+	storagecache, cleanup, err := MountRepoLayer(repobase, metalayer, tmpd, repoOpts)
 	if err != nil {
 		return errors.Wrapf(err, "Failed unpacking SOCI metalayer layer")
 	}
@@ -118,17 +167,26 @@ func MountSOCI(repobase, metalayer, capath, mountpoint string) error {
 		return errors.Errorf("bad SOCI layer")
 	}
 
-	// Set up a temporary storage
+	// Set up a temporary storage.  SOCI layers are always atomfs.
 	opts := DefaultMosOptions()
+	opts.StorageType = AtomfsStorageType
 	opts.CaPath = capath
 
 	opts.StorageCache = storagecache
 
+	// For a remote repo base, the referenced image is pulled by its
+	// signed manifest hash into the cache as it is verified.
+	srcDir := ""
+	if isRegistryURL(repobase) {
+		srcDir = repobase
+		opts.Registry = repoOpts.registry(repobase)
+	}
+
 	s, err := NewStorage(opts)
 	if err != nil {
 		return err
 	}
-	manifest, err := ReadVerifyManifest(mPath, cPath, capath, "", s)
+	manifest, err := ReadVerifyManifest(mPath, cPath, capath, srcDir, s, SignerCheck{Policy: DefaultSignerPolicy(capath)})
 	if err != nil {
 		fmt.Printf("Failed verifying %q using %q and %q\n", mPath, cPath, capath)
 		return errors.Wrapf(err, "Verification of manifest on metalayer failed")
@@ -143,7 +201,7 @@ func MountSOCI(repobase, metalayer, capath, mountpoint string) error {
 	if t.Version != "" {
 		name = name + ":" + t.Version
 	}
-	_, _, err = MountRepoLayer(repobase, name, mountpoint)
+	_, err = MountOCILayer(storagecache, name, mountpoint)
 	if err != nil {
 		return errors.Wrapf(err, "Failed mounting %s (%s %s)", t.ServiceName, repobase, name)
 	}
@@ -179,12 +237,34 @@ type SOCI struct {
 	// The key for signing the manifest.  This is only required
 	// when creating, of course
 	Key string
+
+	// Whether to skip TLS verification (or use plain http) for
+	// docker:// Layer and Meta urls
+	SkipTLS bool
+
+	// Optional directory with the CA certificates for docker://
+	// Layer and Meta urls
+	CertDir string
 }
 
 // Open an OCI image manifest.  Return the ispec.Manifest descriptor as
-// well as the shasum.
-func openManifest(url string) (ispec.Manifest, string, error) {
+// well as the shasum.  A docker:// image is first copied into a
+// temporary oci layout.
+func openManifest(url string, reg RegistryOpts) (ispec.Manifest, string, error) {
 	emptyM := ispec.Manifest{}
+	if isRegistryURL(url) {
+		tmpd, err := os.MkdirTemp("", "soci-manifest")
+		if err != nil {
+			return emptyM, "", err
+		}
+		defer os.RemoveAll(tmpd)
+		ociDir := filepath.Join(tmpd, "oci")
+		if err := reg.pullImage(url, "oci:"+ociDir+":image"); err != nil {
+			return emptyM, "", err
+		}
+		return openManifest("oci:"+ociDir+":image", reg)
+	}
+
 	src, err := imagesource.NewImageSource(url)
 	if err != nil {
 		return emptyM, "", err
@@ -250,24 +330,30 @@ func (soci *SOCI) Generate() error {
 	switch {
 	case strings.HasPrefix(soci.Layer, "oci:"):
 		break
-	case strings.HasPrefix(soci.Layer, "docker:"):
-		return fmt.Errorf("FIXME: remote images are not yet supported")
+	case isRegistryURL(soci.Layer):
+		break
 	default:
 		return fmt.Errorf("Unknown image url: %q", soci.Layer)
 	}
 
-	_, shasum, err := openManifest(soci.Layer)
+	reg := RegistryOpts{SkipTLS: soci.SkipTLS, CertDir: soci.CertDir}
+	_, shasum, err := openManifest(soci.Layer, reg)
 	if err != nil {
 		return fmt.Errorf("Failed opening oci layer %q: %w", soci.Layer, err)
 	}
 
+	product, err := ProductFromCert(soci.Cert)
+	if err != nil {
+		return err
+	}
+
 	t := Target{
 		ServiceName:  soci.ServiceName,
 		ImagePath:    soci.ImagePath,
 		Version:      soci.Version,
 		ServiceType:  HostfsService,
 		NSGroup:      "",
-		Network:      TargetNetwork{HostNetwork},
+		Network:      TargetNetwork{Type: HostNetwork},
 		ManifestHash: shasum,
 	}
 	fmt.Printf("XXX shasum is %s\n", shasum)
@@ -277,7 +363,7 @@ func (soci *SOCI) Generate() error {
 		Version:     1,
 		ImageType:   ISO,
 		UpdateType:  FullUpdate,
-		Product:     "de6c82c5-2e01-4c92-949b-a6545d30fc06", // FIXME get this from cert?
+		Product:     product,
 		Targets:     target,
 		StorageType: AtomfsStorageType,
 	}
@@ -303,7 +389,7 @@ func (soci *SOCI) Generate() error {
 		return fmt.Errorf("Error signing manifest: %w", err)
 	}
 
-	if err := createLayer(soci.Meta, tmpdir); err != nil {
+	if err := createLayer(soci.Meta, tmpdir, reg); err != nil {
 		return fmt.Errorf("Error creating final meta oci layer: %w", err)
 	}
 	return nil
@@ -401,11 +487,23 @@ func doInsert(oci casext.Engine, toInsert string, insertAt string, tag string) e
 	return nil
 }
 
-// Create an OCI layer from a directory's contents
-// TODO - if the Meta layer is not a local oci layout, then should write to
-// a tempdir and then copy over to final destination.  For now, we just
-// require it be oci.
-func createLayer(destUrl string, sourceDir string) error {
+// Create an OCI layer from a directory's contents.  If @destUrl is a
+// docker:// url, then the layer is built in a temporary oci layout and
+// then pushed.
+func createLayer(destUrl string, sourceDir string, reg RegistryOpts) error {
+	if isRegistryURL(destUrl) {
+		tmpd, err := os.MkdirTemp("", "soci-layer")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpd)
+		tmpUrl := "oci:" + filepath.Join(tmpd, "oci") + ":meta"
+		if err := createLayer(tmpUrl, sourceDir, reg); err != nil {
+			return err
+		}
+		return reg.pushImage(tmpUrl, destUrl)
+	}
+
 	ocidir, ociname, err := splitOCIURL(destUrl)
 	if err != nil {
 		return fmt.Errorf("Failure parsing url: %w", err)
@@ -0,0 +1,324 @@
+package mosconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// Branches in manifest.git.  master is the last known good system
+// manifest.  Updates are committed on 'staging', and only moved to
+// master (or to 'pending') once they have been verified.  'pending'
+// holds an update which must first successfully boot before it becomes
+// master.
+const (
+	stagingBranch = plumbing.ReferenceName("refs/heads/staging")
+	pendingBranch = plumbing.ReferenceName("refs/heads/pending")
+)
+
+// The default number of times we will try to boot a pending update
+// before falling back to master.
+const DefaultBootTries = 3
+
+func openManifestRepo(mPath string) (*git.Repository, *git.Worktree, error) {
+	repo, err := git.PlainOpen(mPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed opening manifest git repo at %q: %w", mPath, err)
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed opening manifest repo: %w", err)
+	}
+
+	return repo, w, nil
+}
+
+func refExists(repo *git.Repository, name plumbing.ReferenceName) (bool, error) {
+	_, err := repo.Reference(name, true)
+	if err == nil {
+		return true, nil
+	}
+	if err == plumbing.ErrReferenceNotFound {
+		return false, nil
+	}
+	return false, err
+}
+
+// startStaging checks out a new staging branch at @hash.  Any staging
+// branch left over from an interrupted update is discarded.
+func startStaging(repo *git.Repository, w *git.Worktree, hash plumbing.Hash) error {
+	if err := repo.Storer.RemoveReference(stagingBranch); err != nil {
+		return fmt.Errorf("Failed removing stale staging branch: %w", err)
+	}
+	cOpts := git.CheckoutOptions{
+		Branch: stagingBranch,
+		Hash:   hash,
+		Create: true,
+		Force:  true,
+	}
+	if err := w.Checkout(&cOpts); err != nil {
+		return fmt.Errorf("Failed creating staging branch: %w", err)
+	}
+	return nil
+}
+
+// abortStaging restores the master worktree and drops the staging branch.
+func abortStaging(repo *git.Repository, w *git.Worktree) {
+	cOpts := git.CheckoutOptions{
+		Branch: plumbing.Master,
+		Force:  true,
+	}
+	if err := w.Checkout(&cOpts); err != nil {
+		log.Warnf("Failed restoring the manifest worktree: %v", err)
+	}
+	if err := repo.Storer.RemoveReference(stagingBranch); err != nil {
+		log.Warnf("Failed removing the staging branch: %v", err)
+	}
+}
+
+// promote verifies the system manifest at the staging branch, which
+// must point to @hash, and then points @dest to @hash.
+func (mos *Mos) promote(repo *git.Repository, w *git.Worktree, hash plumbing.Hash, dest plumbing.ReferenceName) error {
+	if _, err := mos.manifestAt(stagingBranch); err != nil {
+		abortStaging(repo, w)
+		return fmt.Errorf("Failed verifying the new system manifest: %w", err)
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(dest, hash)); err != nil {
+		abortStaging(repo, w)
+		return fmt.Errorf("Failed updating %s: %w", dest.Short(), err)
+	}
+
+	abortStaging(repo, w)
+	if dest == plumbing.Master {
+		mos.Manifest = nil
+	}
+	return nil
+}
+
+// The number of boot attempts left for the pending update is kept in
+// $config/boot-tries.
+func (mos *Mos) bootTriesPath() string {
+	return filepath.Join(mos.opts.ConfigDir, "boot-tries")
+}
+
+func (mos *Mos) readBootTries() (int, error) {
+	content, err := os.ReadFile(mos.bootTriesPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("Failed reading boot tries: %w", err)
+	}
+	tries, err := strconv.Atoi(strings.TrimSpace(string(content)))
+	if err != nil {
+		return 0, fmt.Errorf("Bad boot tries count %q: %w", string(content), err)
+	}
+	return tries, nil
+}
+
+func (mos *Mos) writeBootTries(tries int) error {
+	if err := os.WriteFile(mos.bootTriesPath(), []byte(fmt.Sprintf("%d\n", tries)), 0644); err != nil {
+		return fmt.Errorf("Failed writing boot tries: %w", err)
+	}
+	return nil
+}
+
+// HasPending returns true if an update is waiting to be booted.
+func (mos *Mos) HasPending() (bool, error) {
+	mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+	repo, _, err := openManifestRepo(mPath)
+	if err != nil {
+		return false, err
+	}
+	return refExists(repo, pendingBranch)
+}
+
+// dropPending discards the pending update.
+func (mos *Mos) dropPending(repo *git.Repository) error {
+	if err := repo.Storer.RemoveReference(pendingBranch); err != nil {
+		return fmt.Errorf("Failed removing pending update: %w", err)
+	}
+	if err := os.Remove(mos.bootTriesPath()); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed removing boot tries: %w", err)
+	}
+	return nil
+}
+
+// BootTarget returns the target named @name from the system manifest
+// which should be booted.  This is the pending update, if there is one
+// with boot attempts left, and each call uses up one attempt.  Once
+// they are exhausted, the pending update is dropped and we fall back
+// to the last good manifest.
+func (mos *Mos) BootTarget(name string) (*Target, error) {
+	mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+	repo, _, err := openManifestRepo(mPath)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := refExists(repo, pendingBranch)
+	if err != nil {
+		return nil, err
+	}
+	if !pending {
+		return mos.Current(name)
+	}
+
+	tries, err := mos.readBootTries()
+	if err != nil {
+		return nil, err
+	}
+	if tries <= 0 {
+		log.Warnf("Pending update failed to boot, falling back to the last good manifest")
+		if err := mos.dropPending(repo); err != nil {
+			return nil, err
+		}
+		return mos.Current(name)
+	}
+
+	if err := mos.writeBootTries(tries - 1); err != nil {
+		return nil, err
+	}
+
+	manifest, err := mos.manifestAt(pendingBranch)
+	if err != nil {
+		log.Warnf("Pending update is not usable, falling back to the last good manifest: %v", err)
+		if err := mos.dropPending(repo); err != nil {
+			return nil, err
+		}
+		return mos.Current(name)
+	}
+
+	log.Infof("Booting pending update, %d tries left", tries-1)
+	for _, t := range manifest.SysTargets {
+		if t.Name == name {
+			return t.raw, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Target %s not found in pending update", name)
+}
+
+// ConfirmBoot makes the pending update, which has booted successfully,
+// the current system manifest.
+func (mos *Mos) ConfirmBoot() error {
+	mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+	repo, w, err := openManifestRepo(mPath)
+	if err != nil {
+		return err
+	}
+
+	ref, err := repo.Reference(pendingBranch, true)
+	if err != nil {
+		if err == plumbing.ErrReferenceNotFound {
+			return fmt.Errorf("No update is pending")
+		}
+		return err
+	}
+
+	old, err := mos.CurrentManifest()
+	if err != nil {
+		return err
+	}
+
+	if err := startStaging(repo, w, ref.Hash()); err != nil {
+		return err
+	}
+	if err := mos.promote(repo, w, ref.Hash(), plumbing.Master); err != nil {
+		return err
+	}
+
+	if err := mos.dropPending(repo); err != nil {
+		return err
+	}
+
+	updated, err := mos.CurrentManifest()
+	if err != nil {
+		return err
+	}
+	return mos.dropIdmaps(old, updated)
+}
+
+// Rollback discards the pending update if there is one.  Otherwise it
+// resets the system manifest to the one before the last update.  The
+// subid allocations of the nsgroups are reconciled with the result.
+func (mos *Mos) Rollback() error {
+	mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+	repo, _, err := openManifestRepo(mPath)
+	if err != nil {
+		return err
+	}
+
+	pending, err := refExists(repo, pendingBranch)
+	if err != nil {
+		return err
+	}
+	if pending {
+		log.Infof("Discarding pending update")
+		discarded, err := mos.manifestAt(pendingBranch)
+		if err != nil {
+			return err
+		}
+		if err := mos.dropPending(repo); err != nil {
+			return err
+		}
+		current, err := mos.CurrentManifest()
+		if err != nil {
+			return err
+		}
+		return mos.dropIdmaps(discarded, current)
+	}
+
+	return mos.rollbackMaster()
+}
+
+// rollbackMaster resets the system manifest to the one before the last
+// update, leaving any pending update alone.
+func (mos *Mos) rollbackMaster() error {
+	mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+	repo, w, err := openManifestRepo(mPath)
+	if err != nil {
+		return err
+	}
+
+	old, err := mos.CurrentManifest()
+	if err != nil {
+		return err
+	}
+
+	head, err := repo.Reference(plumbing.Master, true)
+	if err != nil {
+		return fmt.Errorf("Failed finding the current manifest: %w", err)
+	}
+	commit, err := repo.CommitObject(head.Hash())
+	if err != nil {
+		return fmt.Errorf("Failed reading the current manifest commit: %w", err)
+	}
+	if commit.NumParents() == 0 {
+		return fmt.Errorf("No previous system manifest to roll back to")
+	}
+	prev := commit.ParentHashes[0]
+
+	if err := startStaging(repo, w, prev); err != nil {
+		return err
+	}
+	if err := mos.promote(repo, w, prev, plumbing.Master); err != nil {
+		return err
+	}
+
+	log.Infof("Rolled back system manifest to %s", prev)
+
+	updated, err := mos.CurrentManifest()
+	if err != nil {
+		return err
+	}
+	return mos.dropIdmaps(old, updated)
+}
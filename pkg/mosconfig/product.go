@@ -0,0 +1,143 @@
+package mosconfig
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v2"
+)
+
+// Manifest signing certificates name the product whose manifests they
+// may sign in their CommonName, as "manifest PRODUCT:<uuid>".
+const productPrefix = "PRODUCT:"
+
+func productFromCert(cert *x509.Certificate) (string, error) {
+	cn := cert.Subject.CommonName
+	i := strings.Index(cn, productPrefix)
+	if i == -1 {
+		return "", fmt.Errorf("Certificate %q does not name a product", cn)
+	}
+	fields := strings.Fields(cn[i+len(productPrefix):])
+	if len(fields) == 0 {
+		return "", fmt.Errorf("Certificate %q does not name a product", cn)
+	}
+	if _, err := uuid.Parse(fields[0]); err != nil {
+		return "", fmt.Errorf("Certificate %q has a bad product: %w", cn, err)
+	}
+	return fields[0], nil
+}
+
+// ProductFromCert returns the product for which the manifest signing
+// certificate at @certPath may sign manifests.
+func ProductFromCert(certPath string) (string, error) {
+	certs, err := readCerts(certPath)
+	if err != nil {
+		return "", fmt.Errorf("Failed reading manifest cert (%q): %w", certPath, err)
+	}
+	return productFromCert(certs[0])
+}
+
+// The product which is installed is recorded in $config/product.
+func productPath(configDir string) string {
+	return filepath.Join(configDir, "product")
+}
+
+// Return the installed product, or "" for systems installed before it
+// was recorded.
+func readProduct(configDir string) (string, error) {
+	content, err := os.ReadFile(productPath(configDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("Failed reading installed product: %w", err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+func writeProduct(configDir, product string) error {
+	if err := os.WriteFile(productPath(configDir), []byte(product+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed writing installed product: %w", err)
+	}
+	return nil
+}
+
+// manifestProduct returns the product named by the install manifests
+// in the current system manifest, or "" if they name none.
+func (mos *Mos) manifestProduct() (string, error) {
+	manifest, err := mos.CurrentManifest()
+	if err != nil {
+		return "", err
+	}
+	r, err := mos.openManifestHistory()
+	if err != nil {
+		return "", err
+	}
+	head, err := r.Reference(plumbing.Master, true)
+	if err != nil {
+		return "", fmt.Errorf("Failed finding %s in the manifest git tree: %w", plumbing.Master, err)
+	}
+	commit, err := r.CommitObject(head.Hash())
+	if err != nil {
+		return "", fmt.Errorf("Failed reading manifest commit %s: %w", head.Hash(), err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return "", fmt.Errorf("Failed reading manifest tree at %s: %w", head.Hash(), err)
+	}
+
+	product := ""
+	seen := map[string]bool{}
+	for _, t := range manifest.SysTargets {
+		if seen[t.Source] {
+			continue
+		}
+		seen[t.Source] = true
+		contents, err := treeFileContents(tree, t.Source)
+		if err != nil {
+			return "", fmt.Errorf("Error opening install manifest %q: %w", t.Source, err)
+		}
+		var cf InstallFile
+		if err := yaml.Unmarshal([]byte(contents), &cf); err != nil {
+			return "", fmt.Errorf("Failed parsing install manifest %q: %w", t.Source, err)
+		}
+		if cf.Product == "" {
+			continue
+		}
+		if product != "" && product != cf.Product {
+			return "", fmt.Errorf("Installed manifests are for products %s and %s", product, cf.Product)
+		}
+		product = cf.Product
+	}
+	return product, nil
+}
+
+// checkProduct returns an error if @product is not the one installed.
+// Systems installed before the product was recorded fall back to the
+// product of their install manifests, which is then recorded.
+func (mos *Mos) checkProduct(product string) error {
+	installed, err := readProduct(mos.opts.ConfigDir)
+	if err != nil {
+		return err
+	}
+	if installed == "" {
+		installed, err = mos.manifestProduct()
+		if err != nil {
+			return err
+		}
+		if installed != "" {
+			if err := writeProduct(mos.opts.ConfigDir, installed); err != nil {
+				return err
+			}
+		}
+	}
+	if installed != "" && installed != product {
+		return fmt.Errorf("Manifest is for product %s, but this system is product %s", product, installed)
+	}
+	return nil
+}
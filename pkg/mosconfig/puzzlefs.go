@@ -0,0 +1,508 @@
+package mosconfig
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"github.com/lxc/lxd/shared/idmap"
+	ispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/opencontainers/umoci"
+	"github.com/opencontainers/umoci/oci/casext"
+	"golang.org/x/sys/unix"
+	"stackerbuild.io/stacker/pkg/mount"
+)
+
+// PuzzlefsStorage keeps all images in a single OCI layout, so that
+// puzzlefs chunks which are shared between images (or versions of an
+// image) are only stored once.  Image imagepath:version is tagged
+// as "imagepath:version" in that layout.
+type PuzzlefsStorage struct {
+	RootDir     string
+	storePath   string
+	scratchPath string
+}
+
+func NewPuzzlefsStorage(rootDir, storeDir, scratchPath string) (*PuzzlefsStorage, error) {
+	return &PuzzlefsStorage{
+		RootDir:     rootDir,
+		storePath:   filepath.Join(storeDir, "puzzlefs"),
+		scratchPath: scratchPath,
+	}, nil
+}
+
+func (p *PuzzlefsStorage) Type() StorageType {
+	return PuzzlefsStorageType
+}
+
+func puzzlefsTag(t *Target) string {
+	return t.ImagePath + ":" + t.Version
+}
+
+// We remember the manifest hash which is mounted at each mountpoint
+// under $scratch-writes/puzzlefs/mounts/, since the fuse mount itself
+// does not tell us.
+func (p *PuzzlefsStorage) mountRecord(mountpoint string) string {
+	sum := sha256.Sum256([]byte(filepath.Clean(mountpoint)))
+	return filepath.Join(p.scratchPath, "puzzlefs", "mounts", fmt.Sprintf("%x", sum))
+}
+
+func (p *PuzzlefsStorage) recordMount(t *Target, mountpoint string) error {
+	r := p.mountRecord(mountpoint)
+	if err := EnsureDir(filepath.Dir(r)); err != nil {
+		return err
+	}
+	return os.WriteFile(r, []byte(t.ManifestHash), 0644)
+}
+
+func (p *PuzzlefsStorage) Mount(t *Target, mountpoint string) (func(), error) {
+	if err := EnsureDir(mountpoint); err != nil {
+		return func() {}, fmt.Errorf("Failed creating mountpoint %q: %w", mountpoint, err)
+	}
+
+	// puzzlefs mount daemonizes once the image has been opened, wait
+	// for the fuse mount to show up.
+	tag := puzzlefsTag(t)
+	if err := RunCommand("puzzlefs", "mount", p.storePath, tag, mountpoint); err != nil {
+		return func() {}, fmt.Errorf("Failed mounting puzzlefs image %q: %w", tag, err)
+	}
+
+	cleanup := func() {
+		if err := unix.Unmount(mountpoint, 0); err != nil {
+			log.Warnf("unmounting %s failed: %s", mountpoint, err)
+		}
+		os.Remove(p.mountRecord(mountpoint))
+	}
+
+	const maxTries int = 10
+	count := 0
+	for ; count < maxTries; count++ {
+		mounted, err := IsMountpoint(mountpoint)
+		if err != nil {
+			return cleanup, err
+		}
+		if mounted {
+			break
+		}
+		time.Sleep(1 * time.Second)
+	}
+	if count == maxTries {
+		return cleanup, fmt.Errorf("Timed out waiting for puzzlefs mount at %q", mountpoint)
+	}
+
+	if err := p.recordMount(t, mountpoint); err != nil {
+		return cleanup, fmt.Errorf("Failed recording mount of %s: %w", tag, err)
+	}
+
+	return cleanup, nil
+}
+
+func (p *PuzzlefsStorage) MountWriteable(t *Target, mountpoint string) (func(), error) {
+	cleanup, err := mountWriteableOverlay(p, p.scratchPath, t, mountpoint)
+	if err != nil {
+		return cleanup, err
+	}
+	if err := p.recordMount(t, mountpoint); err != nil {
+		return cleanup, fmt.Errorf("Failed recording mount of %s: %w", puzzlefsTag(t), err)
+	}
+	return cleanup, nil
+}
+
+// mountContainerRoot mounts @t at @mountpoint as a container's root
+// filesystem, see mountContainerRoot().
+func (p *PuzzlefsStorage) mountContainerRoot(t *Target, mountpoint string, idmapset *idmap.IdmapSet) (bool, error) {
+	_, idmapped, err := mountContainerRoot(p, p.scratchPath, t, mountpoint, idmapset)
+	if err != nil {
+		return false, err
+	}
+	if err := p.recordMount(t, mountpoint); err != nil {
+		return false, fmt.Errorf("Failed recording mount of %s: %w", puzzlefsTag(t), err)
+	}
+	return idmapped, nil
+}
+
+func (p *PuzzlefsStorage) mountedHashAt(mountpoint string) (string, error) {
+	mounted, err := IsMountpoint(mountpoint)
+	if err != nil {
+		return "", err
+	}
+	if !mounted {
+		return "", nil
+	}
+	content, err := os.ReadFile(p.mountRecord(mountpoint))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// MountedByHash returns the manifest hash of the image mounted for
+// @target, or "" if it is not mounted.
+func (p *PuzzlefsStorage) MountedByHash(target *Target) (string, error) {
+	hash, err := p.mountHash(target)
+	if err != nil {
+		return "", err
+	}
+	return recordedHash(p.scratchPath, target, hash)
+}
+
+func (p *PuzzlefsStorage) mountHash(target *Target) (string, error) {
+	switch target.ServiceType {
+	case HostfsService:
+		return p.mountedHashAt(p.RootDir)
+	case FsService:
+		return p.mountedHashAt(filepath.Join(p.scratchPath, "roots", target.ServiceName))
+	case ContainerService:
+		out, rc := RunCommandWithRc("lxc-info", "-H", "-n", target.ServiceName, "-s")
+		if rc != 0 || strings.TrimSpace(string(out)) != "RUNNING" {
+			return "", nil
+		}
+		return p.mountedHashAt(filepath.Join(p.scratchPath, "roots", target.ServiceName))
+	default:
+		return "", fmt.Errorf("couldn't determine mountpoint for %s (%s)", target.ServiceName, target.ServiceType)
+	}
+}
+
+func (p *PuzzlefsStorage) SetupTarget(t *Target, idmapset *idmap.IdmapSet) (bool, error) {
+	mp := filepath.Join(p.scratchPath, "roots", t.ServiceName)
+	if err := p.TearDownTarget(t.ServiceName); err != nil {
+		return false, err
+	}
+
+	if err := EnsureDir(mp); err != nil {
+		return false, fmt.Errorf("Failed creating mountpoint %q: %w", mp, err)
+	}
+
+	var err error
+	idmapped := false
+	if t.ServiceType == ContainerService {
+		// As with atomfs, containers get an idmapped mount, or a
+		// writeable overlay over which uids are shifted.
+		idmapped, err = p.mountContainerRoot(t, mp, idmapset)
+	} else {
+		_, err = p.Mount(t, mp)
+	}
+	if err != nil {
+		return false, fmt.Errorf("Failed mounting %s:%s to %q: %w", t.ServiceName, t.Version, mp, err)
+	}
+
+	// The mount record already holds the manifest hash
+	if err := writeTargetState(p.scratchPath, t, t.ManifestHash); err != nil {
+		return false, err
+	}
+
+	return idmapped, nil
+}
+
+func (p *PuzzlefsStorage) TargetMountdir(t *Target) (string, error) {
+	return filepath.Join(p.scratchPath, "roots", t.ServiceName), nil
+}
+
+// TearDownTarget unmounts the target's root, as well as the readonly
+// puzzlefs mount under it if it was a writeable overlay.
+func (p *PuzzlefsStorage) TearDownTarget(name string) error {
+	if err := removeTargetState(p.scratchPath, name); err != nil {
+		return err
+	}
+	mp := filepath.Join(p.scratchPath, "roots", name)
+	mounted, err := IsMountpoint(mp)
+	if err != nil {
+		return fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
+	}
+	if !mounted {
+		return p.unmountIdmapSource(mp)
+	}
+	log.Warnf("tearing down %q", name)
+
+	lowerdirs := []string{}
+	mounts, err := mount.ParseMounts("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		if m.Target == mp && m.FSType == "overlay" {
+			lowerdirs, err = m.GetOverlayDirs()
+			if err != nil {
+				return fmt.Errorf("Failed getting overlay dirs for mount %+v: %w", m, err)
+			}
+		}
+	}
+
+	if err := unix.Unmount(mp, 0); err != nil {
+		return fmt.Errorf("puzzlefs umount of %q failed: %w", mp, err)
+	}
+	os.Remove(p.mountRecord(mp))
+
+	for _, d := range lowerdirs {
+		if err := unix.Unmount(d, 0); err != nil {
+			return fmt.Errorf("puzzlefs umount of %q failed: %w", d, err)
+		}
+		os.Remove(p.mountRecord(d))
+		os.Remove(d)
+	}
+	return p.unmountIdmapSource(mp)
+}
+
+func (p *PuzzlefsStorage) unmountIdmapSource(mp string) error {
+	return unmountIdmapSource(mp, func(src string) error {
+		if err := unix.Unmount(src, 0); err != nil {
+			return err
+		}
+		os.Remove(p.mountRecord(src))
+		return nil
+	})
+}
+
+func (p *PuzzlefsStorage) ImageRef(t *Target) (string, string) {
+	return p.storePath, puzzlefsTag(t)
+}
+
+func (p *PuzzlefsStorage) VerifyTarget(t *Target) error {
+	return verifyManifestHash(p.storePath, puzzlefsTag(t), t)
+}
+
+// Import a target's storage.  src is the install media base directory,
+// under which we expect either oci or zot.  The blobs which the puzzlefs
+// image uses are copied into our one store, skipping any chunks which we
+// already have.
+func (p *PuzzlefsStorage) ImportTarget(src string, target *Target) error {
+	if src == "" || isRegistryURL(src) {
+		return fmt.Errorf("remote image copy is not supported for puzzlefs storage")
+	}
+	zotDir := filepath.Join(src, "zot")
+	ociDir := filepath.Join(src, "oci")
+	var srcDir, srcTag string
+	switch {
+	case PathExists(ociDir):
+		srcDir, srcTag = ociDir, target.ServiceName
+	case PathExists(zotDir):
+		srcDir, srcTag = filepath.Join(zotDir, target.ImagePath), target.Version
+	default:
+		return fmt.Errorf("Error extracting target %#v: no oci or zot storage found under %s", target, src)
+	}
+
+	_, blobs, err := copyOCIImage(srcDir, srcTag, p.storePath, puzzlefsTag(target), target.ManifestHash)
+	if err != nil {
+		return fmt.Errorf("Error extracting target %#v: %w", target, err)
+	}
+
+	if err := p.writeBlobRecord(puzzlefsTag(target), blobs); err != nil {
+		return fmt.Errorf("Failed recording the blobs of %s: %w", puzzlefsTag(target), err)
+	}
+
+	return nil
+}
+
+// Since puzzlefs chunks are not listed in the image manifest, we record
+// which blobs each image uses when it is imported in
+// $store/puzzlefs-blobs/sha256(TAG), so that GC can tell which blobs
+// are still used.
+func (p *PuzzlefsStorage) blobRecord(tag string) string {
+	sum := sha256.Sum256([]byte(tag))
+	return filepath.Join(p.storePath+"-blobs", fmt.Sprintf("%x", sum))
+}
+
+func (p *PuzzlefsStorage) writeBlobRecord(tag string, blobs []string) error {
+	r := p.blobRecord(tag)
+	if err := EnsureDir(filepath.Dir(r)); err != nil {
+		return err
+	}
+	return os.WriteFile(r, []byte(strings.Join(blobs, "\n")+"\n"), 0644)
+}
+
+// readBlobRecord returns the blobs recorded for @tag, or nil if there
+// is no record.
+func (p *PuzzlefsStorage) readBlobRecord(tag string) ([]string, error) {
+	content, err := os.ReadFile(p.blobRecord(tag))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return strings.Fields(string(content)), nil
+}
+
+// layoutBlobs returns the names of all blobs in the OCI layout at @dir.
+func layoutBlobs(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, "blobs", "sha256"))
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading blobs under %q: %w", dir, err)
+	}
+	blobs := []string{}
+	for _, e := range entries {
+		blobs = append(blobs, e.Name())
+	}
+	return blobs, nil
+}
+
+// referencedBlobs returns the blobs among @candidates whose sha256
+// digest, raw or hex encoded, appears in the blob at @path.  @candidates
+// maps both encodings of each digest to its blob name.
+func referencedBlobs(path string, candidates map[string]string) ([]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading blob %q: %w", path, err)
+	}
+	found := map[string]bool{}
+	for _, n := range []int{sha256.Size, 2 * sha256.Size} {
+		for i := 0; i+n <= len(content); i++ {
+			if name, ok := candidates[string(content[i:i+n])]; ok {
+				found[name] = true
+			}
+		}
+	}
+	blobs := []string{}
+	for name := range found {
+		blobs = append(blobs, name)
+	}
+	return blobs, nil
+}
+
+// imageBlobs returns the blobs in the OCI layout at @dir which the image
+// with manifest @desc uses: its manifest, config and layers, and the
+// puzzlefs metadata and chunks which its rootfs refers to.  Those are
+// not listed in the manifest, but puzzlefs refers to them by digest, so
+// we look for the digests of the layout's blobs in the rootfs, and then
+// in the blobs it refers to.
+func imageBlobs(dir string, desc ispec.Descriptor) ([]string, error) {
+	blobDir := filepath.Join(dir, "blobs", "sha256")
+	content, err := os.ReadFile(filepath.Join(blobDir, desc.Digest.Encoded()))
+	if err != nil {
+		return nil, fmt.Errorf("Failed reading image manifest %s: %w", desc.Digest, err)
+	}
+	var manifest ispec.Manifest
+	if err := json.Unmarshal(content, &manifest); err != nil {
+		return nil, fmt.Errorf("Failed parsing image manifest %s: %w", desc.Digest, err)
+	}
+
+	all, err := layoutBlobs(dir)
+	if err != nil {
+		return nil, err
+	}
+	candidates := map[string]string{}
+	for _, b := range all {
+		raw, err := hex.DecodeString(b)
+		if err != nil || len(raw) != sha256.Size {
+			continue
+		}
+		candidates[string(raw)] = b
+		candidates[b] = b
+	}
+
+	seen := map[string]bool{
+		desc.Digest.Encoded():            true,
+		manifest.Config.Digest.Encoded(): true,
+	}
+	rootfs := []string{}
+	for _, l := range manifest.Layers {
+		seen[l.Digest.Encoded()] = true
+		rootfs = append(rootfs, l.Digest.Encoded())
+	}
+
+	// The rootfs refers to the metadata, which refers to the chunks
+	next := rootfs
+	for depth := 0; depth < 2; depth++ {
+		found := []string{}
+		for _, b := range next {
+			refs, err := referencedBlobs(filepath.Join(blobDir, b), candidates)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range refs {
+				if !seen[r] {
+					seen[r] = true
+					found = append(found, r)
+				}
+			}
+		}
+		next = found
+	}
+
+	blobs := []string{}
+	for b := range seen {
+		blobs = append(blobs, b)
+	}
+	sort.Strings(blobs)
+	return blobs, nil
+}
+
+// copyOCIImage copies image @srcTag from the OCI layout at @srcDir into
+// the layout at @destDir, tagging it @destTag.  Besides the blobs listed
+// in its manifest, the puzzlefs metadata and chunks which it uses are
+// copied.  Blobs which already exist in @destDir are not copied again.
+// If @hash is not empty, then the image's manifest must have that hash.
+// Returns the hash of the image's manifest, and the blobs which the
+// image uses.
+func copyOCIImage(srcDir, srcTag, destDir, destTag, hash string) (string, []string, error) {
+	src, err := umoci.OpenLayout(srcDir)
+	if err != nil {
+		return "", nil, fmt.Errorf("Failed opening OCI layout %q: %w", srcDir, err)
+	}
+	defer src.Close()
+
+	dps, err := src.ResolveReference(context.Background(), srcTag)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(dps) != 1 {
+		return "", nil, fmt.Errorf("bad descriptor %q in %q", srcTag, srcDir)
+	}
+	desc := dps[0].Descriptor()
+	if hash != "" && desc.Digest.Encoded() != hash {
+		return "", nil, fmt.Errorf("Hash is %q, should be %q", desc.Digest.Encoded(), hash)
+	}
+
+	blobs, err := imageBlobs(srcDir, desc)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var dest casext.Engine
+	if PathExists(filepath.Join(destDir, "index.json")) {
+		dest, err = umoci.OpenLayout(destDir)
+	} else {
+		// umoci will only create the layout in a new directory
+		os.Remove(destDir)
+		dest, err = umoci.CreateLayout(destDir)
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("Error opening oci layout at %q: %w", destDir, err)
+	}
+	defer dest.Close()
+
+	srcBlobs := filepath.Join(srcDir, "blobs", "sha256")
+	destBlobs := filepath.Join(destDir, "blobs", "sha256")
+	copied := 0
+	for _, b := range blobs {
+		d := filepath.Join(destBlobs, b)
+		if PathExists(d) {
+			continue
+		}
+		s := filepath.Join(srcBlobs, b)
+		if err := os.Link(s, d); err != nil {
+			if err := CopyFileBits(s, d); err != nil {
+				return "", nil, fmt.Errorf("Failed copying blob %q: %w", b, err)
+			}
+		}
+		copied++
+	}
+	log.Infof("copied %d of %d blobs for %s into %q", copied, len(blobs), destTag, destDir)
+
+	if err := dest.UpdateReference(context.Background(), destTag, desc); err != nil {
+		return "", nil, fmt.Errorf("Failed tagging %q in %q: %w", destTag, destDir, err)
+	}
+
+	return desc.Digest.Encoded(), blobs, nil
+}
@@ -0,0 +1,171 @@
+package mosconfig
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/containers/image/v5/copy"
+	"github.com/containers/image/v5/signature"
+	"github.com/containers/image/v5/transports/alltransports"
+	"github.com/containers/image/v5/types"
+	"gopkg.in/yaml.v2"
+)
+
+// RegistryOpts describes a remote OCI distribution registry from which
+// target images can be imported.
+type RegistryOpts struct {
+	// Base url of the registry, e.g. docker://zothub.local:5000/machine.
+	// A target with imagepath 'puzzleos/hostfs' will be pulled from
+	// docker://zothub.local:5000/machine/puzzleos/hostfs.
+	Base string
+
+	// Whether to skip TLS verification (or use plain http)
+	SkipTLS bool
+
+	// Optional directory with the CA certificates (*.crt) to verify
+	// the registry with, and a client certificate and key (*.cert
+	// and *.key) to present to it.
+	CertDir string
+
+	// Optional yaml file with 'username' and 'password' for the
+	// registry.
+	AuthFile string
+}
+
+type registryAuth struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+func isRegistryURL(src string) bool {
+	return strings.HasPrefix(src, "docker://")
+}
+
+func (r RegistryOpts) readAuth() (registryAuth, error) {
+	auth := registryAuth{}
+	if r.AuthFile == "" {
+		return auth, nil
+	}
+	bytes, err := os.ReadFile(r.AuthFile)
+	if err != nil {
+		return auth, fmt.Errorf("Failed reading registry credentials: %w", err)
+	}
+	if err := yaml.Unmarshal(bytes, &auth); err != nil {
+		return auth, fmt.Errorf("Failed parsing registry credentials %q: %w", r.AuthFile, err)
+	}
+	return auth, nil
+}
+
+// registryImageURL returns the url of @t's image under registry base
+// @base.  The image is always referred to by its signed manifest hash,
+// so that the registry cannot serve us anything else.
+func registryImageURL(base string, t *Target) string {
+	return fmt.Sprintf("%s/%s@sha256:%s", strings.TrimSuffix(base, "/"), t.ImagePath, t.ManifestHash)
+}
+
+// copyFromRegistry copies @t's image from registry @base to the
+// local oci layout url @dest.
+func (r RegistryOpts) copyFromRegistry(base string, t *Target, dest string) error {
+	if t.ManifestHash == "" {
+		return fmt.Errorf("No manifest hash for %s", t.ServiceName)
+	}
+	return r.pullImage(registryImageURL(base, t), dest)
+}
+
+// systemContext returns the containers/image settings for talking to
+// the registry.
+func (r RegistryOpts) systemContext() (*types.SystemContext, error) {
+	auth, err := r.readAuth()
+	if err != nil {
+		return nil, err
+	}
+	if r.CertDir != "" && !PathExists(r.CertDir) {
+		return nil, fmt.Errorf("Registry certificate directory %q does not exist", r.CertDir)
+	}
+
+	sys := &types.SystemContext{
+		DockerCertPath:              r.CertDir,
+		DockerInsecureSkipTLSVerify: types.NewOptionalBool(r.SkipTLS),
+	}
+	if auth.Username != "" {
+		sys.DockerAuthConfig = &types.DockerAuthConfig{
+			Username: auth.Username,
+			Password: auth.Password,
+		}
+	}
+	return sys, nil
+}
+
+// imageCopy copies image url @src to @dest, using the registry settings
+// for either end which is a registry.
+func (r RegistryOpts) imageCopy(src, dest string) error {
+	srcRef, err := alltransports.ParseImageName(src)
+	if err != nil {
+		return fmt.Errorf("Bad image url %q: %w", src, err)
+	}
+	destRef, err := alltransports.ParseImageName(dest)
+	if err != nil {
+		return fmt.Errorf("Bad image url %q: %w", dest, err)
+	}
+
+	// Images are verified by their signed manifest hash, not by
+	// signatures in the registry.
+	policy := &signature.Policy{
+		Default: signature.PolicyRequirements{signature.NewPRInsecureAcceptAnything()},
+	}
+	policyContext, err := signature.NewPolicyContext(policy)
+	if err != nil {
+		return err
+	}
+	defer policyContext.Destroy()
+
+	sys, err := r.systemContext()
+	if err != nil {
+		return err
+	}
+	copyOpts := &copy.Options{
+		ReportWriter: os.Stdout,
+	}
+	if isRegistryURL(src) {
+		copyOpts.SourceCtx = sys
+	}
+	if isRegistryURL(dest) {
+		copyOpts.DestinationCtx = sys
+	}
+
+	_, err = copy.Image(context.Background(), policyContext, destRef, srcRef, copyOpts)
+	return err
+}
+
+// pullImage copies the image at registry url @src to the local oci
+// layout url @dest.
+func (r RegistryOpts) pullImage(src, dest string) error {
+	log.Infof("copying %q from registry into zot as '%s'", src, dest)
+	if err := r.imageCopy(src, dest); err != nil {
+		return fmt.Errorf("failed copying %q: %w", src, err)
+	}
+	return nil
+}
+
+// pushImage copies the image at local oci layout url @src to the
+// registry url @dest.
+func (r RegistryOpts) pushImage(src, dest string) error {
+	log.Infof("copying '%s' to registry as %q", src, dest)
+	if err := r.imageCopy(src, dest); err != nil {
+		return fmt.Errorf("failed copying to %q: %w", dest, err)
+	}
+	return nil
+}
+
+// splitRegistryName splits image name @name, as found under a docker://
+// repo base, into its path and tag.  The tag defaults to "latest".
+func splitRegistryName(name string) (string, string) {
+	idx := strings.LastIndex(name, ":")
+	if idx == -1 || strings.Contains(name[idx:], "/") {
+		return name, "latest"
+	}
+	return name[:idx], name[idx+1:]
+}
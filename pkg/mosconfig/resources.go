@@ -0,0 +1,193 @@
+package mosconfig
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/docker/go-units"
+)
+
+// Resources are the cgroup v2 limits for a container target.  Unset
+// (zero) fields are left at the kernel defaults.
+type Resources struct {
+	// Memory limits in bytes, optionally with a k, m, g or t suffix,
+	// or "max".
+	MemoryMax  string `yaml:"memory_max" json:"memory_max,omitempty"`
+	MemoryHigh string `yaml:"memory_high" json:"memory_high,omitempty"`
+
+	// The relative cpu weight, 1-10000 (100 by default)
+	CPUWeight int64 `yaml:"cpu_weight" json:"cpu_weight,omitempty"`
+
+	// The cpu bandwidth limit, as in cgroup's cpu.max: "QUOTA [PERIOD]"
+	// in microseconds, where QUOTA may be "max".
+	CPUMax string `yaml:"cpu_max" json:"cpu_max,omitempty"`
+
+	PidsMax int64 `yaml:"pids_max" json:"pids_max,omitempty"`
+
+	// The relative io weight, 1-10000 (100 by default)
+	IOWeight int64 `yaml:"io_weight" json:"io_weight,omitempty"`
+}
+
+// ResourceUsage is the current usage of a running container target.
+type ResourceUsage struct {
+	MemoryCurrent int64 `json:"memory_current"`
+	CPUUsageUsec  int64 `json:"cpu_usage_usec"`
+	PidsCurrent   int64 `json:"pids_current"`
+}
+
+// parseMemoryLimit returns the cgroup value for a memory limit.
+func parseMemoryLimit(limit string) (string, error) {
+	if limit == "max" {
+		return limit, nil
+	}
+	n, err := units.RAMInBytes(limit)
+	if err != nil {
+		return "", fmt.Errorf("Bad memory limit %q: %w", limit, err)
+	}
+	if n < 1 {
+		return "", fmt.Errorf("Bad memory limit %q", limit)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+func validateCPUMax(max string) error {
+	fields := strings.Fields(max)
+	if len(fields) == 0 || len(fields) > 2 {
+		return fmt.Errorf("Bad cpu_max %q", max)
+	}
+	if fields[0] != "max" {
+		if n, err := strconv.ParseInt(fields[0], 10, 64); err != nil || n < 1 {
+			return fmt.Errorf("Bad cpu_max quota %q", fields[0])
+		}
+	}
+	if len(fields) == 2 {
+		if n, err := strconv.ParseInt(fields[1], 10, 64); err != nil || n < 1000 || n > 1000000 {
+			return fmt.Errorf("Bad cpu_max period %q", fields[1])
+		}
+	}
+	return nil
+}
+
+func (r *Resources) Validate() error {
+	if r.MemoryMax != "" {
+		if _, err := parseMemoryLimit(r.MemoryMax); err != nil {
+			return err
+		}
+	}
+	if r.MemoryHigh != "" {
+		if _, err := parseMemoryLimit(r.MemoryHigh); err != nil {
+			return err
+		}
+	}
+	if r.CPUWeight != 0 && (r.CPUWeight < 1 || r.CPUWeight > 10000) {
+		return fmt.Errorf("cpu_weight must be between 1 and 10000")
+	}
+	if r.CPUMax != "" {
+		if err := validateCPUMax(r.CPUMax); err != nil {
+			return err
+		}
+	}
+	if r.PidsMax < 0 {
+		return fmt.Errorf("pids_max cannot be negative")
+	}
+	if r.IOWeight != 0 && (r.IOWeight < 1 || r.IOWeight > 10000) {
+		return fmt.Errorf("io_weight must be between 1 and 10000")
+	}
+	return nil
+}
+
+func (t Target) ValidateResources() error {
+	if t.Resources == nil {
+		return nil
+	}
+	if t.ServiceType != ContainerService {
+		return fmt.Errorf("Resource limits are only supported for container targets")
+	}
+	return t.Resources.Validate()
+}
+
+// lxcResourceEntries returns the lxc.cgroup2 lines for @t's resource
+// limits.
+func lxcResourceEntries(t *Target) ([]string, error) {
+	r := t.Resources
+	if r == nil {
+		return []string{}, nil
+	}
+
+	entries := []string{}
+	if r.MemoryMax != "" {
+		v, err := parseMemoryLimit(r.MemoryMax)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, "lxc.cgroup2.memory.max = "+v)
+	}
+	if r.MemoryHigh != "" {
+		v, err := parseMemoryLimit(r.MemoryHigh)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, "lxc.cgroup2.memory.high = "+v)
+	}
+	if r.CPUWeight != 0 {
+		entries = append(entries, fmt.Sprintf("lxc.cgroup2.cpu.weight = %d", r.CPUWeight))
+	}
+	if r.CPUMax != "" {
+		entries = append(entries, "lxc.cgroup2.cpu.max = "+strings.Join(strings.Fields(r.CPUMax), " "))
+	}
+	if r.PidsMax != 0 {
+		entries = append(entries, fmt.Sprintf("lxc.cgroup2.pids.max = %d", r.PidsMax))
+	}
+	if r.IOWeight != 0 {
+		entries = append(entries, fmt.Sprintf("lxc.cgroup2.io.weight = %d", r.IOWeight))
+	}
+	return entries, nil
+}
+
+// readCgroup returns the value of cgroup file @key of running container
+// @name.
+func readCgroup(name, key string) (string, error) {
+	out, rc := RunCommandWithRc("lxc-cgroup", "-n", name, key)
+	if rc != 0 {
+		return "", fmt.Errorf("Failed reading %s of %s: %s", key, name, string(out))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+func readCgroupInt(name, key string) (int64, error) {
+	v, err := readCgroup(name, key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed parsing %s of %s: %w", key, name, err)
+	}
+	return n, nil
+}
+
+// resourceUsage returns the current usage of running container @name.
+func resourceUsage(name string) (*ResourceUsage, error) {
+	var err error
+	u := ResourceUsage{}
+	u.MemoryCurrent, err = readCgroupInt(name, "memory.current")
+	if err != nil {
+		return nil, err
+	}
+	u.PidsCurrent, err = readCgroupInt(name, "pids.current")
+	if err != nil {
+		return nil, err
+	}
+	stat, err := readCgroup(name, "cpu.stat")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(stat, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "usage_usec" {
+			u.CPUUsageUsec, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+	return &u, nil
+}
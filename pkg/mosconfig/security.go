@@ -0,0 +1,221 @@
+package mosconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SecurityPolicy restricts what a container target may do.
+type SecurityPolicy struct {
+	// Capabilities to keep (dropping all others), or to drop, as
+	// lxc names them, e.g. sys_admin.  Only one of these may be set.
+	CapKeep []string `yaml:"cap_keep"`
+	CapDrop []string `yaml:"cap_drop"`
+
+	// The seccomp policy: "" or "default" for the deny list shipped
+	// with mos, "unconfined" for none, or the name of one of the
+	// install manifest's seccomp_policies.
+	Seccomp string `yaml:"seccomp"`
+
+	// The apparmor profile to run the container under.  If unset, lxc
+	// chooses, unless we are ourselves confined (e.g. when testing in a
+	// nested container), in which case the container stays in our
+	// profile.
+	Apparmor string `yaml:"apparmor"`
+
+	NoNewPrivs bool `yaml:"no_new_privs"`
+}
+
+// A SeccompPolicy is an lxc seccomp policy shipped in an install
+// manifest.  Policy is the content of the policy file.
+type SeccompPolicy struct {
+	Name   string `yaml:"name"`
+	Policy string `yaml:"policy"`
+}
+
+const (
+	SeccompDefault    = "default"
+	SeccompUnconfined = "unconfined"
+)
+
+// The seccomp policy for targets which do not choose one.  It refuses
+// syscalls which let a container meddle with the host's kernel.
+const defaultSeccompPolicy = `2
+denylist
+reject_force_umount
+[all]
+kexec_load errno 1
+kexec_file_load errno 1
+open_by_handle_at errno 1
+init_module errno 1
+finit_module errno 1
+delete_module errno 1
+bpf errno 1
+perf_event_open errno 1
+`
+
+var knownCapabilities = map[string]bool{
+	"audit_control": true, "audit_read": true, "audit_write": true,
+	"block_suspend": true, "bpf": true, "checkpoint_restore": true,
+	"chown": true, "dac_override": true, "dac_read_search": true,
+	"fowner": true, "fsetid": true, "ipc_lock": true, "ipc_owner": true,
+	"kill": true, "lease": true, "linux_immutable": true,
+	"mac_admin": true, "mac_override": true, "mknod": true,
+	"net_admin": true, "net_bind_service": true, "net_broadcast": true,
+	"net_raw": true, "perfmon": true, "setfcap": true, "setgid": true,
+	"setpcap": true, "setuid": true, "sys_admin": true, "sys_boot": true,
+	"sys_chroot": true, "sys_module": true, "sys_nice": true,
+	"sys_pacct": true, "sys_ptrace": true, "sys_rawio": true,
+	"sys_resource": true, "sys_time": true, "sys_tty_config": true,
+	"syslog": true, "wake_alarm": true,
+}
+
+func validateCapabilities(caps []string) error {
+	for _, c := range caps {
+		if !knownCapabilities[c] {
+			return fmt.Errorf("Unknown capability %q", c)
+		}
+	}
+	return nil
+}
+
+func (p SeccompPolicy) Validate() error {
+	if p.Name == "" || p.Name == SeccompDefault || p.Name == SeccompUnconfined || strings.ContainsAny(p.Name, "/ \t\n") {
+		return fmt.Errorf("Bad seccomp policy name %q", p.Name)
+	}
+	version := strings.TrimSpace(strings.SplitN(p.Policy, "\n", 2)[0])
+	if version != "1" && version != "2" {
+		return fmt.Errorf("Seccomp policy %q has unsupported version %q", p.Name, version)
+	}
+	return nil
+}
+
+func (t Target) ValidateSecurity() error {
+	s := t.Security
+	if s == nil {
+		return nil
+	}
+	if t.ServiceType != ContainerService {
+		return fmt.Errorf("Security policies are only supported for container targets")
+	}
+	if len(s.CapKeep) != 0 && len(s.CapDrop) != 0 {
+		return fmt.Errorf("Only one of cap_keep and cap_drop may be set")
+	}
+	if err := validateCapabilities(s.CapKeep); err != nil {
+		return err
+	}
+	if err := validateCapabilities(s.CapDrop); err != nil {
+		return err
+	}
+	if strings.ContainsAny(s.Apparmor, " \t\n") {
+		return fmt.Errorf("Bad apparmor profile %q", s.Apparmor)
+	}
+	return nil
+}
+
+// validateSeccompPolicies checks the install manifest's seccomp
+// policies, and that every target's seccomp policy is either built in
+// or one of them.
+func (af *InstallFile) validateSeccompPolicies() error {
+	names := map[string]bool{}
+	for _, p := range af.SeccompPolicies {
+		if err := p.Validate(); err != nil {
+			return err
+		}
+		if names[p.Name] {
+			return fmt.Errorf("Seccomp policy %q is defined twice", p.Name)
+		}
+		names[p.Name] = true
+	}
+	for _, t := range af.Targets {
+		if t.Security == nil {
+			continue
+		}
+		switch t.Security.Seccomp {
+		case "", SeccompDefault, SeccompUnconfined:
+		default:
+			if !names[t.Security.Seccomp] {
+				return fmt.Errorf("Target %s uses undefined seccomp policy %q", t.ServiceName, t.Security.Seccomp)
+			}
+		}
+	}
+	return nil
+}
+
+func findSeccompPolicy(cf InstallFile, name string) (*SeccompPolicy, bool) {
+	for _, p := range cf.SeccompPolicies {
+		if p.Name == name {
+			return &p, true
+		}
+	}
+	return nil, false
+}
+
+// apparmorConfined returns true if we are running under an apparmor
+// profile ourselves, in which case lxc cannot switch the container to
+// a profile of its own.
+func apparmorConfined() bool {
+	for _, f := range []string{"/proc/self/attr/apparmor/current", "/proc/self/attr/current"} {
+		content, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		label := strings.TrimSpace(strings.TrimRight(string(content), "\x00"))
+		return label != "" && label != "unconfined"
+	}
+	return false
+}
+
+// lxcSecurityEntries returns the lxc configuration for @t's security
+// policy, writing its seccomp policy into @lxcconfigDir.
+func (mos *Mos) lxcSecurityEntries(t *Target, lxcconfigDir string) ([]string, error) {
+	s := SecurityPolicy{}
+	if t.Security != nil {
+		s = *t.Security
+	}
+
+	entries := []string{}
+	if len(s.CapKeep) != 0 {
+		entries = append(entries, "lxc.cap.keep = "+strings.Join(s.CapKeep, " "))
+	}
+	if len(s.CapDrop) != 0 {
+		entries = append(entries, "lxc.cap.drop = "+strings.Join(s.CapDrop, " "))
+	}
+	if s.NoNewPrivs {
+		entries = append(entries, "lxc.no_new_privs = 1")
+	}
+
+	switch {
+	case s.Apparmor != "":
+		entries = append(entries, "lxc.apparmor.profile = "+s.Apparmor)
+	case apparmorConfined():
+		entries = append(entries, "lxc.apparmor.profile = unchanged")
+	}
+
+	policy := ""
+	switch s.Seccomp {
+	case "", SeccompDefault:
+		policy = defaultSeccompPolicy
+	case SeccompUnconfined:
+	default:
+		syst, err := mos.GetSystarget(t)
+		if err != nil {
+			return entries, err
+		}
+		if syst.seccompPolicy == nil {
+			return entries, fmt.Errorf("No seccomp policy %q found for %s", s.Seccomp, t.ServiceName)
+		}
+		policy = syst.seccompPolicy.Policy
+	}
+	if policy != "" {
+		path := filepath.Join(lxcconfigDir, "seccomp")
+		if err := os.WriteFile(path, []byte(policy), 0644); err != nil {
+			return entries, fmt.Errorf("Failed writing seccomp policy for %s: %w", t.ServiceName, err)
+		}
+		entries = append(entries, "lxc.seccomp.profile = "+path)
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,188 @@
+package mosconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/apex/log"
+	"gopkg.in/yaml.v2"
+)
+
+// A manifest signing certificate whose subject has this
+// OrganizationalUnit may sign manifests which downgrade the system.
+const DowngradeOU = "mos-allow-downgrade"
+
+// The highest release serial which we have accepted for each product is
+// kept in $config/release_serials.yaml.
+func releaseSerialsPath(configDir string) string {
+	return filepath.Join(configDir, "release_serials.yaml")
+}
+
+func readReleaseSerials(configDir string) (map[string]int64, error) {
+	serials := map[string]int64{}
+	content, err := os.ReadFile(releaseSerialsPath(configDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return serials, nil
+		}
+		return nil, fmt.Errorf("Failed reading release serials: %w", err)
+	}
+	if err := yaml.Unmarshal(content, &serials); err != nil {
+		return nil, fmt.Errorf("Failed parsing release serials: %w", err)
+	}
+	return serials, nil
+}
+
+// recordReleaseSerial records that we accepted release @serial of
+// @product, unless we already accepted a later one.
+func recordReleaseSerial(configDir, product string, serial int64) error {
+	serials, err := readReleaseSerials(configDir)
+	if err != nil {
+		return err
+	}
+	if last, ok := serials[product]; ok && last >= serial {
+		return nil
+	}
+	serials[product] = serial
+	bytes, err := yaml.Marshal(serials)
+	if err != nil {
+		return fmt.Errorf("Failed marshalling release serials: %w", err)
+	}
+	if err := os.WriteFile(releaseSerialsPath(configDir), bytes, 0644); err != nil {
+		return fmt.Errorf("Failed writing release serials: %w", err)
+	}
+	return nil
+}
+
+// compareVersions compares target versions @a and @b by semantic
+// versioning precedence.  The '.' separated release fields are compared
+// numerically, with missing fields counting as 0.  A pre-release, such
+// as 1.0.0-rc.1, is older than its release, and pre-release fields are
+// compared numerically if both are numbers, else as strings, numbers
+// coming first.  Build metadata after a '+' is ignored.  It returns -1
+// if a < b, 0 if they are equal and 1 if a > b.
+func compareVersions(a, b string) int {
+	aRel, aPre := splitVersion(a)
+	bRel, bPre := splitVersion(b)
+	if c := compareVersionFields(aRel, bRel, true); c != 0 {
+		return c
+	}
+	switch {
+	case aPre == nil && bPre == nil:
+		return 0
+	case aPre == nil:
+		return 1
+	case bPre == nil:
+		return -1
+	}
+	return compareVersionFields(aPre, bPre, false)
+}
+
+// splitVersion returns the release and pre-release fields of version @v.
+func splitVersion(v string) ([]string, []string) {
+	v, _, _ = strings.Cut(v, "+")
+	release, pre, found := strings.Cut(v, "-")
+	if !found {
+		return strings.Split(release, "."), nil
+	}
+	return strings.Split(release, "."), strings.Split(pre, ".")
+}
+
+// compareVersionFields compares lists of version fields.  If @pad, then
+// missing fields count as 0, else the shorter list is the older.
+func compareVersionFields(a, b []string, pad bool) int {
+	for i := 0; i < len(a) || i < len(b); i++ {
+		if !pad && i >= len(a) {
+			return -1
+		}
+		if !pad && i >= len(b) {
+			return 1
+		}
+		af, bf := "0", "0"
+		if i < len(a) {
+			af = a[i]
+		}
+		if i < len(b) {
+			bf = b[i]
+		}
+		if c := compareVersionField(af, bf); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+func compareVersionField(a, b string) int {
+	an, aerr := strconv.ParseUint(a, 10, 64)
+	bn, berr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case aerr == nil && berr == nil:
+		switch {
+		case an < bn:
+			return -1
+		case an > bn:
+			return 1
+		}
+		return 0
+	case aerr == nil:
+		return -1
+	case berr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func certAllowsDowngrade(certPath string) (bool, error) {
+	certs, err := readCerts(certPath)
+	if err != nil {
+		return false, fmt.Errorf("Failed reading manifest cert (%q): %w", certPath, err)
+	}
+	for _, ou := range certs[0].Subject.OrganizationalUnit {
+		if ou == DowngradeOU {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkDowngrade returns an error if @newIF has an older release serial
+// than one we have accepted for its product, or an older version of a
+// target in @current, unless its signing certificate at @certPath
+// allows downgrades.
+func (mos *Mos) checkDowngrade(current *SysManifest, newIF *InstallFile, certPath string) error {
+	serials, err := readReleaseSerials(mos.opts.ConfigDir)
+	if err != nil {
+		return err
+	}
+
+	var downgrade error
+	if last, ok := serials[newIF.Product]; ok && newIF.Serial < last {
+		downgrade = fmt.Errorf("Release serial %d is older than the accepted %d", newIF.Serial, last)
+	}
+	if downgrade == nil {
+		targets := SysTargets(current.SysTargets)
+		for _, t := range newIF.Targets {
+			old, ok := targets.Contains(SysTarget{Name: t.ServiceName})
+			if ok && compareVersions(t.Version, old.raw.Version) < 0 {
+				downgrade = fmt.Errorf("Target %s would be downgraded from %s to %s", t.ServiceName, old.raw.Version, t.Version)
+				break
+			}
+		}
+	}
+	if downgrade == nil {
+		return nil
+	}
+
+	allowed, err := certAllowsDowngrade(certPath)
+	if err != nil {
+		return err
+	}
+	if !allowed {
+		return downgrade
+	}
+	log.Warnf("Allowing downgrade, as the manifest signer permits it: %v", downgrade)
+	return nil
+}
@@ -0,0 +1,223 @@
+package mosconfig
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/apex/log"
+	"gopkg.in/yaml.v2"
+)
+
+// How installed manifests are treated once the certificate which signed
+// them has expired.  New manifests are never accepted from an expired
+// signer.
+type ExpiredSigners string
+
+const (
+	// Installed manifests remain usable, so the system still boots
+	AllowInstalled ExpiredSigners = "allow-installed"
+
+	// Installed manifests are rejected as well
+	RejectExpired ExpiredSigners = "reject"
+)
+
+// A SignerPolicy says how manifest signing certificates are checked.
+// It is read from $config/trust.yaml.
+type SignerPolicy struct {
+	// A CRL, signed by the manifest CA, listing revoked signing
+	// certificates.  Defaults to the CA's path with .crl in place of
+	// .pem.  If it does not exist, no certificates are revoked.
+	CRLPath string `yaml:"crl"`
+
+	ExpiredSigners ExpiredSigners `yaml:"expired_signers"`
+}
+
+// A SignerCheck is what ReadVerifyManifest needs to check a manifest's
+// signing certificate.
+type SignerCheck struct {
+	Policy SignerPolicy
+
+	// The manifest is already installed, rather than being installed
+	// or updated to.
+	Installed bool
+}
+
+func crlPathFor(caPath string) string {
+	return strings.TrimSuffix(caPath, ".pem") + ".crl"
+}
+
+// DefaultSignerPolicy is used for manifests signed under the CA at
+// @caPath when $config/trust.yaml does not say otherwise.
+func DefaultSignerPolicy(caPath string) SignerPolicy {
+	return SignerPolicy{
+		CRLPath:        crlPathFor(caPath),
+		ExpiredSigners: AllowInstalled,
+	}
+}
+
+// signerPolicy returns the policy for certificates issued by the CA at
+// @caPath.
+func (mos *Mos) signerPolicy(caPath string) (SignerPolicy, error) {
+	p := DefaultSignerPolicy(caPath)
+	path := filepath.Join(mos.opts.ConfigDir, "trust.yaml")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return p, nil
+		}
+		return p, fmt.Errorf("Failed reading trust configuration: %w", err)
+	}
+	if err := yaml.Unmarshal(content, &p); err != nil {
+		return p, fmt.Errorf("Failed parsing %q: %w", path, err)
+	}
+	switch p.ExpiredSigners {
+	case AllowInstalled, RejectExpired:
+	default:
+		return p, fmt.Errorf("Unknown expired_signers policy %q in %q", p.ExpiredSigners, path)
+	}
+	if p.CRLPath == "" {
+		p.CRLPath = crlPathFor(caPath)
+	} else if mos.opts.RootDir != "/" && !strings.HasPrefix(p.CRLPath, mos.opts.RootDir) {
+		p.CRLPath = filepath.Join(mos.opts.RootDir, p.CRLPath)
+	}
+	return p, nil
+}
+
+func readCerts(path string) ([]*x509.Certificate, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCerts(content)
+}
+
+// parseCerts returns the certificates in PEM @content.
+func parseCerts(content []byte) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for {
+		var block *pem.Block
+		block, content = pem.Decode(content)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("No certificate found")
+	}
+	return certs, nil
+}
+
+// checkRevoked returns an error if @cert is listed in the CRL, which
+// must be signed by one of @cas.
+func (p SignerPolicy) checkRevoked(cert *x509.Certificate, cas []*x509.Certificate) error {
+	if p.CRLPath == "" {
+		return nil
+	}
+	content, err := os.ReadFile(p.CRLPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Failed reading revocation list: %w", err)
+	}
+	if block, _ := pem.Decode(content); block != nil {
+		content = block.Bytes
+	}
+	crl, err := x509.ParseRevocationList(content)
+	if err != nil {
+		return fmt.Errorf("Failed parsing revocation list %q: %w", p.CRLPath, err)
+	}
+
+	signed := false
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			signed = true
+			break
+		}
+	}
+	if !signed {
+		return fmt.Errorf("Revocation list %q is not signed by the manifest CA", p.CRLPath)
+	}
+	if !crl.NextUpdate.IsZero() && time.Now().After(crl.NextUpdate) {
+		log.Warnf("Revocation list %q is out of date since %s", p.CRLPath, crl.NextUpdate)
+	}
+
+	if !bytes.Equal(crl.RawIssuer, cert.RawIssuer) {
+		return nil
+	}
+	for _, r := range crl.RevokedCertificates {
+		if r.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return fmt.Errorf("Manifest signing certificate %q (serial %x) has been revoked", cert.Subject.CommonName, cert.SerialNumber)
+		}
+	}
+	return nil
+}
+
+// VerifyManifest checks that @contents is signed, with the signature in
+// @sigPath, by the certificate at @certPath, and that the certificate is
+// issued by the CA at @caPath, not revoked, and valid.  An installed
+// manifest whose certificate has since expired is accepted if the
+// policy allows it, as long as the certificate was valid for the CA.
+func (c SignerCheck) VerifyManifest(contents []byte, sigPath, certPath, caPath string) error {
+	certs, err := readCerts(certPath)
+	if err != nil {
+		return fmt.Errorf("Failed reading manifest cert (%q): %w", certPath, err)
+	}
+	cert := certs[0]
+	cas, err := readCerts(caPath)
+	if err != nil {
+		return fmt.Errorf("Failed reading manifest CA (%q): %w", caPath, err)
+	}
+
+	if err := c.Policy.checkRevoked(cert, cas); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("Manifest signing certificate %q is not valid until %s", cert.Subject.CommonName, cert.NotBefore)
+	}
+	if now.After(cert.NotAfter) {
+		if !c.Installed || c.Policy.ExpiredSigners != AllowInstalled {
+			return fmt.Errorf("Manifest signing certificate %q expired on %s", cert.Subject.CommonName, cert.NotAfter)
+		}
+		log.Debugf("Accepting installed manifest signed by %q, which expired on %s", cert.Subject.CommonName, cert.NotAfter)
+		now = cert.NotAfter
+	}
+
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+	opts := x509.VerifyOptions{
+		Roots:       pool,
+		CurrentTime: now,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		return fmt.Errorf("Manifest certificate does not match the CA: %w", err)
+	}
+
+	signature, err := os.ReadFile(sigPath)
+	if err != nil {
+		return fmt.Errorf("Failed reading signature (%q): %w", sigPath, err)
+	}
+	if err := cert.CheckSignature(x509.SHA256WithRSA, contents, signature); err != nil {
+		return fmt.Errorf("Failed verifying manifest signature: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package mosconfig
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/opencontainers/umoci"
+	stackeroci "stackerbuild.io/stacker/pkg/oci"
+)
+
+// Target run states reported by Status
+const (
+	StateRunning = "running"
+	StateStopped = "stopped"
+	StateMounted = "mounted"
+	StateFailed  = "failed"
+)
+
+// TargetStatus describes the installed and running state of one target.
+type TargetStatus struct {
+	Name        string      `json:"name"`
+	ServiceType ServiceType `json:"service_type"`
+	ImagePath   string      `json:"image_path"`
+
+	// The version and manifest hash in the system manifest
+	Version      string `json:"version"`
+	ManifestHash string `json:"manifest_hash"`
+
+	// The version and manifest hash which are actually mounted, if any
+	MountedVersion string `json:"mounted_version,omitempty"`
+	MountedHash    string `json:"mounted_hash,omitempty"`
+
+	// The version in a pending update, if any
+	PendingVersion string `json:"pending_version,omitempty"`
+
+	State     string   `json:"state"`
+	Health    string   `json:"health,omitempty"`
+	Addresses []string `json:"addresses,omitempty"`
+	NSGroup   string   `json:"nsgroup,omitempty"`
+	UidRange  string   `json:"uid_range,omitempty"`
+
+	// The resource limits of a container, and its current usage if
+	// it is running
+	Resources *Resources     `json:"resources,omitempty"`
+	Usage     *ResourceUsage `json:"usage,omitempty"`
+}
+
+// imageForHash finds the image for target @t whose manifest hash is
+// @hash, or whose top layer has hash @hash (atomfs reports the topmost
+// overlay lowerdir, which is the image's last layer).  The target's own
+// version is checked first.  Returns the version and manifest hash of
+// the image, or "" if none was found.
+func (mos *Mos) imageForHash(t *Target, hash string) (string, string, error) {
+	ociDir, name := mos.storage.ImageRef(t)
+	// Images of other versions of t are tagged as prefix+version
+	prefix := strings.TrimSuffix(name, t.Version)
+
+	oci, err := umoci.OpenLayout(ociDir)
+	if err != nil {
+		return "", "", fmt.Errorf("Failed opening OCI layout for %s: %w", t.ImagePath, err)
+	}
+	defer oci.Close()
+
+	tags, err := oci.ListReferences(context.Background())
+	if err != nil {
+		return "", "", fmt.Errorf("Failed listing images for %s: %w", t.ImagePath, err)
+	}
+
+	candidates := []string{name}
+	for _, tag := range tags {
+		if tag != name && strings.HasPrefix(tag, prefix) {
+			candidates = append(candidates, tag)
+		}
+	}
+
+	for _, tag := range candidates {
+		dps, err := oci.ResolveReference(context.Background(), tag)
+		if err != nil || len(dps) != 1 {
+			continue
+		}
+		mHash := dps[0].Descriptor().Digest.Encoded()
+		version := strings.TrimPrefix(tag, prefix)
+		if mHash == hash {
+			return version, mHash, nil
+		}
+
+		manifest, err := stackeroci.LookupManifest(oci, tag)
+		if err != nil {
+			continue
+		}
+		n := len(manifest.Layers)
+		if n != 0 && manifest.Layers[n-1].Digest.Encoded() == hash {
+			return version, mHash, nil
+		}
+	}
+
+	return "", "", nil
+}
+
+// uidRange returns the host uid range used by target @t, if any.
+func uidRange(manifest *SysManifest, t *Target) string {
+	if !t.NeedsIdmap() {
+		return ""
+	}
+	for _, u := range manifest.UidMaps {
+		if u.Name == t.NSGroup {
+			return fmt.Sprintf("%d-%d", u.Hostid, u.Hostid+u.size()-1)
+		}
+	}
+	return ""
+}
+
+// runState reports whether target @t is running.
+func (mos *Mos) runState(t *Target) (string, error) {
+	switch t.ServiceType {
+	case HostfsService:
+		return StateRunning, nil
+	case FsService:
+		/* see startFsOnly() */
+		mp := filepath.Join(mos.opts.RootDir, "/mnt/atom", t.ServiceName)
+		mounted, err := IsMountpoint(mp)
+		if err != nil {
+			return "", err
+		}
+		if mounted {
+			return StateMounted, nil
+		}
+		return StateStopped, nil
+	case ContainerService:
+		out, rc := RunCommandWithRc("lxc-info", "-H", "-n", t.ServiceName, "-s")
+		state := strings.ToLower(strings.TrimSpace(string(out)))
+		if rc != 0 || state == StateStopped {
+			// Tell a failed service from one which was stopped
+			return mos.initmgr.Status(t)
+		}
+		return state, nil
+	default:
+		return "", fmt.Errorf("Unhandled service type: %s", t.ServiceType)
+	}
+}
+
+// Status reports the state of each target in the system manifest.
+func (mos *Mos) Status() ([]TargetStatus, error) {
+	manifest, err := mos.CurrentManifest()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending *SysManifest
+	hasPending, err := mos.HasPending()
+	if err != nil {
+		return nil, err
+	}
+	if hasPending {
+		pending, err = mos.manifestAt(pendingBranch)
+		if err != nil {
+			log.Warnf("Failed reading pending update: %v", err)
+		}
+	}
+
+	ret := []TargetStatus{}
+	for _, st := range manifest.SysTargets {
+		t := st.raw
+		s := TargetStatus{
+			Name:         t.ServiceName,
+			ServiceType:  t.ServiceType,
+			ImagePath:    t.ImagePath,
+			Version:      t.Version,
+			ManifestHash: t.ManifestHash,
+			NSGroup:      t.NSGroup,
+			UidRange:     uidRange(manifest, t),
+			Resources:    t.Resources,
+		}
+
+		s.State, err = mos.runState(t)
+		if err != nil {
+			return nil, fmt.Errorf("Failed checking state of %s: %w", t.ServiceName, err)
+		}
+		if t.Network.Type == CNINetworkType && s.State == StateRunning {
+			s.Addresses = cniAddresses(mos.opts.RootDir, t.ServiceName)
+		}
+		if t.ServiceType == ContainerService && s.State == StateRunning {
+			s.Health = mos.Health(t)
+			s.Usage, err = resourceUsage(t.ServiceName)
+			if err != nil {
+				log.Warnf("Failed reading resource usage of %s: %v", t.ServiceName, err)
+			}
+		}
+
+		s.MountedVersion, s.MountedHash, err = mos.runningImage(t)
+		if err != nil {
+			log.Warnf("Failed finding mounted image for %s: %v", t.ServiceName, err)
+		} else if s.MountedVersion == "" {
+			// not an image we know, so not a manifest hash
+			s.MountedHash = ""
+		}
+
+		if pending != nil {
+			for _, pt := range pending.SysTargets {
+				if pt.Name == st.Name {
+					s.PendingVersion = pt.raw.Version
+				}
+			}
+		}
+
+		ret = append(ret, s)
+	}
+
+	// Targets which only exist in the pending update
+	if pending != nil {
+		current := SysTargets(manifest.SysTargets)
+		for _, pt := range pending.SysTargets {
+			if _, ok := current.Contains(pt); ok {
+				continue
+			}
+			ret = append(ret, TargetStatus{
+				Name:           pt.Name,
+				ServiceType:    pt.raw.ServiceType,
+				ImagePath:      pt.raw.ImagePath,
+				PendingVersion: pt.raw.Version,
+				State:          StateStopped,
+				NSGroup:        pt.raw.NSGroup,
+			})
+		}
+	}
+
+	return ret, nil
+}
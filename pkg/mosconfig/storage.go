@@ -2,6 +2,7 @@ package mosconfig
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -11,6 +12,7 @@ import (
 	ispec "github.com/opencontainers/image-spec/specs-go/v1"
 
 	"github.com/apex/log"
+	"github.com/lxc/lxd/shared/idmap"
 	"github.com/opencontainers/umoci"
 	"golang.org/x/sys/unix"
 	"stackerbuild.io/stacker/pkg/atomfs"
@@ -34,10 +36,22 @@ type Storage interface {
 	MountedByHash(target *Target) (string, error)
 	TearDownTarget(name string) error
 	TargetMountdir(t *Target) (string, error)
-	SetupTarget(t *Target) error
+
+	// Mount the target's root filesystem under TargetMountdir.  If
+	// @idmapset is not nil, then a container's files are shifted into
+	// that range using an idmapped mount where supported, in which case
+	// true is returned.
+	SetupTarget(t *Target, idmapset *idmap.IdmapSet) (bool, error)
 	VerifyTarget(t *Target) error
 
 	ImportTarget(srcDir string, target *Target) error
+
+	// Remove all images which are not used by any of the given targets.
+	GC(keep []*Target) error
+
+	// Return the OCI layout directory and image name under which the
+	// target's image is stored.
+	ImageRef(t *Target) (string, string)
 }
 
 func NewStorage(opts MosOptions) (Storage, error) {
@@ -45,9 +59,9 @@ func NewStorage(opts MosOptions) (Storage, error) {
 	var e error
 	switch opts.StorageType {
 	case AtomfsStorageType:
-		s, e = NewAtomfsStorage(opts.RootDir, opts.StorageCache, opts.ScratchWrites)
+		s, e = NewAtomfsStorage(opts.RootDir, opts.StorageCache, opts.ScratchWrites, opts.Registry)
 	case PuzzlefsStorageType:
-		return nil, fmt.Errorf("Not yet implemented")
+		s, e = NewPuzzlefsStorage(opts.RootDir, opts.StorageCache, opts.ScratchWrites)
 	default:
 		return nil, fmt.Errorf("Unknown storage type requested")
 	}
@@ -55,17 +69,56 @@ func NewStorage(opts MosOptions) (Storage, error) {
 	return s, e
 }
 
+// The storage type is chosen at install time from the install manifest,
+// and recorded in $config/storage_type.
+func storageTypePath(configDir string) string {
+	return filepath.Join(configDir, "storage_type")
+}
+
+func ParseStorageType(t string) (StorageType, error) {
+	switch t {
+	case "", "atomfs":
+		return AtomfsStorageType, nil
+	case "puzzlefs":
+		return PuzzlefsStorageType, nil
+	default:
+		return "", fmt.Errorf("Unknown storage type %q", t)
+	}
+}
+
+// Return the storage type recorded at install time.  Systems installed
+// before this was recorded use atomfs.
+func readStorageType(configDir string) (StorageType, error) {
+	content, err := os.ReadFile(storageTypePath(configDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return AtomfsStorageType, nil
+		}
+		return "", fmt.Errorf("Failed reading storage type: %w", err)
+	}
+	return ParseStorageType(strings.TrimSpace(string(content)))
+}
+
+func writeStorageType(configDir string, t StorageType) error {
+	if err := os.WriteFile(storageTypePath(configDir), []byte(string(t)+"\n"), 0644); err != nil {
+		return fmt.Errorf("Failed writing storage type: %w", err)
+	}
+	return nil
+}
+
 type AtomfsStorage struct {
 	RootDir     string
 	zotPath     string
 	scratchPath string
+	registry    RegistryOpts
 }
 
-func NewAtomfsStorage(rootDir, zotPath, scratchPath string) (*AtomfsStorage, error) {
+func NewAtomfsStorage(rootDir, zotPath, scratchPath string, registry RegistryOpts) (*AtomfsStorage, error) {
 	return &AtomfsStorage{
 		RootDir:     rootDir,
 		zotPath:     zotPath,
 		scratchPath: scratchPath,
+		registry:    registry,
 	}, nil
 }
 
@@ -113,25 +166,32 @@ func (a *AtomfsStorage) Mount(t *Target, mountpoint string) (func(), error) {
 }
 
 func (a *AtomfsStorage) MountWriteable(t *Target, mountpoint string) (func(), error) {
-	ropath, err := os.MkdirTemp(a.scratchPath, fmt.Sprintf("%s-scratch-readonly-", t.ServiceName))
+	return mountWriteableOverlay(a, a.scratchPath, t, mountpoint)
+}
+
+// mountWriteableOverlay mounts a read-only copy of @t using storage @s,
+// and a writeable overlay on top of it at @mountpoint.  The readonly
+// mount, upperdir and workdir are created under @scratchPath.
+func mountWriteableOverlay(s Storage, scratchPath string, t *Target, mountpoint string) (func(), error) {
+	ropath, err := os.MkdirTemp(scratchPath, fmt.Sprintf("%s-scratch-readonly-", t.ServiceName))
 	if err != nil {
 		return func() {}, fmt.Errorf("Failed creating readonly mountpoint: %w", err)
 	}
 
-	roCleanup, err := a.Mount(t, ropath)
+	roCleanup, err := s.Mount(t, ropath)
 	if err != nil {
 		os.Remove(ropath)
 		return func() {}, fmt.Errorf("Failed creating readonly mount for %#v: %w", t, err)
 	}
 
-	workdir, err := os.MkdirTemp(a.scratchPath, fmt.Sprintf("%s-scratch-workdir-", t.ServiceName))
+	workdir, err := os.MkdirTemp(scratchPath, fmt.Sprintf("%s-scratch-workdir-", t.ServiceName))
 	if err != nil {
 		roCleanup()
 		os.Remove(ropath)
 		return func() {}, fmt.Errorf("Failed creating workdir: %w", err)
 	}
 
-	upperdir, err := os.MkdirTemp(a.scratchPath, fmt.Sprintf("%s-scratch-upperdir-", t.ServiceName))
+	upperdir, err := os.MkdirTemp(scratchPath, fmt.Sprintf("%s-scratch-upperdir-", t.ServiceName))
 	if err != nil {
 		roCleanup()
 		os.Remove(ropath)
@@ -146,7 +206,6 @@ func (a *AtomfsStorage) MountWriteable(t *Target, mountpoint string) (func(), er
 		os.RemoveAll(workdir)
 		os.RemoveAll(upperdir)
 		os.Remove(ropath)
-		return nil, err
 		return func() {}, fmt.Errorf("Failed mounting writeable overlay: %w", err)
 	}
 	cleanup := func() {
@@ -160,6 +219,78 @@ func (a *AtomfsStorage) MountWriteable(t *Target, mountpoint string) (func(), er
 	return cleanup, nil
 }
 
+// The readonly image under an idmapped container root $mp is mounted
+// at $mp-source.
+const idmapSourceSuffix = "-source"
+
+// mountContainerRoot mounts @t at @mountpoint as a container's root
+// filesystem.  If @idmapset is not nil and idmapped mounts are supported,
+// the readonly image is mounted there idmapped into that range, and true
+// is returned.  Otherwise a writeable overlay is mounted there, whose
+// files the caller has to shift.
+func mountContainerRoot(s Storage, scratchPath string, t *Target, mountpoint string, idmapset *idmap.IdmapSet) (func(), bool, error) {
+	if idmapset != nil {
+		cleanup, err := mountIdmappedRoot(s, t, mountpoint, *idmapset)
+		if err == nil {
+			return cleanup, true, nil
+		}
+		if !errors.Is(err, errIdmapUnsupported) {
+			return func() {}, false, err
+		}
+		log.Infof("Idmapped mounts are not supported for %s, its files will be shifted", t.ServiceName)
+	}
+
+	cleanup, err := mountWriteableOverlay(s, scratchPath, t, mountpoint)
+	return cleanup, false, err
+}
+
+// mountIdmappedRoot mounts the readonly image of @t at @mountpoint,
+// idmapped by @set.
+func mountIdmappedRoot(s Storage, t *Target, mountpoint string, set idmap.IdmapSet) (func(), error) {
+	src := mountpoint + idmapSourceSuffix
+	if err := EnsureDir(src); err != nil {
+		return func() {}, fmt.Errorf("Failed creating readonly mountpoint: %w", err)
+	}
+
+	roCleanup, err := s.Mount(t, src)
+	if err != nil {
+		os.Remove(src)
+		return func() {}, fmt.Errorf("Failed creating readonly mount for %#v: %w", t, err)
+	}
+
+	if err := mountIdmapped(src, mountpoint, set); err != nil {
+		roCleanup()
+		os.Remove(src)
+		return func() {}, err
+	}
+
+	cleanup := func() {
+		unix.Unmount(mountpoint, unix.MNT_DETACH)
+		roCleanup()
+		os.Remove(src)
+	}
+	return cleanup, nil
+}
+
+// unmountIdmapSource unmounts, using @umount, the readonly image under
+// the idmapped container root @mp, if there is one.
+func unmountIdmapSource(mp string, umount func(string) error) error {
+	src := mp + idmapSourceSuffix
+	mounted, err := IsMountpoint(src)
+	if err != nil {
+		return fmt.Errorf("Failed checking whether %q is mounted: %w", src, err)
+	}
+	if mounted {
+		if err := umount(src); err != nil {
+			return fmt.Errorf("umount of %q failed: %w", src, err)
+		}
+	}
+	if err := os.Remove(src); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed removing %q: %w", src, err)
+	}
+	return nil
+}
+
 func getHashFromOverlay(mountinfo string, mountPoint string) (string, error) {
 	mounts, err := mount.ParseMounts(mountinfo)
 	if err != nil {
@@ -176,9 +307,20 @@ func getHashFromOverlay(mountinfo string, mountPoint string) (string, error) {
 			return "", fmt.Errorf("Failed getting overlay dirs for mount %+v: %w", m, err)
 		}
 
+		// A writeable overlay (see mountWriteableOverlay) has the
+		// readonly image mount as its lowerdir.  That is mounted in
+		// our own namespace.
+		firstDir := dirs[0]
+		isOverlay, err := isOverlayMount(firstDir)
+		if err != nil {
+			return "", err
+		}
+		if isOverlay {
+			return getHashFromOverlay("/proc/self/mountinfo", firstDir)
+		}
+
 		// atomix has traditionally used the first layer as the 'hash'
 		// field of everything.
-		firstDir := dirs[0]
 		hash := filepath.Base(firstDir)
 		return hash, nil
 	}
@@ -186,7 +328,31 @@ func getHashFromOverlay(mountinfo string, mountPoint string) (string, error) {
 	return "", nil
 }
 
+func isOverlayMount(dir string) (bool, error) {
+	mounts, err := mount.ParseMounts("/proc/self/mountinfo")
+	if err != nil {
+		return false, err
+	}
+	for _, m := range mounts {
+		if m.Target == dir && m.FSType == "overlay" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// MountedByHash returns the manifest hash recorded by SetupTarget for
+// @target if it is still mounted, else the hash of its mounted top layer,
+// or "" if it is not mounted.
 func (a *AtomfsStorage) MountedByHash(target *Target) (string, error) {
+	hash, err := a.mountHash(target)
+	if err != nil {
+		return "", err
+	}
+	return recordedHash(a.scratchPath, target, hash)
+}
+
+func (a *AtomfsStorage) mountHash(target *Target) (string, error) {
 	switch target.ServiceType {
 	case "hostfs":
 		return getHashFromOverlay("/proc/self/mountinfo", a.RootDir)
@@ -222,39 +388,49 @@ func (a *AtomfsStorage) MountedByHash(target *Target) (string, error) {
 	}
 }
 
-func (a *AtomfsStorage) SetupTarget(t *Target) error {
+func (a *AtomfsStorage) SetupTarget(t *Target, idmapset *idmap.IdmapSet) (bool, error) {
 	mp := filepath.Join(a.scratchPath, "roots", t.ServiceName)
 	mounted, err := IsMountpoint(mp)
 	if err != nil {
-		return fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
+		return false, fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
 	}
 	if mounted {
 		err := atomfs.Umount(mp)
 		if err != nil {
-			return err
+			return false, err
 		}
 	}
 
 	err = EnsureDir(mp)
 	if err != nil {
-		return fmt.Errorf("Failed creating mountpoint %q: %w", mp, err)
+		return false, fmt.Errorf("Failed creating mountpoint %q: %w", mp, err)
 	}
 
+	idmapped := false
 	if t.ServiceType == "container" {
-		// For containers, we have to make this writeable to support
-		// uid shifting.  We can un-do this if/when we can use id mapped
-		// mounts.
-		// XXX TODO we should probably, therefore, umount this after
-		// every service stop.
-		_, err = a.MountWriteable(t, mp)
+		// For containers, the readonly image is mounted idmapped
+		// into the container's uid range.  If idmapped mounts are
+		// not supported, a writeable overlay is mounted instead, in
+		// which the caller will have to shift the uids.
+		// XXX TODO we should probably umount this after every
+		// service stop.
+		_, idmapped, err = mountContainerRoot(a, a.scratchPath, t, mp, idmapset)
 	} else {
 		_, err = a.Mount(t, mp)
 	}
 	if err != nil {
-		return fmt.Errorf("Failed mounting %s:%s to %q: %w", t.ServiceName, t.Version, mp, err)
+		return false, fmt.Errorf("Failed mounting %s:%s to %q: %w", t.ServiceName, t.Version, mp, err)
 	}
 
-	return nil
+	hash, err := getHashFromOverlay("/proc/self/mountinfo", mp)
+	if err != nil {
+		return false, fmt.Errorf("Failed finding the image mounted at %q: %w", mp, err)
+	}
+	if err := writeTargetState(a.scratchPath, t, hash); err != nil {
+		return false, err
+	}
+
+	return idmapped, nil
 }
 
 // We mount a readonly copy of the fs under $scratch-writes/roots/$target.
@@ -267,20 +443,20 @@ func (a *AtomfsStorage) TargetMountdir(t *Target) (string, error) {
 
 func (a *AtomfsStorage) TearDownTarget(name string) error {
 	log.Warnf("tearing down %q", name)
+	if err := removeTargetState(a.scratchPath, name); err != nil {
+		return err
+	}
 	mp := filepath.Join(a.scratchPath, "roots", name)
 	mounted, err := IsMountpoint(mp)
 	if err != nil {
 		return fmt.Errorf("Failed checking whether %q is mounted: %w", mp, err)
 	}
-	if !mounted {
-		return nil
-	}
-
-	err = atomfs.Umount(mp)
-	if err != nil {
-		return fmt.Errorf("atomfs umount of %q failed: %w", mp, err)
+	if mounted {
+		if err := atomfs.Umount(mp); err != nil {
+			return fmt.Errorf("atomfs umount of %q failed: %w", mp, err)
+		}
 	}
-	return err
+	return unmountIdmapSource(mp, atomfs.Umount)
 }
 
 func pickOciOrZot(inDir, inName, inVersion string) (ocidir, name string, err error) {
@@ -303,12 +479,23 @@ func pickOciOrZot(inDir, inName, inVersion string) (ocidir, name string, err err
 	return
 }
 
+// Images are kept in a local zot layout.
+func (a *AtomfsStorage) ImageRef(t *Target) (string, string) {
+	return filepath.Join(a.zotPath, t.ImagePath), t.Version
+}
+
 func (a *AtomfsStorage) VerifyTarget(t *Target) error {
 	ocidir, name, err := pickOciOrZot(a.zotPath, t.ImagePath, t.Version)
 	if err != nil {
 		return err
 	}
 
+	return verifyManifestHash(ocidir, name, t)
+}
+
+// verifyManifestHash checks that image @name in the OCI layout at @ocidir
+// has the manifest hash listed for @t in the install manifest.
+func verifyManifestHash(ocidir, name string, t *Target) error {
 	oci, err := umoci.OpenLayout(ocidir)
 	if err != nil {
 		return fmt.Errorf("Failed reading OCI manifest for %s: %w", t.ImagePath, err)
@@ -344,11 +531,20 @@ func (a *AtomfsStorage) VerifyTarget(t *Target) error {
 
 // Import a target's storage.  src is the install media base
 // directory, under which we expect either oci or zot.
-// src could also be a remote zot server, but that's not yet
-// implemented.
+// src could also be a remote registry (docker://host[:port][/prefix]).
+// If src is empty, then the registry in our options is used.
 func (a *AtomfsStorage) ImportTarget(src string, target *Target) error {
 	if src == "" {
-		return fmt.Errorf("remote image copy not yet implemented")
+		if a.registry.Base == "" {
+			return fmt.Errorf("No source or registry configured for %s", target.ServiceName)
+		}
+		src = a.registry.Base
+	}
+	if isRegistryURL(src) {
+		if err := a.copyRemote(src, target); err != nil {
+			return fmt.Errorf("Error pulling target %#v: %w", target, err)
+		}
+		return nil
 	}
 	zotDir := filepath.Join(src, "zot")
 	ociDir := filepath.Join(src, "oci")
@@ -388,6 +584,22 @@ func (a *AtomfsStorage) copyLocalZot(zotSourceDir string, target *Target) error
 	return nil
 }
 
+// copyRemote pulls the target's image by its manifest hash from the
+// registry at @base, and verifies it once it is in our zot store.
+func (a *AtomfsStorage) copyRemote(base string, target *Target) error {
+	tpath := filepath.Join(a.zotPath, target.ImagePath)
+	if err := EnsureDir(tpath); err != nil {
+		return fmt.Errorf("Failed creating local zot directory %q: %w", tpath, err)
+	}
+	dest := fmt.Sprintf("oci:%s:%s", tpath, target.Version)
+
+	if err := a.registry.copyFromRegistry(base, target, dest); err != nil {
+		return err
+	}
+
+	return a.VerifyTarget(target)
+}
+
 func (a *AtomfsStorage) copyLocalOci(ociDir string, target *Target) error {
 	src := fmt.Sprintf("oci:%s:%s", ociDir, target.ServiceName)
 	tpath := filepath.Join(a.zotPath, target.ImagePath)
@@ -0,0 +1,415 @@
+package mosconfig
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/apex/log"
+	"gopkg.in/yaml.v2"
+)
+
+// supervisorInitmgr runs container targets under 'mosctl supervise', for
+// systems without systemd.  It talks to the supervisor through files:
+//
+//   - $root/var/lib/mos/supervisor/NAME describes each enabled service,
+//     which the supervisor starts when it starts.
+//   - $root/run/mos/supervisor/NAME.want exists while the service should
+//     be running.
+//   - $root/run/mos/supervisor/NAME.state is the service's state as the
+//     supervisor last saw it.
+//   - $root/run/mos/supervisor/NAME.stop exists while a stop requested
+//     through Stop is under way, so that the supervisor does not take the
+//     container's exit for a crash, even if it is already wanted again.
+type supervisorInitmgr struct {
+	rootDir string
+}
+
+// A supervisedService is what the supervisor needs to know about an
+// enabled service.
+type supervisedService struct {
+	Name  string   `yaml:"name"`
+	After []string `yaml:"after"` // services to start first
+}
+
+const (
+	supervisorPollInterval = time.Second
+	supervisorMaxBackoff   = 5 * time.Minute
+
+	// A service which ran for this long before exiting is restarted
+	// without backoff.
+	supervisorStableRun = time.Minute
+)
+
+func supervisorEnabledDir(rootDir string) string {
+	return filepath.Join(rootDir, "var/lib/mos/supervisor")
+}
+
+func supervisorRunDir(rootDir string) string {
+	return filepath.Join(rootDir, "run/mos/supervisor")
+}
+
+func supervisorWantPath(rootDir, name string) string {
+	return filepath.Join(supervisorRunDir(rootDir), name+".want")
+}
+
+func supervisorStatePath(rootDir, name string) string {
+	return filepath.Join(supervisorRunDir(rootDir), name+".state")
+}
+
+func supervisorStopPath(rootDir, name string) string {
+	return filepath.Join(supervisorRunDir(rootDir), name+".stop")
+}
+
+func (s *supervisorInitmgr) Enable(t *Target) error {
+	if err := EnsureDir(supervisorEnabledDir(s.rootDir)); err != nil {
+		return err
+	}
+	svc := supervisedService{Name: t.ServiceName, After: t.ordering()}
+	bytes, err := yaml.Marshal(&svc)
+	if err != nil {
+		return fmt.Errorf("Failed marshalling supervised service %s: %w", t.ServiceName, err)
+	}
+	dest := filepath.Join(supervisorEnabledDir(s.rootDir), t.ServiceName)
+	if err := os.WriteFile(dest, bytes, 0644); err != nil {
+		return fmt.Errorf("Failed enabling %s: %w", t.ServiceName, err)
+	}
+	return nil
+}
+
+func (s *supervisorInitmgr) Start(t *Target) error {
+	if err := EnsureDir(supervisorRunDir(s.rootDir)); err != nil {
+		return err
+	}
+	if err := os.WriteFile(supervisorWantPath(s.rootDir, t.ServiceName), []byte{}, 0644); err != nil {
+		return fmt.Errorf("Failed starting %s: %w", t.ServiceName, err)
+	}
+	return nil
+}
+
+func (s *supervisorInitmgr) Stop(t *Target) error {
+	if err := EnsureDir(supervisorRunDir(s.rootDir)); err != nil {
+		return err
+	}
+	stopPath := supervisorStopPath(s.rootDir, t.ServiceName)
+	if err := os.WriteFile(stopPath, []byte{}, 0644); err != nil {
+		return fmt.Errorf("Failed stopping %s: %w", t.ServiceName, err)
+	}
+	err := os.Remove(supervisorWantPath(s.rootDir, t.ServiceName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed stopping %s: %w", t.ServiceName, err)
+	}
+
+	// The supervisor does not restart a service which is not wanted,
+	// so we can stop the container ourselves.
+	out, rc := RunCommandWithRc("lxc-info", "-H", "-n", t.ServiceName, "-s")
+	if rc != 0 || strings.TrimSpace(string(out)) != "RUNNING" {
+		// No exit is coming for the supervisor to see
+		os.Remove(stopPath)
+		return nil
+	}
+	if err := RunCommand("lxc-stop", "-n", t.ServiceName); err != nil {
+		return fmt.Errorf("Failed to stop service %s: %w", t.ServiceName, err)
+	}
+	return nil
+}
+
+func (s *supervisorInitmgr) Status(t *Target) (string, error) {
+	content, err := os.ReadFile(supervisorStatePath(s.rootDir, t.ServiceName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return StateStopped, nil
+		}
+		return "", fmt.Errorf("Failed reading state of %s: %w", t.ServiceName, err)
+	}
+	return strings.TrimSpace(string(content)), nil
+}
+
+// Reboot uses the system's reboot, which stops the supervisor and so its
+// services.  For kexec, the boot kernel must already have been loaded
+// with kexec -l.
+func (s *supervisorInitmgr) Reboot(kexec bool) error {
+	if !kexec {
+		if err := RunCommand("reboot"); err != nil {
+			return fmt.Errorf("Failed to reboot: %w", err)
+		}
+		return nil
+	}
+
+	loaded, err := os.ReadFile("/sys/kernel/kexec_loaded")
+	if err != nil {
+		return fmt.Errorf("Failed checking for a kexec kernel: %w", err)
+	}
+	if strings.TrimSpace(string(loaded)) != "1" {
+		return fmt.Errorf("No kernel has been loaded for kexec")
+	}
+	if err := RunCommand("kexec", "-e"); err != nil {
+		return fmt.Errorf("Failed to kexec: %w", err)
+	}
+	return nil
+}
+
+// A supervised is a service which the supervisor has started.
+type supervised struct {
+	cmd           *exec.Cmd
+	started       time.Time
+	failures      int
+	nextStart     time.Time
+	stopping      bool
+	cancelMonitor context.CancelFunc
+}
+
+type supervisorExit struct {
+	name string
+	err  error
+}
+
+type supervisor struct {
+	rootDir   string
+	services  map[string]*supervised
+	exits     chan supervisorExit
+	unhealthy chan string
+}
+
+func (sv *supervisor) setState(name, state string) {
+	if err := os.WriteFile(supervisorStatePath(sv.rootDir, name), []byte(state+"\n"), 0644); err != nil {
+		log.Warnf("Failed recording state of %s: %v", name, err)
+	}
+}
+
+func (sv *supervisor) wanted(name string) bool {
+	return PathExists(supervisorWantPath(sv.rootDir, name))
+}
+
+func (sv *supervisor) running(name string) bool {
+	s, ok := sv.services[name]
+	return ok && s.cmd != nil
+}
+
+// readEnabled returns the enabled service @name, or one with no
+// dependencies if it is wanted but has not been enabled.
+func (sv *supervisor) readEnabled(name string) supervisedService {
+	svc := supervisedService{Name: name}
+	content, err := os.ReadFile(filepath.Join(supervisorEnabledDir(sv.rootDir), name))
+	if err == nil {
+		if err := yaml.Unmarshal(content, &svc); err != nil {
+			log.Warnf("Failed parsing supervised service %s: %v", name, err)
+		}
+	}
+	return svc
+}
+
+func (sv *supervisor) start(name string) {
+	s, ok := sv.services[name]
+	if !ok {
+		s = &supervised{}
+		sv.services[name] = s
+	}
+
+	log.Infof("Starting %s", name)
+	// Any stop which was requested has been seen by exited()
+	os.Remove(supervisorStopPath(sv.rootDir, name))
+	cmd := exec.Command("lxc-execute", "-n", name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		log.Warnf("Failed starting %s: %v", name, err)
+		// A failed start is no stable run, so the backoff grows
+		s.started = time.Now()
+		sv.failed(name, s)
+		return
+	}
+	s.cmd = cmd
+	s.started = time.Now()
+	s.stopping = false
+	sv.setState(name, StateRunning)
+	go func() {
+		sv.exits <- supervisorExit{name, cmd.Wait()}
+	}()
+
+	h, err := readHealthcheck(sv.rootDir, name)
+	if err != nil {
+		log.Warnf("Not monitoring health of %s: %v", name, err)
+	} else if h != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancelMonitor = cancel
+		go func() {
+			err := monitorHealth(ctx, sv.rootDir, name, h, func() error {
+				// The monitor is cancelled once the service exits
+				select {
+				case sv.unhealthy <- name:
+				case <-ctx.Done():
+				}
+				return nil
+			})
+			if err != nil {
+				log.Warnf("Health monitor for %s failed: %v", name, err)
+			}
+		}()
+	}
+}
+
+// failed schedules a restart of @name with exponential backoff.
+func (sv *supervisor) failed(name string, s *supervised) {
+	if time.Since(s.started) > supervisorStableRun {
+		s.failures = 0
+	}
+	backoff := time.Second << s.failures
+	if backoff > supervisorMaxBackoff || backoff <= 0 {
+		backoff = supervisorMaxBackoff
+	} else {
+		s.failures++
+	}
+	s.nextStart = time.Now().Add(backoff)
+	log.Warnf("%s failed, restarting in %s", name, backoff)
+	sv.setState(name, StateFailed)
+}
+
+func (sv *supervisor) exited(e supervisorExit) {
+	s, ok := sv.services[e.name]
+	if !ok {
+		return
+	}
+	s.cmd = nil
+	if s.cancelMonitor != nil {
+		s.cancelMonitor()
+		s.cancelMonitor = nil
+	}
+	requested := PathExists(supervisorStopPath(sv.rootDir, e.name))
+	if requested {
+		os.Remove(supervisorStopPath(sv.rootDir, e.name))
+	}
+	if requested || !sv.wanted(e.name) {
+		log.Infof("%s stopped", e.name)
+		s.failures = 0
+		sv.setState(e.name, StateStopped)
+		return
+	}
+	if e.err != nil {
+		log.Warnf("%s exited: %v", e.name, e.err)
+	}
+	sv.failed(e.name, s)
+}
+
+// stop asks container @name to stop.  Its exit is handled by exited().
+func (sv *supervisor) stop(name string) {
+	s, ok := sv.services[name]
+	if !ok || s.cmd == nil || s.stopping {
+		return
+	}
+	s.stopping = true
+	go func() {
+		if err := RunCommand("lxc-stop", "-n", name); err != nil {
+			log.Warnf("Failed stopping %s: %v", name, err)
+		}
+	}()
+}
+
+// reconcile starts the wanted services whose dependencies are up, and
+// stops running services which are no longer wanted.
+func (sv *supervisor) reconcile() {
+	entries, err := os.ReadDir(supervisorRunDir(sv.rootDir))
+	if err != nil {
+		log.Warnf("Failed reading %q: %v", supervisorRunDir(sv.rootDir), err)
+		return
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".want") {
+			continue
+		}
+		name := strings.TrimSuffix(e.Name(), ".want")
+		if sv.running(name) {
+			continue
+		}
+		if s, ok := sv.services[name]; ok && time.Now().Before(s.nextStart) {
+			continue
+		}
+		ready := true
+		for _, d := range sv.readEnabled(name).After {
+			if sv.wanted(d) && !sv.running(d) {
+				ready = false
+			}
+		}
+		if ready {
+			sv.start(name)
+		}
+	}
+
+	for name, s := range sv.services {
+		if s.cmd != nil && !sv.wanted(name) {
+			sv.stop(name)
+		}
+	}
+}
+
+// RunSupervisor runs the enabled container services under @rootDir,
+// restarting them with backoff when they fail, until it is killed.  It
+// is run by 'mosctl supervise' on systems which use the supervisor init
+// type.
+func RunSupervisor(rootDir string) error {
+	if err := EnsureDir(supervisorRunDir(rootDir)); err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(supervisorEnabledDir(rootDir))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed reading enabled services: %w", err)
+	}
+	for _, e := range entries {
+		if err := os.WriteFile(supervisorWantPath(rootDir, e.Name()), []byte{}, 0644); err != nil {
+			return fmt.Errorf("Failed starting %s: %w", e.Name(), err)
+		}
+	}
+
+	sv := &supervisor{
+		rootDir:   rootDir,
+		services:  map[string]*supervised{},
+		exits:     make(chan supervisorExit),
+		unhealthy: make(chan string),
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	ticker := time.NewTicker(supervisorPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			sv.reconcile()
+		case e := <-sv.exits:
+			sv.exited(e)
+		case name := <-sv.unhealthy:
+			// exited() restarts it, since it is still wanted
+			sv.stop(name)
+		case sig := <-signals:
+			log.Infof("Got %s, stopping all services", sig)
+			return sv.shutdown()
+		}
+	}
+}
+
+// shutdown stops all running services, and waits for them to exit.
+func (sv *supervisor) shutdown() error {
+	remaining := 0
+	for name, s := range sv.services {
+		if s.cmd != nil {
+			sv.stop(name)
+			remaining++
+		}
+	}
+	for ; remaining > 0; remaining-- {
+		e := <-sv.exits
+		if s, ok := sv.services[e.name]; ok && s.cancelMonitor != nil {
+			s.cancelMonitor()
+		}
+		sv.setState(e.name, StateStopped)
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package mosconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+)
+
+// systemdInitmgr runs each container target as a systemd service.
+type systemdInitmgr struct {
+	rootDir string
+}
+
+func systemdStart(unitName string) error {
+	if err := RunCommand("systemctl", "enable", unitName); err != nil {
+		return fmt.Errorf("Failed enabling %s: %w", unitName, err)
+	}
+	if err := RunCommand("systemctl", "start", "--no-block", unitName); err != nil {
+		return fmt.Errorf("Failed starting %s: %w", unitName, err)
+	}
+	return nil
+}
+
+const execServiceTemplate = `
+[Unit]
+Description=%s
+DefaultDependencies=no
+After=network-online.target cloud-init.target
+Wants=network.target
+%s
+[Service]
+Restart=on-failure
+RestartSec=1
+ExecStart=/usr/bin/lxc-execute -n %s
+ExecStop=/usr/bin/lxc-stop -n %s
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const stopService = `
+[Unit]
+Description=Stop the %s container before shutdown
+DefaultDependencies=no
+Before=shutdown.target
+
+[Service]
+Type=oneshot
+ExecStart=/usr/bin/systemctl stop %s
+TimeoutStartSec=0
+
+[Install]
+WantedBy=shutdown.target
+`
+
+func (s *systemdInitmgr) unitPath(unitName string) string {
+	return filepath.Join(s.rootDir, "/etc", "systemd", "system", unitName)
+}
+
+func (s *systemdInitmgr) writeContainerService(t *Target) error {
+	unitName := fmt.Sprintf("%s.service", t.ServiceName)
+	dest := s.unitPath(unitName)
+	log.Infof("Writing container service at %q", dest)
+	os.Remove(dest)
+	content := []byte(fmt.Sprintf(execServiceTemplate, t.ServiceName, unitDependencies(t), t.ServiceName, t.ServiceName))
+	if err := os.WriteFile(dest, content, 0644); err != nil {
+		return fmt.Errorf("Failed writing systemd.service file for %q: %w", unitName, err)
+	}
+
+	return nil
+}
+
+func healthUnitName(name string) string {
+	return fmt.Sprintf("%s-health.service", name)
+}
+
+const healthServiceTemplate = `
+[Unit]
+Description=Health check for %s
+BindsTo=%s.service
+After=%s.service
+
+[Service]
+Restart=on-failure
+RestartSec=1
+ExecStart=%s health-monitor --root %s %s
+
+[Install]
+WantedBy=%s.service
+`
+
+// writeHealthService writes the systemd unit which runs @t's
+// healthcheck.  The unit is started and stopped along with @t's own.
+func (s *systemdInitmgr) writeHealthService(t *Target) error {
+	unitName := healthUnitName(t.ServiceName)
+	dest := s.unitPath(unitName)
+	if t.Healthcheck == nil {
+		if PathExists(dest) {
+			if err := RunCommand("systemctl", "disable", unitName); err != nil {
+				log.Warnf("Failed disabling %s: %v", unitName, err)
+			}
+			os.Remove(dest)
+		}
+		return nil
+	}
+
+	mosctl, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("Failed finding mosctl: %w", err)
+	}
+	n := t.ServiceName
+	content := []byte(fmt.Sprintf(healthServiceTemplate, n, n, n, mosctl, s.rootDir, n, n))
+	if err := os.WriteFile(dest, content, 0644); err != nil {
+		return fmt.Errorf("Failed writing systemd.service file for %q: %w", unitName, err)
+	}
+	if err := RunCommand("systemctl", "enable", unitName); err != nil {
+		return fmt.Errorf("Failed enabling %s: %w", unitName, err)
+	}
+	return nil
+}
+
+func (s *systemdInitmgr) Enable(t *Target) error {
+	if err := s.writeContainerService(t); err != nil {
+		return err
+	}
+	return s.writeHealthService(t)
+}
+
+func (s *systemdInitmgr) Start(t *Target) error {
+	return systemdStart(fmt.Sprintf("%s.service", t.ServiceName))
+}
+
+func (s *systemdInitmgr) Stop(t *Target) error {
+	unitName := fmt.Sprintf("%s.service", t.ServiceName)
+	out, rc := RunCommandWithRc("systemctl", "stop", unitName)
+	outs := string(out)
+	if rc != 0 && !strings.HasSuffix(outs, "not loaded.\n") {
+		return fmt.Errorf("Failed to stop service %s: %s", t.ServiceName, outs)
+	}
+	return nil
+}
+
+func (s *systemdInitmgr) Status(t *Target) (string, error) {
+	unitName := fmt.Sprintf("%s.service", t.ServiceName)
+	// is-active exits non-zero for anything but active
+	out, _ := RunCommandWithRc("systemctl", "is-active", unitName)
+	switch strings.TrimSpace(string(out)) {
+	case "active", "activating", "reloading":
+		return StateRunning, nil
+	case "failed":
+		return StateFailed, nil
+	default:
+		return StateStopped, nil
+	}
+}
+
+func (s *systemdInitmgr) Reboot(kexec bool) error {
+	// systemd loads the default boot loader entry for kexec
+	verb := "reboot"
+	if kexec {
+		verb = "kexec"
+	}
+	if err := RunCommand("systemctl", verb); err != nil {
+		return fmt.Errorf("Failed to %s: %w", verb, err)
+	}
+	return nil
+}
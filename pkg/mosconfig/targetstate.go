@@ -0,0 +1,91 @@
+package mosconfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The image which SetupTarget mounted for each target is recorded in
+// $scratch-writes/state/$service.yaml.  The mounts themselves only tell
+// us a layer (atomfs), or nothing at all (puzzlefs), and not which
+// version of the image that belongs to.
+type targetState struct {
+	ServiceName  string `yaml:"service_name"`
+	ImagePath    string `yaml:"imagepath"`
+	Version      string `yaml:"version"`
+	ManifestHash string `yaml:"manifest_hash"`
+
+	// What MountedByHash finds while the target is mounted, so that we
+	// can tell whether this record is still current.
+	MountHash string `yaml:"mount_hash"`
+}
+
+func targetStatePath(scratchPath, name string) string {
+	return filepath.Join(scratchPath, "state", name+".yaml")
+}
+
+func writeTargetState(scratchPath string, t *Target, mountHash string) error {
+	path := targetStatePath(scratchPath, t.ServiceName)
+	if err := EnsureDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	s := targetState{
+		ServiceName:  t.ServiceName,
+		ImagePath:    t.ImagePath,
+		Version:      t.Version,
+		ManifestHash: t.ManifestHash,
+		MountHash:    mountHash,
+	}
+	bytes, err := yaml.Marshal(&s)
+	if err != nil {
+		return fmt.Errorf("Failed marshalling state of %s: %w", t.ServiceName, err)
+	}
+	if err := os.WriteFile(path, bytes, 0644); err != nil {
+		return fmt.Errorf("Failed writing state of %s: %w", t.ServiceName, err)
+	}
+	return nil
+}
+
+// readTargetState returns the recorded state of target @name, or nil if
+// there is none.
+func readTargetState(scratchPath, name string) (*targetState, error) {
+	content, err := os.ReadFile(targetStatePath(scratchPath, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed reading state of %s: %w", name, err)
+	}
+	s := targetState{}
+	if err := yaml.Unmarshal(content, &s); err != nil {
+		return nil, fmt.Errorf("Failed parsing state of %s: %w", name, err)
+	}
+	return &s, nil
+}
+
+func removeTargetState(scratchPath, name string) error {
+	err := os.Remove(targetStatePath(scratchPath, name))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed removing state of %s: %w", name, err)
+	}
+	return nil
+}
+
+// recordedHash returns the manifest hash recorded for @t if the record
+// matches @mountHash, which MountedByHash found for it, else @mountHash.
+func recordedHash(scratchPath string, t *Target, mountHash string) (string, error) {
+	if mountHash == "" {
+		return "", nil
+	}
+	s, err := readTargetState(scratchPath, t.ServiceName)
+	if err != nil {
+		return "", err
+	}
+	if s == nil || s.ImagePath != t.ImagePath || s.MountHash != mountHash {
+		return mountHash, nil
+	}
+	return s.ManifestHash, nil
+}
@@ -3,13 +3,20 @@ package mosconfig
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 
+	"github.com/apex/log"
 	"github.com/lxc/lxd/shared/idmap"
+	"gopkg.in/yaml.v2"
 )
 
 type uidRangeDefaults struct {
-	SubidStart int64
-	SubidRange int64
+	SubidStart int64 `yaml:"start"`
+	SubidRange int64 `yaml:"range"`
 }
 
 var fullRangeDefaults = uidRangeDefaults{
@@ -46,42 +53,346 @@ func chooseRangeDefaults() uidRangeDefaults {
 	return tinyRangeDefaults
 }
 
-func firstUnusedUID(uidmaps []IdmapSet) int64 {
-	rangedefs := chooseRangeDefaults()
-	min := rangedefs.SubidStart
-	for _, u := range uidmaps {
-		if u.Hostid > min {
-			min = u.Hostid + rangedefs.SubidRange
+// The size of the host id range of @u.  System manifests written before
+// the range was recorded used the default range.
+func (u IdmapSet) size() int64 {
+	if u.Range != 0 {
+		return u.Range
+	}
+	return chooseRangeDefaults().SubidRange
+}
+
+// rangeDefaults returns where new nsgroup ranges are allocated, and
+// their size.  These can be set with 'start' and 'range' in
+// $config/subids.yaml.
+func (mos *Mos) rangeDefaults() (uidRangeDefaults, error) {
+	defs := chooseRangeDefaults()
+	path := filepath.Join(mos.opts.ConfigDir, "subids.yaml")
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return defs, nil
+		}
+		return defs, fmt.Errorf("Failed reading uid range configuration: %w", err)
+	}
+	if err := yaml.Unmarshal(content, &defs); err != nil {
+		return defs, fmt.Errorf("Failed parsing %q: %w", path, err)
+	}
+	if defs.SubidStart < 1 || defs.SubidRange < 1 {
+		return defs, fmt.Errorf("Bad uid range configuration in %q: %#v", path, defs)
+	}
+	return defs, nil
+}
+
+// An idRange is the range of host ids [start, start+size).
+type idRange struct {
+	start int64
+	size  int64
+}
+
+func (r idRange) overlaps(o idRange) bool {
+	return r.start < o.start+o.size && o.start < r.start+r.size
+}
+
+func (t IdType) uids() bool {
+	return t != IdGid
+}
+
+func (t IdType) gids() bool {
+	return t != IdUid
+}
+
+// Host ids below MinPassthroughId, such as root and the system users
+// and groups, may not be mapped through into a container.
+const MinPassthroughId = 1000
+
+// Ids are 32 bit, and (uid_t)-1 is never a valid id.
+const maxId = int64(1<<32 - 1)
+
+// ValidateIdmap checks that the target's idmap entries neither overlap
+// nor leave container root unmapped, and map no system ids through.
+func (t Target) ValidateIdmap() error {
+	if len(t.Idmap) == 0 {
+		return nil
+	}
+	if !t.NeedsIdmap() {
+		return fmt.Errorf("An idmap requires an nsgroup")
+	}
+
+	rootUid, rootGid := false, false
+	for i, e := range t.Idmap {
+		switch e.Type {
+		case "", IdBoth, IdUid, IdGid:
+		default:
+			return fmt.Errorf("Bad idmap type %q", e.Type)
+		}
+		if e.Nsid < 0 || e.Range < 1 || (e.Hostid != nil && *e.Hostid < 0) {
+			return fmt.Errorf("Bad idmap entry: nsid %d range %d", e.Nsid, e.Range)
+		}
+		if e.Range > maxId || e.Nsid > maxId-e.Range {
+			return fmt.Errorf("Bad idmap entry: container ids %d-%d are out of range", e.Nsid, e.Nsid+e.Range-1)
+		}
+		if e.Hostid != nil && *e.Hostid < MinPassthroughId {
+			return fmt.Errorf("Host id %d may not be mapped into a container, only ids from %d up", *e.Hostid, MinPassthroughId)
+		}
+		if e.Hostid != nil && *e.Hostid > maxId-e.Range {
+			return fmt.Errorf("Bad idmap entry: host ids %d-%d are out of range", *e.Hostid, *e.Hostid+e.Range-1)
+		}
+		ns := idRange{e.Nsid, e.Range}
+		for _, o := range t.Idmap[:i] {
+			if !(e.Type.uids() && o.Type.uids()) && !(e.Type.gids() && o.Type.gids()) {
+				continue
+			}
+			if ns.overlaps(idRange{o.Nsid, o.Range}) {
+				return fmt.Errorf("Container ids %d-%d are mapped twice", e.Nsid, e.Nsid+e.Range-1)
+			}
+			if e.Hostid == nil || o.Hostid == nil {
+				continue
+			}
+			if (idRange{*e.Hostid, e.Range}).overlaps(idRange{*o.Hostid, o.Range}) {
+				return fmt.Errorf("Host ids %d-%d are mapped twice", *e.Hostid, *e.Hostid+e.Range-1)
+			}
+		}
+		if e.Nsid == 0 {
+			rootUid = rootUid || e.Type.uids()
+			rootGid = rootGid || e.Type.gids()
+		}
+	}
+	if !rootUid || !rootGid {
+		return fmt.Errorf("Container uid and gid 0 must be mapped")
+	}
+	return nil
+}
+
+// validateNSGroups checks that all targets in an nsgroup have the same
+// idmap.
+func (ts InstallTargets) validateNSGroups() error {
+	idmaps := map[string][]IdmapSpec{}
+	for _, t := range ts {
+		if !t.NeedsIdmap() {
+			continue
+		}
+		if prev, ok := idmaps[t.NSGroup]; ok && !reflect.DeepEqual(prev, t.Idmap) {
+			return fmt.Errorf("Targets in nsgroup %s have different idmaps", t.NSGroup)
+		}
+		idmaps[t.NSGroup] = t.Idmap
+	}
+	return nil
+}
+
+// resolveIdmap returns the entries of @specs for an nsgroup whose host
+// range starts at @hostid, and the size which that range needs to have.
+func resolveIdmap(hostid int64, specs []IdmapSpec) ([]IdmapEntry, int64) {
+	if len(specs) == 0 {
+		return nil, 0
+	}
+	entries := []IdmapEntry{}
+	size := int64(0)
+	for _, s := range specs {
+		e := IdmapEntry{Type: s.Type, Nsid: s.Nsid, Range: s.Range}
+		if e.Type == "" {
+			e.Type = IdBoth
+		}
+		if s.Hostid != nil {
+			e.Hostid = *s.Hostid
+		} else {
+			e.Hostid = hostid + s.Nsid
+			if s.Nsid+s.Range > size {
+				size = s.Nsid + s.Range
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, size
+}
+
+// fixedHostRanges returns the host ids which @specs map through.
+func fixedHostRanges(specs []IdmapSpec) []idRange {
+	ranges := []idRange{}
+	for _, s := range specs {
+		if s.Hostid != nil {
+			ranges = append(ranges, idRange{*s.Hostid, s.Range})
+		}
+	}
+	return ranges
+}
+
+// entries returns the nsgroup's idmap.
+func (u IdmapSet) entries() []IdmapEntry {
+	if len(u.Entries) != 0 {
+		return u.Entries
+	}
+	return []IdmapEntry{{Type: IdBoth, Nsid: 0, Hostid: u.Hostid, Range: u.size()}}
+}
+
+func (u IdmapSet) lxdIdmap() idmap.IdmapSet {
+	set := idmap.IdmapSet{
+		Idmap: []idmap.IdmapEntry{},
+	}
+	for _, e := range u.entries() {
+		set.Idmap = append(set.Idmap, idmap.IdmapEntry{
+			Isuid:    e.Type.uids(),
+			Isgid:    e.Type.gids(),
+			Hostid:   e.Hostid,
+			Nsid:     e.Nsid,
+			Maprange: e.Range,
+		})
+	}
+	return set
+}
+
+// fits returns true if @t's idmap can be resolved within @u's host range.
+func (u IdmapSet) fits(t Target) bool {
+	_, need := resolveIdmap(u.Hostid, t.Idmap)
+	if need > u.size() {
+		return false
+	}
+	for _, r := range fixedHostRanges(t.Idmap) {
+		if r.overlaps(idRange{u.Hostid, u.size()}) {
+			return false
+		}
+	}
+	return true
+}
+
+// uidAllocator hands out host id ranges to new nsgroups, avoiding those
+// which are reserved.
+type uidAllocator struct {
+	defs     uidRangeDefaults
+	reserved []idRange
+}
+
+// uidAllocator returns an allocator which avoids all ranges listed in
+// /etc/subuid and /etc/subgid.
+func (mos *Mos) uidAllocator() (uidAllocator, error) {
+	defs, err := mos.rangeDefaults()
+	if err != nil {
+		return uidAllocator{}, err
+	}
+	alloc := uidAllocator{defs: defs}
+	for _, f := range []string{mos.subuidPath(), mos.subgidPath()} {
+		entries, err := readSubids(f)
+		if err != nil {
+			return uidAllocator{}, err
+		}
+		for _, e := range entries {
+			alloc.reserved = append(alloc.reserved, e.idRange)
+		}
+	}
+	return alloc, nil
+}
+
+// firstUnused returns the lowest start of a free range of @size ids
+// which overlaps none of @used.
+func (alloc uidAllocator) firstUnused(used []idRange, size int64) int64 {
+	all := append(append([]idRange{}, alloc.reserved...), used...)
+	sort.Slice(all, func(i, j int) bool { return all[i].start < all[j].start })
+
+	start := alloc.defs.SubidStart
+	for _, r := range all {
+		if r.start+r.size <= start {
+			continue
+		}
+		if r.start >= start+size {
+			break
+		}
+		start = r.start + r.size
+	}
+	return start
+}
+
+// checkFixedHostRanges returns an error if the host ids which @t maps
+// through are used by any nsgroup in @sets other than @t's own, or are
+// reserved in /etc/subuid or subgid.
+func (alloc uidAllocator) checkFixedHostRanges(sets []IdmapSet, t Target) error {
+	for _, r := range fixedHostRanges(t.Idmap) {
+		for _, u := range sets {
+			if u.Name == t.NSGroup {
+				continue
+			}
+			used := []idRange{{u.Hostid, u.size()}}
+			for _, e := range u.Entries {
+				used = append(used, idRange{e.Hostid, e.Range})
+			}
+			for _, o := range used {
+				if r.overlaps(o) {
+					return fmt.Errorf("Host ids %d-%d mapped by %s are used by nsgroup %s", r.start, r.start+r.size-1, t.ServiceName, u.Name)
+				}
+			}
+		}
+		for _, o := range alloc.reserved {
+			if r.overlaps(o) {
+				return fmt.Errorf("Host ids %d-%d mapped by %s are reserved in /etc/subuid or /etc/subgid", r.start, r.start+r.size-1, t.ServiceName)
+			}
 		}
 	}
-	return min
+	return nil
 }
 
-func addUIDMap(old []IdmapSet, uidmaps []IdmapSet, t Target) []IdmapSet {
+func (alloc uidAllocator) addUIDMap(old []IdmapSet, uidmaps []IdmapSet, t Target) ([]IdmapSet, error) {
 	if !t.NeedsIdmap() {
-		return uidmaps
+		return uidmaps, nil
+	}
+	if err := alloc.checkFixedHostRanges(append(append([]IdmapSet{}, old...), uidmaps...), t); err != nil {
+		return uidmaps, err
 	}
 	for _, u := range uidmaps {
 		if u.Name == t.NSGroup {
-			// use the nsgroup already defined in system manifest
-			return uidmaps
+			// another target already set up this nsgroup
+			entries, _ := resolveIdmap(u.Hostid, t.Idmap)
+			if !reflect.DeepEqual(entries, u.Entries) {
+				return uidmaps, fmt.Errorf("Target %s has a different idmap from the rest of nsgroup %s", t.ServiceName, t.NSGroup)
+			}
+			return uidmaps, nil
 		}
 	}
 
 	for _, u := range old {
-		if u.Name == t.NSGroup {
+		if u.Name == t.NSGroup && u.fits(t) {
 			// use the nsgroup already defined in system manifest
-			return append(uidmaps, u)
+			u.Entries, _ = resolveIdmap(u.Hostid, t.Idmap)
+			return append(uidmaps, u), nil
 		}
 	}
 
-	// Create a new idmap range
+	// Create a new idmap range which overlaps neither the ranges of
+	// other nsgroups, old or new, nor any in /etc/subuid or subgid,
+	// nor the host ids which are mapped through.
+	used := fixedHostRanges(t.Idmap)
+	for _, u := range append(append([]IdmapSet{}, old...), uidmaps...) {
+		used = append(used, idRange{u.Hostid, u.size()})
+		for _, e := range u.Entries {
+			used = append(used, idRange{e.Hostid, e.Range})
+		}
+	}
+	_, size := resolveIdmap(0, t.Idmap)
+	if size < alloc.defs.SubidRange {
+		size = alloc.defs.SubidRange
+	}
 	uidmap := IdmapSet{
 		Name:   t.NSGroup,
-		Hostid: firstUnusedUID(uidmaps),
+		Hostid: alloc.firstUnused(used, size),
+		Range:  size,
 	}
+	uidmap.Entries, _ = resolveIdmap(uidmap.Hostid, t.Idmap)
 	uidmaps = append(uidmaps, uidmap)
-	return uidmaps
+	return uidmaps, nil
+}
+
+// nsgroupIdmap returns the system manifest's idmap for @t's nsgroup.
+func (mos *Mos) nsgroupIdmap(t *Target) (IdmapSet, error) {
+	manifest, err := mos.CurrentManifest()
+	if err != nil {
+		return IdmapSet{}, fmt.Errorf("Error opening manifest: %w", err)
+	}
+
+	for _, u := range manifest.UidMaps {
+		if u.Name == t.NSGroup {
+			return u, nil
+		}
+	}
+
+	return IdmapSet{}, fmt.Errorf("Error finding UID Mapping for %s", t.ServiceName)
 }
 
 // The install/upgrade step should have created an idmap
@@ -90,49 +401,296 @@ func (mos *Mos) GetUIDMapStr(t *Target) (idmap.IdmapSet, []string, error) {
 	empty := idmap.IdmapSet{
 		Idmap: []idmap.IdmapEntry{},
 	}
-	manifest, err := mos.CurrentManifest()
+	u, err := mos.nsgroupIdmap(t)
 	if err != nil {
-		return empty, []string{}, fmt.Errorf("Error opening manifest: %w", err)
+		return empty, []string{}, err
 	}
-	rangedefs := chooseRangeDefaults()
 
-	for _, u := range manifest.UidMaps {
-		if u.Name == t.NSGroup {
-			uidmap := idmap.IdmapEntry{
-				Isuid:    true,
-				Isgid:    true,
-				Hostid:   u.Hostid,
-				Nsid:     0,
-				Maprange: rangedefs.SubidRange,
-			}
-			set := idmap.IdmapSet{
-				Idmap: []idmap.IdmapEntry{uidmap},
+	set := u.lxdIdmap()
+	return set, set.ToLxcString(), nil
+}
+
+// Containers run as root, so the nsgroup ranges are allocated to root
+// in /etc/subuid and /etc/subgid.
+const subidOwner = "root"
+
+func (mos *Mos) subuidPath() string {
+	return filepath.Join(mos.opts.RootDir, "etc/subuid")
+}
+
+func (mos *Mos) subgidPath() string {
+	return filepath.Join(mos.opts.RootDir, "etc/subgid")
+}
+
+// A subidEntry is one 'name:start:count' line of /etc/subuid or subgid.
+type subidEntry struct {
+	name string
+	idRange
+}
+
+func readSubids(path string) ([]subidEntry, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed reading %q: %w", path, err)
+	}
+	entries := []subidEntry{}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) != 3 {
+			continue
+		}
+		start, err1 := strconv.ParseInt(fields[1], 10, 64)
+		size, err2 := strconv.ParseInt(fields[2], 10, 64)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		entries = append(entries, subidEntry{fields[0], idRange{start, size}})
+	}
+	return entries, nil
+}
+
+// updateSubids adds (or with @remove, removes) the entry @e in the
+// subid file @path.  Other lines are left as they are, and the file is
+// only rewritten if it changes.
+func updateSubids(path string, e subidEntry, remove bool) error {
+	content, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("Failed reading %q: %w", path, err)
+	}
+
+	want := fmt.Sprintf("%s:%d:%d", e.name, e.start, e.size)
+	lines := []string{}
+	found := false
+	for _, line := range strings.Split(strings.TrimSuffix(string(content), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.TrimSpace(line) == want {
+			found = true
+			if remove {
+				continue
 			}
-			return set, uidmap.ToLxcString(), nil
 		}
+		lines = append(lines, line)
+	}
+	// Nothing to do if the entry is already present (or absent)
+	if found != remove {
+		return nil
+	}
+	if !remove {
+		lines = append(lines, want)
+	}
+
+	if err := EnsureDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	tmp := path + ".mos-new"
+	data := []byte(strings.Join(lines, "\n") + "\n")
+	if len(lines) == 0 {
+		data = []byte{}
+	}
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("Failed writing %q: %w", tmp, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("Failed updating %q: %w", path, err)
 	}
+	return nil
+}
 
-	return empty, []string{}, fmt.Errorf("Error finding UID Mapping for %s", t.ServiceName)
+// updateSubidEntries allocates (or with @remove, releases) nsgroup
+// range @u to root in /etc/subuid and /etc/subgid.
+func (mos *Mos) updateSubidEntries(u IdmapSet, remove bool) error {
+	action := "adding"
+	if remove {
+		action = "releasing"
+	}
+	e := subidEntry{subidOwner, idRange{u.Hostid, u.size()}}
+	if err := updateSubids(mos.subuidPath(), e, remove); err != nil {
+		return fmt.Errorf("Error %s subuid allocation of %s: %w", action, u.Name, err)
+	}
+	if err := updateSubids(mos.subgidPath(), e, remove); err != nil {
+		return fmt.Errorf("Error %s subgid allocation of %s: %w", action, u.Name, err)
+	}
+	return nil
 }
 
-func addUidMapping(set idmap.IdmapSet) error {
-	for _, u := range set.Idmap {
-		// In atomix we wrote /etc/subuid by hand.  Here we are
-		// calling out to usermod.  Not sure which is the "better"
-		// way.
-		first := u.Hostid
-		last := first + u.Maprange - 1
-		r := fmt.Sprintf("%d-%d", first, last)
+// addUidMapping makes sure that the host range of @t's nsgroup is
+// allocated to root in /etc/subuid and /etc/subgid.  Host ids which are
+// mapped through are not added.
+func (mos *Mos) addUidMapping(t *Target) error {
+	u, err := mos.nsgroupIdmap(t)
+	if err != nil {
+		return err
+	}
+	return mos.updateSubidEntries(u, false)
+}
 
-		cmdStr := []string{"usermod", "-v", r, "root"}
-		if err := RunCommand(cmdStr...); err != nil {
-			return fmt.Errorf("Error adding subuid allocation: %w", err)
-		}
-		cmdStr = []string{"usermod", "-w", r, "root"}
-		if err := RunCommand(cmdStr...); err != nil {
-			return fmt.Errorf("Error adding subgid allocation: %w", err)
+// The nsgroup ranges which the system manifest no longer has, but which
+// may still be in use by running containers, are listed in
+// $config/dropped-idmaps.yaml until they are released.
+func droppedIdmapsPath(configDir string) string {
+	return filepath.Join(configDir, "dropped-idmaps.yaml")
+}
+
+func readDroppedIdmaps(configDir string) ([]IdmapSet, error) {
+	dropped := []IdmapSet{}
+	content, err := os.ReadFile(droppedIdmapsPath(configDir))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return dropped, nil
 		}
+		return nil, fmt.Errorf("Failed reading dropped idmaps: %w", err)
 	}
+	if err := yaml.Unmarshal(content, &dropped); err != nil {
+		return nil, fmt.Errorf("Failed parsing dropped idmaps: %w", err)
+	}
+	return dropped, nil
+}
 
+func writeDroppedIdmaps(configDir string, dropped []IdmapSet) error {
+	path := droppedIdmapsPath(configDir)
+	if len(dropped) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed removing dropped idmaps: %w", err)
+		}
+		return nil
+	}
+	bytes, err := yaml.Marshal(dropped)
+	if err != nil {
+		return fmt.Errorf("Failed marshalling dropped idmaps: %w", err)
+	}
+	if err := os.WriteFile(path, bytes, 0644); err != nil {
+		return fmt.Errorf("Failed writing dropped idmaps: %w", err)
+	}
 	return nil
 }
+
+// hasIdmap returns true if @sets has nsgroup @u with the same host range.
+func hasIdmap(sets []IdmapSet, u IdmapSet) bool {
+	for _, s := range sets {
+		if s.Name == u.Name && s.Hostid == u.Hostid && s.size() == u.size() {
+			return true
+		}
+	}
+	return false
+}
+
+// dropIdmaps queues the nsgroup ranges of @old which are not in @updated
+// to be released, and then reconciles the subid allocations.
+func (mos *Mos) dropIdmaps(old, updated *SysManifest) error {
+	dropped, err := readDroppedIdmaps(mos.opts.ConfigDir)
+	if err != nil {
+		return err
+	}
+	for _, u := range old.UidMaps {
+		if !hasIdmap(updated.UidMaps, u) && !hasIdmap(dropped, u) {
+			dropped = append(dropped, u)
+		}
+	}
+	if err := writeDroppedIdmaps(mos.opts.ConfigDir, dropped); err != nil {
+		return err
+	}
+	return mos.releaseIdmaps()
+}
+
+// releaseIdmaps reconciles /etc/subuid and /etc/subgid with the system
+// manifest.  Its nsgroup ranges are allocated, including any which a
+// rollback brought back, while dropped ranges are released once no
+// running container uses them.
+func (mos *Mos) releaseIdmaps() error {
+	manifest, err := mos.CurrentManifest()
+	if err != nil {
+		return err
+	}
+	dropped, err := readDroppedIdmaps(mos.opts.ConfigDir)
+	if err != nil {
+		return err
+	}
+	inUse, err := mos.runningIdRanges()
+	if err != nil {
+		return err
+	}
+
+	kept := []IdmapSet{}
+	for _, u := range dropped {
+		if hasIdmap(manifest.UidMaps, u) {
+			continue
+		}
+		r := idRange{u.Hostid, u.size()}
+		busy := false
+		for _, o := range inUse {
+			busy = busy || r.overlaps(o)
+		}
+		if busy {
+			log.Infof("Not releasing the ids of nsgroup %s, which are still in use", u.Name)
+			kept = append(kept, u)
+			continue
+		}
+		if err := mos.updateSubidEntries(u, true); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range manifest.UidMaps {
+		if err := mos.updateSubidEntries(u, false); err != nil {
+			return err
+		}
+	}
+
+	return writeDroppedIdmaps(mos.opts.ConfigDir, kept)
+}
+
+// runningIdRanges returns the host id ranges which are mapped into
+// running containers.
+func (mos *Mos) runningIdRanges() ([]idRange, error) {
+	lxcDir := filepath.Join(mos.opts.RootDir, "var/lib/lxc")
+	dirs, err := os.ReadDir(lxcDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed reading %q: %w", lxcDir, err)
+	}
+
+	ranges := []idRange{}
+	for _, d := range dirs {
+		content, err := os.ReadFile(filepath.Join(lxcDir, d.Name(), "config"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("Failed reading container config for %s: %w", d.Name(), err)
+		}
+		out, rc := RunCommandWithRc("lxc-info", "-H", "-n", d.Name(), "-s")
+		if rc != 0 || strings.TrimSpace(string(out)) != "RUNNING" {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			key, value, found := strings.Cut(line, "=")
+			if !found || strings.TrimSpace(key) != "lxc.idmap" {
+				continue
+			}
+			// u|g nsid hostid range
+			fields := strings.Fields(value)
+			if len(fields) != 4 {
+				continue
+			}
+			start, err1 := strconv.ParseInt(fields[2], 10, 64)
+			size, err2 := strconv.ParseInt(fields[3], 10, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			ranges = append(ranges, idRange{start, size})
+		}
+	}
+	return ranges, nil
+}
@@ -5,11 +5,73 @@ import (
 	"os"
 	"path/filepath"
 
+	"github.com/apex/log"
+	"github.com/go-git/go-git/v5/plumbing"
 	"gopkg.in/yaml.v2"
 )
 
+// Update the system to the install manifest @filename.  The new system
+// manifest only replaces the current one once all targets have been
+// imported and verified.
 func (mos *Mos) Update(filename string) error {
-	filename, err := filepath.Abs(filename)
+	old, err := mos.CurrentManifest()
+	if err != nil {
+		return err
+	}
+	if err := mos.update(filename, plumbing.Master); err != nil {
+		return err
+	}
+	return mos.finishUpdate(old)
+}
+
+// finishUpdate cleans up after the update from system manifest @old to
+// the current one, once it is in use: the nsgroup ranges which it drops
+// are queued to be released.  The volumes of dropped targets are kept
+// for rollback, until GC.
+func (mos *Mos) finishUpdate(old *SysManifest) error {
+	updated, err := mos.CurrentManifest()
+	if err != nil {
+		return err
+	}
+	return mos.dropIdmaps(old, updated)
+}
+
+// StageUpdate imports and verifies the update in @filename like Update,
+// but only makes it the current system manifest once it has been booted
+// and confirmed with ConfirmBoot.  If it fails to boot @bootTries times,
+// BootTarget falls back to the current system manifest.
+func (mos *Mos) StageUpdate(filename string, bootTries int) error {
+	if bootTries <= 0 {
+		return fmt.Errorf("Boot tries must be positive")
+	}
+	if err := mos.update(filename, pendingBranch); err != nil {
+		return err
+	}
+
+	// The boot tries are only written once the update is pending, so
+	// that a failed update does not touch those of another.
+	if err := mos.writeBootTries(bootTries); err != nil {
+		mPath := filepath.Join(mos.opts.ConfigDir, "manifest.git")
+		if repo, _, oerr := openManifestRepo(mPath); oerr == nil {
+			if derr := mos.dropPending(repo); derr != nil {
+				log.Warnf("Failed dropping the pending update: %v", derr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func (mos *Mos) update(filename string, branch plumbing.ReferenceName) error {
+	pending, err := mos.HasPending()
+	if err != nil {
+		return err
+	}
+	if pending {
+		return fmt.Errorf("An update is pending boot, confirm or roll it back first")
+	}
+
+	filename, err = filepath.Abs(filename)
 	if err != nil {
 		return fmt.Errorf("Failed to make absolute pathname for install file: %w", err)
 	}
@@ -30,11 +92,37 @@ func (mos *Mos) Update(filename string) error {
 		return fmt.Errorf("Failed calculating shasum: %w", err)
 	}
 
-	newIF, err := ReadVerifyManifest(filename, cPath, mos.opts.CaPath, baseDir, mos.storage)
+	cf, err := simpleParseInstall(filename)
+	if err != nil {
+		return fmt.Errorf("Failed parsing install manifest: %w", err)
+	}
+	if cf.StorageType != "" && cf.StorageType != mos.storage.Type() {
+		return fmt.Errorf("Install manifest is for %s storage, but this system uses %s", cf.StorageType, mos.storage.Type())
+	}
+
+	// Images are shipped next to the install manifest, unless we
+	// were told to pull them from a registry.
+	src := baseDir
+	if mos.opts.Registry.Base != "" {
+		src = mos.opts.Registry.Base
+	}
+
+	policy, err := mos.signerPolicy(mos.opts.CaPath)
+	if err != nil {
+		return err
+	}
+	newIF, err := ReadVerifyManifest(filename, cPath, mos.opts.CaPath, src, mos.storage, SignerCheck{Policy: policy})
 	if err != nil {
 		return fmt.Errorf("Failed verifying signature on %s: %w", filename, err)
 	}
 
+	if err := mos.checkProduct(newIF.Product); err != nil {
+		return err
+	}
+	if err := mos.checkDowngrade(manifest, &newIF, cPath); err != nil {
+		return fmt.Errorf("Refusing update: %w", err)
+	}
+
 	// The shasum-named install.yaml which we'll place in
 	// /config/manifest.git
 	mFile := fmt.Sprintf("%s.yaml", shaSum)
@@ -43,19 +131,25 @@ func (mos *Mos) Update(filename string) error {
 
 	newtargets := SysTargets{}
 
-	for _, t := range newIF.Targets {
+	for i := range newIF.Targets {
+		t := &newIF.Targets[i]
 		newT := SysTarget{
 			Name:   t.ServiceName,
 			Source: mFile,
-			raw:    &t,
+			raw:    t,
 		}
 		newtargets = append(newtargets, newT)
-		if err := mos.storage.ImportTarget(baseDir, &t); err != nil {
+		if err := mos.storage.ImportTarget(src, t); err != nil {
 			return fmt.Errorf("Failed copying %s: %w", newT.Name, err)
 		}
 	}
 
-	sysmanifest, err := mergeUpdateTargets(manifest, newtargets, newIF.UpdateType)
+	alloc, err := mos.uidAllocator()
+	if err != nil {
+		return err
+	}
+
+	sysmanifest, err := mergeUpdateTargets(manifest, newtargets, newIF.UpdateType, alloc)
 	if err != nil {
 		return err
 	}
@@ -91,17 +185,28 @@ func (mos *Mos) Update(filename string) error {
 		return fmt.Errorf("Failed writing system manifest: %w", err)
 	}
 
-	if err = mos.UpdateManifest(manifest, &sysmanifest, tmpdir); err != nil {
+	msg, err := revisionMessage(manifestRelease{
+		Action:   ActionUpdate,
+		Manifest: mFile,
+		Product:  newIF.Product,
+		Serial:   newIF.Serial,
+		CertPath: cPath,
+	}, diffTargets(sysTargetMap(manifest), sysTargetMap(&sysmanifest)))
+	if err != nil {
 		return err
 	}
 
-	return nil
+	if err = mos.UpdateManifest(manifest, &sysmanifest, tmpdir, msg, branch); err != nil {
+		return err
+	}
+
+	return recordReleaseSerial(mos.opts.ConfigDir, newIF.Product, newIF.Serial)
 }
 
 // Any target in old which is also listed in updated, gets
 // switched for the one in updated.  Any target in updated
 // which is not in old gets appended.
-func mergeUpdateTargets(old *SysManifest, updated SysTargets, updateType UpdateType) (SysManifest, error) {
+func mergeUpdateTargets(old *SysManifest, updated SysTargets, updateType UpdateType, alloc uidAllocator) (SysManifest, error) {
 	newtargets := SysTargets{}
 	if updateType == PartialUpdate {
 		for _, t := range old.SysTargets {
@@ -115,9 +220,24 @@ func mergeUpdateTargets(old *SysManifest, updated SysTargets, updateType UpdateT
 		newtargets = append(newtargets, t)
 	}
 
+	raws := []*Target{}
+	for _, t := range newtargets {
+		raws = append(raws, t.raw)
+	}
+	if err := validateDependencies(raws); err != nil {
+		return SysManifest{}, err
+	}
+	if err := validateHostPorts(raws); err != nil {
+		return SysManifest{}, err
+	}
+
+	var err error
 	uidmaps := []IdmapSet{}
 	for _, t := range newtargets {
-		uidmaps = addUIDMap(old.UidMaps, uidmaps, *t.raw)
+		uidmaps, err = alloc.addUIDMap(old.UidMaps, uidmaps, *t.raw)
+		if err != nil {
+			return SysManifest{}, err
+		}
 	}
 
 	return SysManifest{
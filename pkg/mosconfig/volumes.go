@@ -0,0 +1,195 @@
+package mosconfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/apex/log"
+	"github.com/lxc/lxd/shared/idmap"
+)
+
+// A VolumeSpec is a persistent, writeable directory which is mounted
+// into a target on every activation.  Its contents survive updates of
+// the target's image, and are only removed by GC once no system manifest
+// which it keeps for rollback lists the target.
+type VolumeSpec struct {
+	Name string `yaml:"name"`
+	Dest string `yaml:"dest"`
+}
+
+func (v *VolumeSpec) Validate() error {
+	// Names starting with '.' are kept for our own use
+	if v.Name == "" || strings.HasPrefix(v.Name, ".") || strings.ContainsAny(v.Name, "/ \t\n") {
+		return fmt.Errorf("Bad volume name %q", v.Name)
+	}
+	if err := validateMountPath(v.Dest); err != nil {
+		return fmt.Errorf("Bad dest for volume %q: %w", v.Name, err)
+	}
+	if filepath.Clean(v.Dest) == "/" {
+		return fmt.Errorf("Volume %q cannot be mounted over the target's root directory", v.Name)
+	}
+	return nil
+}
+
+func (t Target) ValidateVolumes() error {
+	seen := map[string]bool{}
+	for _, v := range t.Volumes {
+		if err := v.Validate(); err != nil {
+			return err
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("Volume %q is defined twice", v.Name)
+		}
+		seen[v.Name] = true
+	}
+	return nil
+}
+
+// Volumes for target @service live under $config/data/@service/.
+func (mos *Mos) volumesDir(service string) string {
+	return filepath.Join(mos.opts.ConfigDir, "data", service)
+}
+
+// The idmap which volume @name of target @service is shifted into is
+// recorded in $config/data/@service/.idmap/@name.json.
+func (mos *Mos) volumeIdmapPath(service, name string) string {
+	return filepath.Join(mos.volumesDir(service), ".idmap", name+".json")
+}
+
+func (mos *Mos) readVolumeIdmap(service, name string) (*idmap.IdmapSet, error) {
+	content, err := os.ReadFile(mos.volumeIdmapPath(service, name))
+	if err != nil {
+		return nil, err
+	}
+	var set idmap.IdmapSet
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, fmt.Errorf("Failed parsing idmap of volume %q for %s: %w", name, service, err)
+	}
+	return &set, nil
+}
+
+func (mos *Mos) writeVolumeIdmap(service, name string, set *idmap.IdmapSet) error {
+	path := mos.volumeIdmapPath(service, name)
+	if err := EnsureDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	content, err := json.Marshal(set)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, 0644)
+}
+
+// ensureVolume returns the host path for volume @v of target @t, creating
+// it if needed.  The volume's files are owned by ids in @set, which is nil
+// if the target's ids are not mapped.  If the volume was last used with
+// another idmap, such as after a change of the target's nsgroup, its
+// files are shifted from that idmap into @set.
+func (mos *Mos) ensureVolume(t *Target, v VolumeSpec, set *idmap.IdmapSet) (string, error) {
+	if set == nil {
+		set = &idmap.IdmapSet{}
+	}
+
+	path := filepath.Join(mos.volumesDir(t.ServiceName), v.Name)
+	old, err := mos.readVolumeIdmap(t.ServiceName, v.Name)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if !PathExists(path) {
+		if err := EnsureDir(path); err != nil {
+			return "", fmt.Errorf("Failed creating volume %q for %s: %w", v.Name, t.ServiceName, err)
+		}
+		old = &idmap.IdmapSet{}
+	} else if old == nil {
+		// Volumes created before their idmap was recorded were
+		// only ever used with the target's current idmap.
+		old = set
+	}
+
+	if !old.Equals(set) {
+		log.Infof("Shifting volume %q for %s into its new idmap", v.Name, t.ServiceName)
+		if len(old.Idmap) != 0 {
+			if err := old.UnshiftRootfs(path, nil); err != nil {
+				return "", fmt.Errorf("Failed unshifting volume %q for %s: %w", v.Name, t.ServiceName, err)
+			}
+		}
+		if len(set.Idmap) != 0 {
+			if err := set.ShiftRootfs(path, nil); err != nil {
+				return "", fmt.Errorf("Failed shifting volume %q for %s: %w", v.Name, t.ServiceName, err)
+			}
+		}
+	}
+	if err := mos.writeVolumeIdmap(t.ServiceName, v.Name, set); err != nil {
+		return "", fmt.Errorf("Failed recording idmap of volume %q for %s: %w", v.Name, t.ServiceName, err)
+	}
+	return path, nil
+}
+
+// Return the lxc.mount.entry lines for a container target's volumes.
+// Their destinations are created under @rootfs if @create is true.
+func (mos *Mos) lxcVolumeEntries(t *Target, rootfs string, set *idmap.IdmapSet, create bool) ([]string, error) {
+	entries := []string{}
+	for _, v := range t.Volumes {
+		src, err := mos.ensureVolume(t, v, set)
+		if err != nil {
+			return entries, err
+		}
+		entry, err := lxcMountEntry(rootfs, src, &MountSpec{Source: src, Dest: v.Dest}, create)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Mount an fs-only target's volumes under @rootfs.
+func (mos *Mos) bindVolumes(t *Target, rootfs string) error {
+	for _, v := range t.Volumes {
+		src, err := mos.ensureVolume(t, v, nil)
+		if err != nil {
+			return err
+		}
+		if err := bindMount(rootfs, src, &MountSpec{Source: src, Dest: v.Dest}); err != nil {
+			return fmt.Errorf("Failed mounting volume %q: %w", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// gcVolumes removes the volumes of the targets which none of @keep
+// lists.  Those of a container which is still running are left until
+// it has stopped.
+func (mos *Mos) gcVolumes(keep []*Target) error {
+	dataDir := filepath.Join(mos.opts.ConfigDir, "data")
+	entries, err := os.ReadDir(dataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Failed reading %q: %w", dataDir, err)
+	}
+
+	kept := map[string]bool{}
+	for _, t := range keep {
+		kept[t.ServiceName] = true
+	}
+	for _, e := range entries {
+		if !e.IsDir() || kept[e.Name()] {
+			continue
+		}
+		out, rc := RunCommandWithRc("lxc-info", "-H", "-n", e.Name(), "-s")
+		if rc == 0 && strings.TrimSpace(string(out)) == "RUNNING" {
+			log.Infof("Keeping volumes for dropped target %s until it stops", e.Name())
+			continue
+		}
+		log.Infof("Removing volumes for dropped target %s", e.Name())
+		if err := os.RemoveAll(filepath.Join(dataDir, e.Name())); err != nil {
+			return fmt.Errorf("Failed removing volumes for %s: %w", e.Name(), err)
+		}
+	}
+	return nil
+}
@@ -36,3 +36,117 @@ EOF
 @test "activate of hostfs layer" {
 	good_install hostfsonly
 }
+
+function install_fsonly_with_mount {
+	src=$1
+	dest=${2:-/tmp}
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF2
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: hostfstarget
+    imagepath: puzzleos/hostfstarget
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: fs-only
+    nsgroup: ""
+    network:
+      type: none
+    mounts:
+      - source: $src
+        dest: $dest
+        options: ro
+EOF2
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfstarget
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml
+}
+
+@test "activate of fs-only layer with a bind mount" {
+	install_fsonly_with_mount /data/shared
+	mkdir -p $TMPD/data/shared
+	echo hello > $TMPD/data/shared/hello
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/manifestCA.pem
+[ -e $TMPD/mnt/atom/hostfstarget/etc ]
+grep hello $TMPD/mnt/atom/hostfstarget/tmp/hello
+failed=0
+echo testing > $TMPD/mnt/atom/hostfstarget/tmp/newfile || failed=1
+[ $failed -eq 1 ]
+killall squashfuse || true
+XXX
+EOF
+}
+
+@test "activate of fs-only layer with a disallowed bind mount fails" {
+	install_fsonly_with_mount /etc
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+failed=0
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/manifestCA.pem || failed=1
+killall squashfuse || true
+[ $failed -eq 1 ]
+XXX
+EOF
+}
+
+@test "activate of fs-only layer with a bind mount onto a missing path fails" {
+	install_fsonly_with_mount /data/shared /srv/shared
+	mkdir -p $TMPD/data/shared
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+failed=0
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/manifestCA.pem 2> $TMPD/activate.err || failed=1
+killall squashfuse || true
+cat $TMPD/activate.err
+[ $failed -eq 1 ]
+grep -q "does not exist in the read-only image" $TMPD/activate.err
+[ ! -e $TMPD/mnt/atom/hostfstarget/srv/shared ]
+XXX
+EOF
+}
+
+@test "status reports the mounted version" {
+	good_install fsonly
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+./mosctl status -r $TMPD -capath $TMPD/manifestCA.pem
+st=$(./mosctl status -r $TMPD -capath $TMPD/manifestCA.pem --json)
+[ "$(echo "$st" | jq -r '.[] | select(.name == "hostfstarget") | .state')" = "stopped" ]
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/manifestCA.pem
+st=$(./mosctl status -r $TMPD -capath $TMPD/manifestCA.pem --json)
+echo "$st"
+t=$(echo "$st" | jq '.[] | select(.name == "hostfstarget")')
+[ "$(echo "$t" | jq -r .state)" = "mounted" ]
+[ "$(echo "$t" | jq -r .version)" = "1.0.0" ]
+[ "$(echo "$t" | jq -r .mounted_version)" = "1.0.0" ]
+[ "$(echo "$t" | jq -r .mounted_hash)" = "$(echo "$t" | jq -r .manifest_hash)" ]
+killall squashfuse || true
+XXX
+EOF
+}
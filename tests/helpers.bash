@@ -213,7 +213,7 @@ function good_install {
 	spectype=$1
 	write_install_yaml ocipath "$spectype"
 	./mosb iso build --key "${KEYS_DIR}/manifest/privkey.pem" \
-		--cert "${KEYS_DIR}/manifest-ca/cert.pem" \
+		--cert "${KEYS_DIR}/manifest/cert.pem" \
 		--file $TMPD/install.yaml \
 		--output-file $TMPD/mos.iso
 	rm $TMPD/install.yaml
@@ -223,14 +223,24 @@ function good_install {
 	./mosctl --debug install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml
 }
 
+# lxc_install spectype [init]: install in the test container, with the
+# given init type if one is given.
 function lxc_install {
 	# set up the file we need under TMPD
 	spectype=$1
 	write_install_yaml zotpath "$spectype"
+	lxc_install_yaml "$2"
+}
+
+# lxc_install_yaml [init]: install $TMPD/install.yaml, whose targets
+# all use the busybox image, in the test container.
+function lxc_install_yaml {
+	init=$1
+	for t in $(awk '/service_name:/ { print $3 }' $TMPD/install.yaml); do
+		skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:$t
+	done
 	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
 		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
-	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
-	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfstarget
 	cp mosctl ${TMPD}/
 	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
 	# copy TMPD over to the container under /iso/
@@ -239,5 +249,5 @@ function lxc_install {
 	# do the install
 	lxc-attach -n mos-test-1 -- cp /iso/manifestCA.pem /factory/secure/
 	lxc-attach -n mos-test-1 -- cp /iso/mosctl /usr/bin/
-	lxc-attach -n mos-test-1 -- mosctl install -f /iso/install.yaml
+	lxc-attach -n mos-test-1 -- mosctl install ${init:+--init $init} -f /iso/install.yaml
 }
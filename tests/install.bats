@@ -147,3 +147,592 @@ EOF
 	[ $failed -eq 1 ]
 }
 
+
+@test "mos install from remote registry" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy --format=oci --dest-tls-verify=false oci:zothub:busybox-squashfs docker://$ZOT_HOST:$ZOT_PORT/machine/puzzleos/hostfs:1.0.0
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	cat > $TMPD/registry-auth.yaml << EOF
+username: mos
+password: unused
+EOF
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml \
+		--registry docker://$ZOT_HOST:$ZOT_PORT/machine --registry-skip-tls \
+		--registry-auth $TMPD/registry-auth.yaml
+	[ -f $TMPD/atomfs-store/puzzleos/hostfs/index.json ]
+	[ -f $TMPD/config/manifest.git/manifest.yaml ]
+}
+
+@test "mos install from remote registry with bad manifest hash" {
+	sum=$(manifest_shasum busybox-squashfs)
+	sum=$(echo $sum | sha256sum | cut -f 1 -d \ )
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy --format=oci --dest-tls-verify=false oci:zothub:busybox-squashfs docker://$ZOT_HOST:$ZOT_PORT/machine/puzzleos/hostfs:1.0.0
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml \
+		--registry docker://$ZOT_HOST:$ZOT_PORT/machine --registry-skip-tls || failed=1
+	[ $failed -eq 1 ]
+	[ ! -f $TMPD/config/manifest.git/manifest.yaml ]
+}
+
+@test "mos install with a bad simple network fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: simple
+      ports:
+        - host_port: 8080
+          container_port: 70000
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "mos install with two targets forwarding the same host port fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: simple
+      ports:
+        - host_port: 8080
+          container_port: 80
+    mounts: []
+  - service_name: web2
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: simple
+      ports:
+        - host_port: 8080
+          container_port: 8080
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web2
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml 2> $TMPD/install.err || failed=1
+	cat $TMPD/install.err
+	[ $failed -eq 1 ]
+	grep -q "forwarded to both web and web2" $TMPD/install.err
+}
+
+@test "mos install with an undefined cni network fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+cni_networks:
+  - name: lan
+    config: '{"cniVersion": "1.0.0", "name": "lan", "plugins": [{"type": "bridge", "bridge": "cni0"}]}'
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: cni
+      cni_network: wan
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "mos install with an idmap which leaves root unmapped fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    idmap:
+      - type: uid
+        nsid: 0
+        range: 65536
+      - type: gid
+        nsid: 1
+        range: 65535
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "mos install with an idmap which maps host root fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    idmap:
+      - type: both
+        nsid: 0
+        hostid: 0
+        range: 1
+      - type: both
+        nsid: 1
+        range: 65535
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml 2> $TMPD/install.err || failed=1
+	[ $failed -eq 1 ]
+	grep -q "Host id 0 may not be mapped" $TMPD/install.err
+}
+
+@test "mos install with two nsgroups mapping the same host ids fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    idmap:
+      - type: both
+        nsid: 0
+        range: 1000
+      - type: both
+        nsid: 1000
+        hostid: 1100
+        range: 1
+    mounts: []
+  - service_name: db
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c2
+    network:
+      type: host
+    idmap:
+      - type: both
+        nsid: 0
+        range: 1000
+      - type: both
+        nsid: 1000
+        hostid: 1100
+        range: 1
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:db
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml 2> $TMPD/install.err || failed=1
+	[ $failed -eq 1 ]
+	grep -q "Host ids 1100-1100 mapped by db are used by nsgroup c1" $TMPD/install.err
+}
+
+@test "mos install with an idmap past the end of the host ids fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    idmap:
+      - type: both
+        nsid: 0
+        range: 1000
+      - type: both
+        nsid: 1000
+        hostid: 4294967000
+        range: 1000
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml 2> $TMPD/install.err || failed=1
+	[ $failed -eq 1 ]
+	grep -q "out of range" $TMPD/install.err
+}
+
+@test "mos install with bad resource limits fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    resources:
+      memory_max: lots
+      cpu_weight: 20000
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "mos install with an undefined seccomp policy fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    security:
+      cap_drop: [sys_admin]
+      seccomp: strict
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "mos install with a dependency cycle fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    depends_on: [db]
+    mounts: []
+  - service_name: db
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    after: [web]
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:db
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "mos install with a healthcheck without a command fails" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: web
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    healthcheck:
+      interval: 10s
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:web
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "mos install with an unknown init type fails" {
+	failed=0
+	./mosctl install --init upstart -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "mos install with a revoked signing cert fails" {
+	write_install_yaml zotpath hostfsonly
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+
+	serial=$(openssl x509 -in "${KEYS_DIR}/manifest/cert.pem" -noout -serial | cut -d= -f2)
+	mkdir -p $TMPD/crl
+	printf 'R\t991231235959Z\t230101000000Z\t%s\tunknown\t/CN=manifest\n' "$serial" > $TMPD/crl/index.txt
+	echo 01 > $TMPD/crl/crlnumber
+	cat > $TMPD/crl/ca.cnf << EOF2
+[ ca ]
+default_ca = mosca
+[ mosca ]
+database = $TMPD/crl/index.txt
+crlnumber = $TMPD/crl/crlnumber
+default_md = sha256
+default_crl_days = 30
+EOF2
+	openssl ca -gencrl -config $TMPD/crl/ca.cnf \
+		-keyfile "${KEYS_DIR}/manifest-ca/privkey.pem" \
+		-cert "${KEYS_DIR}/manifest-ca/cert.pem" \
+		-out $TMPD/manifestCA.crl
+	failed=0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
@@ -10,8 +10,321 @@ function teardown() {
 	lxc_teardown
 }
 
+# lxc_update [args]: update the test container to $TMPUD/install.yaml,
+# whose targets all use the busybox image, passing args to mosctl update.
+function lxc_update {
+	for t in $(awk '/service_name:/ { print $3 }' $TMPUD/install.yaml); do
+		skopeo copy oci:zothub:busybox-squashfs oci:$TMPUD/oci:$t
+	done
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	lxc-attach -n mos-test-1 -- mkdir -p /iso-update
+	tar -C $TMPUD -cf - . | lxc-attach -n mos-test-1 -- tar -C /iso-update -xf -
+	lxc-attach -n mos-test-1 -- mosctl update "$@" -f /iso-update/install.yaml
+}
+
+function start_supervisor {
+	lxc-attach -n mos-test-1 -- sh -c 'setsid mosctl supervise > /var/log/mos-supervise.log 2>&1 < /dev/null &'
+}
+
+# wait_state name state: wait for the supervisor to report that service
+# name is in state.
+function wait_state {
+	for i in $(seq 30); do
+		[ "$(lxc-attach -n mos-test-1 -- cat /run/mos/supervisor/$1.state)" = "$2" ] && return 0
+		sleep 1
+	done
+	echo "$1 did not reach state $2"
+	lxc-attach -n mos-test-1 -- cat /var/log/mos-supervise.log
+	return 1
+}
+
 # This is to test the test infrastructure itself.  If this fails,
 # then lxc is not set up correctly.
 @test "install of simple system in an lxc container" {
 	lxc_install hostfsonly
 }
+
+@test "activate of a container mounts its image idmapped" {
+	lxc_install containeronly
+	lxc-attach -n mos-test-1 -- mosctl activate -t hostfstarget > $TMPD/activate.out 2>&1 || {
+		cat $TMPD/activate.out
+		false
+	}
+	if grep -q "Idmapped mounts are not supported" $TMPD/activate.out; then
+		skip "idmapped mounts are not supported here"
+	fi
+	root=/scratch-writes/roots/hostfstarget
+	lxc-attach -n mos-test-1 -- mountpoint -q $root-source
+	# The image's files show up owned by the container's root, without
+	# having been shifted, and the image is not writeable.
+	[ "$(lxc-attach -n mos-test-1 -- stat -c %u $root-source/bin)" = "0" ]
+	[ "$(lxc-attach -n mos-test-1 -- stat -c %u $root/bin)" != "0" ]
+	failed=0
+	lxc-attach -n mos-test-1 -- touch $root/newfile || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "activate of a container without idmapped mounts shifts its files" {
+	lxc_install containeronly
+	lxc-attach -n mos-test-1 -- mosctl activate --no-idmapped-mounts -t hostfstarget
+	root=/scratch-writes/roots/hostfstarget
+	failed=0
+	lxc-attach -n mos-test-1 -- mountpoint -q $root-source || failed=1
+	[ $failed -eq 1 ]
+	[ "$(lxc-attach -n mos-test-1 -- findmnt -n -o FSTYPE $root)" = "overlay" ]
+	[ "$(lxc-attach -n mos-test-1 -- stat -c %u $root/bin)" != "0" ]
+	lxc-attach -n mos-test-1 -- touch $root/newfile
+}
+
+@test "a dropped nsgroup range is kept until its container stops" {
+	lxc_install containeronly
+	lxc-attach -n mos-test-1 -- mosctl activate -t hostfstarget
+	entry=$(lxc-attach -n mos-test-1 -- awk '/^lxc.idmap = u 0 / { print "root:" $5 ":" $6 }' /var/lib/lxc/hostfstarget/config)
+	lxc-attach -n mos-test-1 -- grep -qx "$entry" /etc/subuid
+
+	# Update to a manifest without the container
+	sed -e '/service_name: hostfstarget/,$d' $TMPD/install.yaml > $TMPUD/install.yaml
+	lxc_update
+
+	# The container still runs in the range
+	lxc-attach -n mos-test-1 -- grep -qx "$entry" /etc/subuid
+	lxc-attach -n mos-test-1 -- grep -q "idmap-name: c1" /config/dropped-idmaps.yaml
+
+	lxc-attach -n mos-test-1 -- systemctl stop hostfstarget
+	lxc-attach -n mos-test-1 -- mosctl gc
+	failed=0
+	lxc-attach -n mos-test-1 -- grep -qx "$entry" /etc/subuid || failed=1
+	[ $failed -eq 1 ]
+	failed=0
+	lxc-attach -n mos-test-1 -- test -e /config/dropped-idmaps.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "supervisor restarts a crashed container with backoff" {
+	lxc_install containeronly supervisor
+	start_supervisor
+	lxc-attach -n mos-test-1 -- mosctl activate -t hostfstarget
+	wait_state hostfstarget running
+	lxc-attach -n mos-test-1 -- lxc-wait -n hostfstarget -s RUNNING -t 30
+
+	# Kill it behind the supervisor's back, twice in a row
+	lxc-attach -n mos-test-1 -- lxc-stop -k -n hostfstarget
+	lxc-attach -n mos-test-1 -- lxc-wait -n hostfstarget -s RUNNING -t 30
+	lxc-attach -n mos-test-1 -- grep -q "hostfstarget failed, restarting in 1s" /var/log/mos-supervise.log
+	lxc-attach -n mos-test-1 -- lxc-stop -k -n hostfstarget
+	lxc-attach -n mos-test-1 -- lxc-wait -n hostfstarget -s RUNNING -t 30
+	lxc-attach -n mos-test-1 -- grep -q "hostfstarget failed, restarting in 2s" /var/log/mos-supervise.log
+	wait_state hostfstarget running
+}
+
+@test "supervisor does not take a requested stop for a crash" {
+	lxc_install containeronly supervisor
+	start_supervisor
+	lxc-attach -n mos-test-1 -- mosctl activate -t hostfstarget
+	wait_state hostfstarget running
+
+	# Activating a new version stops the container and starts it again
+	sed -e "s/version: 1.0.0/version: 1.0.1/" $TMPD/install.yaml > $TMPUD/install.yaml
+	lxc_update
+	lxc-attach -n mos-test-1 -- mosctl activate -t hostfstarget
+	wait_state hostfstarget running
+	lxc-attach -n mos-test-1 -- lxc-wait -n hostfstarget -s RUNNING -t 30
+	lxc-attach -n mos-test-1 -- grep -q "hostfstarget stopped" /var/log/mos-supervise.log
+	failed=0
+	lxc-attach -n mos-test-1 -- grep -q "hostfstarget failed" /var/log/mos-supervise.log || failed=1
+	[ $failed -eq 1 ]
+	failed=0
+	lxc-attach -n mos-test-1 -- test -e /run/mos/supervisor/hostfstarget.stop || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "supervisor starts services after those they depend on" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: second
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    depends_on: [first]
+    mounts: []
+  - service_name: first
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    mounts: []
+EOF
+	lxc_install_yaml supervisor
+	start_supervisor
+	lxc-attach -n mos-test-1 -- mosctl activate -t first
+	lxc-attach -n mos-test-1 -- mosctl activate -t second
+	wait_state first running
+	wait_state second running
+
+	# A new supervisor starts all enabled services, in order
+	lxc-attach -n mos-test-1 -- pkill -TERM -f "mosctl supervise"
+	wait_state first stopped
+	wait_state second stopped
+	start_supervisor
+	wait_state first running
+	wait_state second running
+	first=$(lxc-attach -n mos-test-1 -- grep -n "Starting first" /var/log/mos-supervise.log | cut -d: -f1)
+	second=$(lxc-attach -n mos-test-1 -- grep -n "Starting second" /var/log/mos-supervise.log | cut -d: -f1)
+	[ "$first" -lt "$second" ]
+}
+
+@test "activating the running version again does not restart the container" {
+	lxc_install containeronly
+	lxc-attach -n mos-test-1 -- mosctl activate -t hostfstarget
+	lxc-attach -n mos-test-1 -- lxc-wait -n hostfstarget -s RUNNING -t 30
+	lxc-attach -n mos-test-1 -- grep -q "version: 1.0.0" /scratch-writes/state/hostfstarget.yaml
+	pid=$(lxc-attach -n mos-test-1 -- lxc-info -H -p -n hostfstarget)
+	lxc-attach -n mos-test-1 -- mosctl activate -t hostfstarget
+	[ "$(lxc-attach -n mos-test-1 -- lxc-info -H -p -n hostfstarget)" = "$pid" ]
+}
+
+@test "a container's recorded state is dropped when it is torn down" {
+	lxc_install containeronly
+	cp $TMPD/install.yaml $TMPUD/install.yaml
+	sum=$(manifest_shasum busybox-squashfs)
+	cat >> $TMPUD/install.yaml << EOF
+  - service_name: extra
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    healthcheck:
+      command: ["false"]
+      interval: 1s
+    mounts: []
+EOF
+	# extra never becomes healthy, so the update is rolled back and
+	# extra is torn down again
+	failed=0
+	lxc_update --activate --wait-timeout 15s || failed=1
+	[ $failed -eq 1 ]
+	failed=0
+	lxc-attach -n mos-test-1 -- mountpoint -q /scratch-writes/roots/extra || failed=1
+	[ $failed -eq 1 ]
+	failed=0
+	lxc-attach -n mos-test-1 -- test -e /scratch-writes/state/extra.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "rolling back an update which drops a target keeps its volumes" {
+	write_install_yaml zotpath containeronly
+	cat >> $TMPD/install.yaml << EOF
+    volumes:
+      - name: scratch
+        dest: /tmp
+EOF
+	lxc_install_yaml
+	lxc-attach -n mos-test-1 -- mosctl activate -t hostfstarget
+	lxc-attach -n mos-test-1 -- sh -c 'echo persisted > /config/data/hostfstarget/scratch/state'
+
+	# Drop hostfstarget, and add extra, which never becomes healthy,
+	# so the update is rolled back.
+	sed -e '/service_name: hostfstarget/,$d' $TMPD/install.yaml > $TMPUD/install.yaml
+	sum=$(manifest_shasum busybox-squashfs)
+	cat >> $TMPUD/install.yaml << EOF
+  - service_name: extra
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c2
+    network:
+      type: host
+    healthcheck:
+      command: ["false"]
+      interval: 1s
+    mounts: []
+EOF
+	failed=0
+	lxc_update --activate --wait-timeout 15s || failed=1
+	[ $failed -eq 1 ]
+	lxc-attach -n mos-test-1 -- grep -q persisted /config/data/hostfstarget/scratch/state
+	lxc-attach -n mos-test-1 -- mosctl activate -t hostfstarget
+	lxc-attach -n mos-test-1 -- lxc-attach -n hostfstarget -- grep -q persisted /tmp/state
+}
+
+@test "only forwarded ports of a simple network container are reachable" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: hostfstarget
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: simple
+      address: 10.0.137.10
+      ports:
+        - host_port: 8080
+          container_port: 80
+    mounts: []
+EOF
+	lxc_install_yaml
+	lxc-attach -n mos-test-1 -- mosctl activate -t hostfstarget
+	lxc-attach -n mos-test-1 -- lxc-wait -n hostfstarget -s RUNNING -t 30
+	lxc-attach -n mos-test-1 -- lxc-attach -n hostfstarget -- httpd -p 80
+	lxc-attach -n mos-test-1 -- lxc-attach -n hostfstarget -- httpd -p 81
+
+	# A host outside, which routes to the containers' subnet
+	lxc-attach -n mos-test-1 -- sh -e << "EOF"
+ip netns add outside
+ip link add mosout0 type veth peer name mosout1
+ip link set mosout1 netns outside
+ip addr add 10.99.0.1/30 dev mosout0
+ip link set mosout0 up
+ip netns exec outside ip addr add 10.99.0.2/30 dev mosout1
+ip netns exec outside ip link set mosout1 up
+ip netns exec outside ip route add 10.0.137.0/24 via 10.99.0.1
+EOF
+
+	# Both ports are listening
+	lxc-attach -n mos-test-1 -- timeout 5 bash -c 'echo > /dev/tcp/10.0.137.10/81'
+	# The forwarded port is reachable from outside, the other is not
+	lxc-attach -n mos-test-1 -- ip netns exec outside timeout 5 bash -c 'echo > /dev/tcp/10.99.0.1/8080'
+	failed=0
+	lxc-attach -n mos-test-1 -- ip netns exec outside timeout 5 bash -c 'echo > /dev/tcp/10.0.137.10/81' || failed=1
+	[ $failed -eq 1 ]
+}
@@ -0,0 +1,176 @@
+load helpers
+
+function setup() {
+	common_setup
+}
+
+function teardown() {
+	common_teardown
+}
+
+# Build puzzlefs image $tag into the OCI layout $ocidir, with /etc/release
+# holding $release
+function puzzlefs_image {
+	ocidir=$1
+	tag=$2
+	release=$3
+	rootfs=$(mktemp -d "$TMPD/rootfs-XXXXX")
+	mkdir -p $rootfs/etc $rootfs/tmp
+	echo "$release" > $rootfs/etc/release
+	puzzlefs build $rootfs $ocidir $tag
+	rm -rf $rootfs
+}
+
+# Write and sign a puzzlefs install manifest under $dir with a hostfs
+# and an fs-only target of version $version
+function puzzlefs_install_yaml {
+	dir=$1
+	version=$2
+	puzzlefs_image $dir/oci hostfs "hostfs $version"
+	puzzlefs_image $dir/oci hostfstarget "hostfstarget $version"
+	hsum=$(manifest_shasum_from hostfs $dir/oci/index.json)
+	tsum=$(manifest_shasum_from hostfstarget $dir/oci/index.json)
+	cat > $dir/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+storage_type: puzzlefs
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: $version
+    manifest_hash: $hsum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: hostfstarget
+    imagepath: puzzleos/hostfstarget
+    version: $version
+    manifest_hash: $tsum
+    service_type: fs-only
+    nsgroup: ""
+    network:
+      type: none
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$dir/install.yaml.signed" "$dir/install.yaml"
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$dir/manifestCA.pem"
+}
+
+function puzzlefs_install {
+	puzzlefs_install_yaml $TMPD 1.0.0
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml
+	mkdir -p $TMPD/factory/secure $TMPD/root
+	cp ${KEYS_DIR}/manifest/cert.pem $TMPD/factory/secure/manifestCA.pem
+}
+
+@test "mos install with puzzlefs storage" {
+	puzzlefs_install
+	# All images are in the one puzzlefs layout
+	[ -f $TMPD/atomfs-store/puzzlefs/index.json ]
+	[ ! -e $TMPD/atomfs-store/puzzleos ]
+	umoci ls --layout $TMPD/atomfs-store/puzzlefs | grep "puzzleos/hostfs:1.0.0"
+	umoci ls --layout $TMPD/atomfs-store/puzzlefs | grep "puzzleos/hostfstarget:1.0.0"
+}
+
+@test "mos update to an atomfs manifest on puzzlefs storage fails" {
+	puzzlefs_install
+	puzzlefs_install_yaml $TMPUD 1.0.2
+	sed -i -e "s/storage_type: puzzlefs/storage_type: atomfs/" $TMPUD/install.yaml
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	failed=0
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "mos update with puzzlefs storage" {
+	puzzlefs_install
+	puzzlefs_install_yaml $TMPUD 1.0.2
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	grep -q 1.0.2 $TMPD/config/manifest.git/*.yaml
+	umoci ls --layout $TMPD/atomfs-store/puzzlefs | grep "puzzleos/hostfstarget:1.0.0"
+	umoci ls --layout $TMPD/atomfs-store/puzzlefs | grep "puzzleos/hostfstarget:1.0.2"
+}
+
+@test "activate and status with puzzlefs storage" {
+	puzzlefs_install
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+st=$(./mosctl status -r $TMPD -capath $TMPD/manifestCA.pem --json)
+[ "$(echo "$st" | jq -r '.[] | select(.name == "hostfstarget") | .state')" = "stopped" ]
+
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/manifestCA.pem
+grep "hostfstarget 1.0.0" $TMPD/mnt/atom/hostfstarget/etc/release
+st=$(./mosctl status -r $TMPD -capath $TMPD/manifestCA.pem --json)
+echo "$st"
+t=$(echo "$st" | jq '.[] | select(.name == "hostfstarget")')
+[ "$(echo "$t" | jq -r .state)" = "mounted" ]
+[ "$(echo "$t" | jq -r .mounted_version)" = "1.0.0" ]
+[ "$(echo "$t" | jq -r .mounted_hash)" = "$(echo "$t" | jq -r .manifest_hash)" ]
+
+# Re-activating the running version is a no-op
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/manifestCA.pem
+grep "hostfstarget 1.0.0" $TMPD/mnt/atom/hostfstarget/etc/release
+XXX
+EOF
+}
+
+@test "activate after a puzzlefs update mounts the new version" {
+	puzzlefs_install
+	puzzlefs_install_yaml $TMPUD 1.0.2
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/manifestCA.pem
+grep "hostfstarget 1.0.2" $TMPD/mnt/atom/hostfstarget/etc/release
+st=$(./mosctl status -r $TMPD -capath $TMPD/manifestCA.pem --json)
+t=$(echo "$st" | jq '.[] | select(.name == "hostfstarget")')
+[ "$(echo "$t" | jq -r .mounted_version)" = "1.0.2" ]
+XXX
+EOF
+}
+
+@test "gc frees the blobs of dropped puzzlefs images" {
+	puzzlefs_install
+	puzzlefs_install_yaml $TMPUD 1.0.2
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	nblobs=$(ls $TMPD/atomfs-store/puzzlefs/blobs/sha256 | wc -l)
+
+	# By default we keep what we need to roll back
+	./mosctl gc -r $TMPD
+	umoci ls --layout $TMPD/atomfs-store/puzzlefs | grep "puzzleos/hostfstarget:1.0.0"
+	[ $(ls $TMPD/atomfs-store/puzzlefs/blobs/sha256 | wc -l) -eq $nblobs ]
+
+	./mosctl gc -r $TMPD --keep 0
+	! umoci ls --layout $TMPD/atomfs-store/puzzlefs | grep "puzzleos/hostfstarget:1.0.0"
+	umoci ls --layout $TMPD/atomfs-store/puzzlefs | grep "puzzleos/hostfstarget:1.0.2"
+	[ $(ls $TMPD/atomfs-store/puzzlefs/blobs/sha256 | wc -l) -lt $nblobs ]
+
+	# Every blob the update brought is still there
+	for b in $(ls $TMPUD/oci/blobs/sha256); do
+		[ -f $TMPD/atomfs-store/puzzlefs/blobs/sha256/$b ]
+	done
+}
+
+@test "a puzzlefs image only records the blobs it uses" {
+	puzzlefs_install
+	tag=puzzleos/hostfstarget:1.0.0
+	record=$TMPD/atomfs-store/puzzlefs-blobs/$(echo -n "$tag" | sha256sum | cut -d ' ' -f 1)
+	hsum=$(manifest_shasum_from hostfs $TMPD/oci/index.json)
+	tsum=$(manifest_shasum_from hostfstarget $TMPD/oci/index.json)
+	grep -qx $tsum $record
+	! grep -qx $hsum $record
+	# More than the manifest, config and rootfs, for the chunks
+	[ $(wc -l < $record) -gt 3 ]
+	[ $(wc -l < $record) -lt $(ls $TMPD/oci/blobs/sha256 | wc -l) ]
+}
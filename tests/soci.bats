@@ -5,6 +5,9 @@ function setup() {
 }
 
 function teardown() {
+	if [ -n "$ZOT_PORT" ]; then
+		zot_teardown
+	fi
 	common_teardown
 }
 
@@ -166,3 +169,49 @@ failed=0
 XXX
 EOF
 }
+
+@test "make and mount an soci image from a docker repo base" {
+	zot_setup
+	echo -n "soci target fs" > $TMPD/IWASHERE
+	cat > $TMPD/stacker.yaml << EOF
+hostfs:
+  from:
+    type: oci
+    url: zothub:busybox-squashfs
+  import:
+    - path: ${TMPD}/IWASHERE
+      dest: /
+EOF
+	stacker --oci-dir $TMPD/oci --roots-dir=${TMPD}/roots \
+	  --stacker-dir=${TMPD}/.stacker \
+	  build -f ${TMPD}/stacker.yaml \
+	  --layer-type squashfs
+	umoci tag --image ${TMPD}/oci:hostfs-squashfs hostfs
+	skopeo copy --format=oci --dest-tls-verify=false oci:${TMPD}/oci:hostfs \
+		docker://$ZOT_HOST:$ZOT_PORT/machine/puzzleos/hostfs:1.0.0
+
+	./mosb soci build --key "${KEYS_DIR}/manifest/privkey.pem" \
+		--cert "${KEYS_DIR}/manifest/cert.pem" \
+		--image-path puzzleos/hostfs \
+		--oci-layer docker://$ZOT_HOST:$ZOT_PORT/machine/puzzleos/hostfs:1.0.0 \
+		--version 1.0.0 \
+		--soci-layer docker://$ZOT_HOST:$ZOT_PORT/machine/hostfs-meta:1.0.0 \
+		--skip-tls
+
+	mkdir ${TMPD}/mnt
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -ex
+./mosctl soci mount --repo-base docker://$ZOT_HOST:$ZOT_PORT/machine \
+    --metalayer hostfs-meta:1.0.0 \
+    --capath ${KEYS_DIR}/manifest-ca/cert.pem \
+    --cache-dir ${TMPD}/soci-cache \
+    --skip-tls \
+    --mountpoint ${TMPD}/mnt
+diff ${TMPD}/mnt/IWASHERE ${TMPD}/IWASHERE
+[ -f ${TMPD}/soci-cache/puzzleos/hostfs/index.json ]
+XXX
+EOF
+}
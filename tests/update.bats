@@ -258,3 +258,428 @@ killall squashfuse || true
 XXX
 EOF
 }
+
+@test "volumes persist across update and are removed by gc after their target" {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+  - service_name: hostfstarget
+    imagepath: puzzleos/hostfstarget
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: fs-only
+    nsgroup: ""
+    network:
+      type: none
+    mounts: []
+    volumes:
+      - name: scratch
+        dest: /tmp
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfstarget
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/manifestCA.pem
+echo persisted > $TMPD/mnt/atom/hostfstarget/tmp/state
+killall squashfuse || true
+XXX
+EOF
+	[ -f $TMPD/config/data/hostfstarget/scratch/state ]
+
+	# Update the image, the volume contents must remain
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	sed -i -e "s/1.0.0/1.0.2/; s/manifest_hash: .*/manifest_hash: $sum/" $TMPD/install.yaml
+	cp $TMPD/install.yaml $TMPUD/install.yaml
+	skopeo copy oci:zothub:busyboxu1-squashfs oci:$TMPUD/oci:hostfs
+	skopeo copy oci:zothub:busyboxu1-squashfs oci:$TMPUD/oci:hostfstarget
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	mkdir -p $TMPD/factory/secure $TMPD/root
+	cp ${KEYS_DIR}/manifest/cert.pem $TMPD/factory/secure/manifestCA.pem
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+./mosctl activate -r $TMPD -t hostfstarget -capath $TMPD/manifestCA.pem
+[ -e $TMPD/mnt/atom/hostfstarget/u1 ]
+grep persisted $TMPD/mnt/atom/hostfstarget/tmp/state
+killall squashfuse || true
+XXX
+EOF
+
+	# Drop the target, the volume is kept for rollback until gc
+	rm -rf $TMPUD/*
+	cp "${KEYS_DIR}/manifest/cert.pem" "$TMPUD/manifestCert.pem"
+	cat > $TMPUD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.2
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+EOF
+	skopeo copy oci:zothub:busyboxu1-squashfs oci:$TMPUD/oci:hostfs
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	[ -f $TMPD/config/data/hostfstarget/scratch/state ]
+	./mosctl gc -r $TMPD
+	[ -f $TMPD/config/data/hostfstarget/scratch/state ]
+	./mosctl gc -r $TMPD --keep 0
+	[ ! -e $TMPD/config/data/hostfstarget ]
+}
+
+# Install hostfs 1.0.0, and prepare an update to 1.0.2 (which has /u1)
+# under $TMPUD.
+function install_and_prepare_update {
+	sum=$(manifest_shasum busybox-squashfs)
+	cat > $TMPD/install.yaml << EOF
+version: 1
+product: de6c82c5-2e01-4c92-949b-a6545d30fc06
+update_type: complete
+targets:
+  - service_name: hostfs
+    imagepath: puzzleos/hostfs
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: hostfs
+    nsgroup: ""
+    network:
+      type: host
+    mounts: []
+EOF
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPD/install.yaml.signed" "$TMPD/install.yaml"
+	skopeo copy oci:zothub:busybox-squashfs oci:$TMPD/oci:hostfs
+	cp "${KEYS_DIR}/manifest-ca/cert.pem" "$TMPD/manifestCA.pem"
+	./mosctl install -c $TMPD/config -a $TMPD/atomfs-store -f $TMPD/install.yaml
+
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	sed -e "s/1.0.0/1.0.2/; s/manifest_hash: .*/manifest_hash: $sum/" \
+		$TMPD/install.yaml > $TMPUD/install.yaml
+	skopeo copy oci:zothub:busyboxu1-squashfs oci:$TMPUD/oci:hostfs
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	mkdir -p $TMPD/factory/secure $TMPD/root
+	cp ${KEYS_DIR}/manifest/cert.pem $TMPD/factory/secure/manifestCA.pem
+}
+
+# Run create-boot-fs, and check whether the booted hostfs is the update
+function boot_is_update {
+	mkdir -p "${TMPD}/mnt"
+	export TMPD
+	lxc-usernsexec -s -- << "EOF"
+unshare -m -- << "XXX"
+#!/bin/bash
+set -e
+./mosctl create-boot-fs --readonly -c $TMPD/config -a $TMPD/atomfs-store \
+   -s $TMPD/scratch-writes --ca-path $TMPD/manifestCA.pem --dest $TMPD/mnt
+sleep 1s
+[ -e $TMPD/mnt/etc ]
+res=0
+[ -e $TMPD/mnt/u1 ] || res=1
+killall squashfuse || true
+exit $res
+XXX
+EOF
+}
+
+@test "failed update leaves the system manifest alone" {
+	install_and_prepare_update
+	before=$(git -C $TMPD/config/manifest.git rev-parse HEAD)
+	# Break the update's manifest hash
+	sum=$(manifest_shasum busybox-squashfs)
+	sed -i -e "s/manifest_hash: .*/manifest_hash: $sum/" $TMPUD/install.yaml
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	failed=0
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+	[ "$(git -C $TMPD/config/manifest.git rev-parse HEAD)" = "$before" ]
+	[ -z "$(git -C $TMPD/config/manifest.git status --porcelain)" ]
+	! git -C $TMPD/config/manifest.git rev-parse --verify -q staging
+
+	# A failed pending update leaves no boot tries behind
+	failed=0
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml --pending || failed=1
+	[ $failed -eq 1 ]
+	[ ! -e $TMPD/config/boot-tries ]
+	! git -C $TMPD/config/manifest.git rev-parse --verify -q pending
+}
+
+@test "rollback to the previous system manifest" {
+	install_and_prepare_update
+	before=$(git -C $TMPD/config/manifest.git rev-parse HEAD)
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	grep -q 1.0.2 $TMPD/config/manifest.git/*.yaml
+	[ "$(git -C $TMPD/config/manifest.git rev-parse HEAD~1)" = "$before" ]
+
+	./mosctl rollback -r $TMPD
+	[ "$(git -C $TMPD/config/manifest.git rev-parse HEAD)" = "$before" ]
+	! grep -q 1.0.2 $TMPD/config/manifest.git/*.yaml
+	! boot_is_update
+
+	# There is nothing before the install
+	failed=0
+	./mosctl rollback -r $TMPD || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "pending update falls back after failed boots" {
+	install_and_prepare_update
+	before=$(git -C $TMPD/config/manifest.git rev-parse HEAD)
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml --pending --boot-tries 2
+	[ "$(git -C $TMPD/config/manifest.git rev-parse HEAD)" = "$before" ]
+	git -C $TMPD/config/manifest.git rev-parse --verify pending
+
+	# Two boots of the update which are never confirmed
+	boot_is_update
+	boot_is_update
+	# Then we fall back
+	! boot_is_update
+	! git -C $TMPD/config/manifest.git rev-parse --verify -q pending
+	[ "$(git -C $TMPD/config/manifest.git rev-parse HEAD)" = "$before" ]
+	[ ! -e $TMPD/config/boot-tries ]
+}
+
+@test "confirmed pending update becomes current" {
+	install_and_prepare_update
+	before=$(git -C $TMPD/config/manifest.git rev-parse HEAD)
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml --pending
+
+	# No other update while one is pending, and a refused one leaves
+	# the pending update's boot tries alone
+	[ "$(cat $TMPD/config/boot-tries)" = "3" ]
+	failed=0
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml --pending --boot-tries 7 || failed=1
+	[ $failed -eq 1 ]
+	[ "$(cat $TMPD/config/boot-tries)" = "3" ]
+	failed=0
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+	failed=0
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml --activate 2> $TMPD/update.err || failed=1
+	[ $failed -eq 1 ]
+	grep -q "before activating another" $TMPD/update.err
+	git -C $TMPD/config/manifest.git rev-parse --verify -q pending
+
+	boot_is_update
+	./mosctl confirm-boot -r $TMPD
+	[ "$(git -C $TMPD/config/manifest.git rev-parse HEAD~1)" = "$before" ]
+	! git -C $TMPD/config/manifest.git rev-parse --verify -q pending
+	[ ! -e $TMPD/config/boot-tries ]
+	boot_is_update
+}
+
+@test "activating hostfs stages a pending update for another boot" {
+	install_and_prepare_update
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml --pending --boot-tries 1
+	boot_is_update
+	[ "$(cat $TMPD/config/boot-tries)" = "0" ]
+
+	./mosctl activate -r $TMPD -t hostfs -capath $TMPD/manifestCA.pem
+	[ "$(cat $TMPD/config/boot-tries)" = "3" ]
+	# verify-boot leaves an update alone until it is booted or given up
+	./mosctl verify-boot -r $TMPD
+	git -C $TMPD/config/manifest.git rev-parse --verify pending
+
+	failed=0
+	./mosctl activate -r $TMPD -t hostfs --reboot --kexec -capath $TMPD/manifestCA.pem || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "update to an older release fails" {
+	install_and_prepare_update
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+
+	# The original install manifest has the older hostfs
+	failed=0
+	./mosctl update -r $TMPD -f $TMPD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+	grep -q 1.0.2 $TMPD/config/manifest.git/*.yaml
+
+	# The update has no serial, so is older than serial 10
+	echo "de6c82c5-2e01-4c92-949b-a6545d30fc06: 10" > $TMPD/config/release_serials.yaml
+	failed=0
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "update from a release candidate to its release" {
+	install_and_prepare_update
+	cp $TMPUD/install.yaml $TMPD/release.yaml
+	sed -i -e "s/1.0.2/1.0.2-rc.1/" $TMPUD/install.yaml
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	grep -q 1.0.2-rc.1 $TMPD/config/manifest.git/*.yaml
+
+	cp $TMPD/release.yaml $TMPUD/install.yaml
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	! grep -q 1.0.2-rc $TMPD/config/manifest.git/*.yaml
+
+	# Going back to a release candidate is a downgrade
+	sed -i -e "s/1.0.2/1.0.2-rc.2/" $TMPUD/install.yaml
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	failed=0
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "update for another product fails" {
+	install_and_prepare_update
+	[ "$(cat $TMPD/config/product)" = "de6c82c5-2e01-4c92-949b-a6545d30fc06" ]
+	echo "2f0e9a1c-5d53-4b9e-8f0a-5a1f3e1f6c7d" > $TMPD/config/product
+	failed=0
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "update records the product of systems installed without one" {
+	install_and_prepare_update
+	rm $TMPD/config/product
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	[ "$(cat $TMPD/config/product)" = "de6c82c5-2e01-4c92-949b-a6545d30fc06" ]
+}
+
+@test "update for another product than the installed manifests fails" {
+	install_and_prepare_update
+	rm $TMPD/config/product
+	# Pretend the system was installed from another product's manifest
+	(
+	cd $TMPD/config/manifest.git
+	f=$(ls *.yaml | grep -v '^manifest.yaml$')
+	sed -i -e "s/de6c82c5-2e01-4c92-949b-a6545d30fc06/2f0e9a1c-5d53-4b9e-8f0a-5a1f3e1f6c7d/" $f
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" -out $f.signed $f
+	git -c user.name=test -c user.email=test@test commit -q -a -m "other product"
+	)
+	failed=0
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml || failed=1
+	[ $failed -eq 1 ]
+	[ "$(cat $TMPD/config/product)" = "2f0e9a1c-5d53-4b9e-8f0a-5a1f3e1f6c7d" ]
+}
+
+@test "the verified system manifest is cached per commit" {
+	install_and_prepare_update
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	boot_is_update
+	head=$(git -C $TMPD/config/manifest.git rev-parse HEAD)
+	grep -q "\"commit\":\"$head\"" $TMPD/config/manifest-cache/master.json
+	[ "$(stat -c %a $TMPD/config/manifest-cache/key)" = "600" ]
+
+	# A tampered cache is ignored and replaced
+	sed -i -e 's/"Version":"1.0.2"/"Version":"1.0.9"/' $TMPD/config/manifest-cache/master.json
+	grep -q 1.0.9 $TMPD/config/manifest-cache/master.json
+	boot_is_update
+	! grep -q 1.0.9 $TMPD/config/manifest-cache/master.json
+}
+
+@test "history lists and compares system manifest revisions" {
+	install_and_prepare_update
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	git -C $TMPD/config/manifest.git log -1 --format=%B | grep -q "^Mos-Target: hostfs changed$"
+	git -C $TMPD/config/manifest.git log -1 --format=%B | grep -q "^Mos-Signer: .*CN=manifest"
+
+	./mosctl history -r $TMPD
+	./mosctl history -r $TMPD --json > $TMPD/history.json
+	[ "$(jq length $TMPD/history.json)" = "2" ]
+	[ "$(jq -r '.[0].action' $TMPD/history.json)" = "update" ]
+	[ "$(jq -r '.[1].action' $TMPD/history.json)" = "install" ]
+	[ "$(jq -r '.[1].changes[0]' $TMPD/history.json)" = "hostfs added" ]
+
+	./mosctl history diff -r $TMPD master~1 master
+	./mosctl history diff -r $TMPD --json master~1 master > $TMPD/diff.json
+	[ "$(jq -r '.[0].change' $TMPD/diff.json)" = "changed" ]
+	[ "$(jq -r '.[0].fields[] | select(.field == "version") | .new' $TMPD/diff.json)" = "1.0.2" ]
+
+	failed=0
+	./mosctl history diff -r $TMPD master~1 || failed=1
+	[ $failed -eq 1 ]
+}
+
+@test "gc removes images no longer in the system manifest" {
+	install_and_prepare_update
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	umoci ls --layout $TMPD/atomfs-store/puzzleos/hostfs | grep 1.0.0
+	umoci ls --layout $TMPD/atomfs-store/puzzleos/hostfs | grep 1.0.2
+
+	# By default we keep what we need to roll back
+	./mosctl gc -r $TMPD
+	umoci ls --layout $TMPD/atomfs-store/puzzleos/hostfs | grep 1.0.0
+	nblobs=$(ls $TMPD/atomfs-store/puzzleos/hostfs/blobs/sha256 | wc -l)
+
+	./mosctl gc -r $TMPD --keep 0
+	! umoci ls --layout $TMPD/atomfs-store/puzzleos/hostfs | grep 1.0.0
+	umoci ls --layout $TMPD/atomfs-store/puzzleos/hostfs | grep 1.0.2
+	[ $(ls $TMPD/atomfs-store/puzzleos/hostfs/blobs/sha256 | wc -l) -lt $nblobs ]
+	boot_is_update
+}
+
+@test "nsgroup uid ranges are released once dropped and restored by rollback" {
+	install_and_prepare_update
+	cp $TMPUD/install.yaml $TMPD/plain.yaml
+	sum=$(manifest_shasum busyboxu1-squashfs)
+	cat >> $TMPUD/install.yaml << EOF
+  - service_name: ctarget
+    imagepath: puzzleos/ctarget
+    version: 1.0.0
+    manifest_hash: $sum
+    service_type: container
+    nsgroup: c1
+    network:
+      type: host
+    mounts: []
+EOF
+	skopeo copy oci:zothub:busyboxu1-squashfs oci:$TMPUD/oci:ctarget
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	entry=$(grep "^root:" $TMPD/etc/subuid)
+	grep -qx "$entry" $TMPD/etc/subgid
+
+	# No container uses c1's range, so dropping its only target
+	# releases it right away
+	cp $TMPD/plain.yaml $TMPUD/install.yaml
+	openssl dgst -sha256 -sign "${KEYS_DIR}/manifest/privkey.pem" \
+		-out "$TMPUD/install.yaml.signed" "$TMPUD/install.yaml"
+	./mosctl update -r $TMPD -f $TMPUD/install.yaml
+	! grep -qx "$entry" $TMPD/etc/subuid
+	! grep -qx "$entry" $TMPD/etc/subgid
+	[ ! -e $TMPD/config/dropped-idmaps.yaml ]
+
+	# Rolling back to the manifest with c1 allocates its range again
+	./mosctl rollback -r $TMPD
+	grep -qx "$entry" $TMPD/etc/subuid
+	grep -qx "$entry" $TMPD/etc/subgid
+}